@@ -0,0 +1,44 @@
+package components
+
+import (
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awscognito"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// NewCognitoTriggers attaches the user pool triggers that keep the users
+// table in step with the pool. Confirmed sign-ups get a users row keyed on
+// their sub, opened with signUpPromo (e.g. "5.00") or an empty wallet when
+// it is empty. Tokens carry the user's plan, account status and
+// organisation as claims read from that row.
+func NewCognitoTriggers(stack awscdk.Stack, userPool awscognito.UserPool, image LambdaImage, signUpPromo string) {
+
+	postConfirmationFn := awslambda.NewFunction(stack, jsii.String("postConfirmationFromImage"), &awslambda.FunctionProps{
+		Code:    image.Code,
+		Handler: awslambda.Handler_FROM_IMAGE(),
+		Runtime: awslambda.Runtime_FROM_IMAGE(),
+		// Cognito waits at most five seconds for a trigger
+		Timeout: awscdk.Duration_Seconds(jsii.Number(5)),
+		Role:    image.Role,
+		Environment: image.environmentWith(map[string]*string{
+			"LAMBDA_HANDLER": jsii.String("postConfirmation"),
+			"SIGN_UP_PROMO":  jsii.String(signUpPromo),
+		}),
+	})
+
+	userPool.AddTrigger(awscognito.UserPoolOperation_POST_CONFIRMATION(), postConfirmationFn, awscognito.LambdaVersion_V1_0)
+
+	preTokenGenerationFn := awslambda.NewFunction(stack, jsii.String("preTokenGenerationFromImage"), &awslambda.FunctionProps{
+		Code:        image.Code,
+		Handler:     awslambda.Handler_FROM_IMAGE(),
+		Runtime:     awslambda.Runtime_FROM_IMAGE(),
+		Timeout:     awscdk.Duration_Seconds(jsii.Number(5)),
+		Role:        image.Role,
+		Environment: image.environmentWith(map[string]*string{"LAMBDA_HANDLER": jsii.String("preTokenGeneration")}),
+	})
+
+	// Version 2 events can add claims to access tokens as well as ID tokens;
+	// they need the Essentials tier set in CreateCognitoUserPool
+	userPool.AddTrigger(awscognito.UserPoolOperation_PRE_TOKEN_GENERATION_CONFIG(), preTokenGenerationFn, awscognito.LambdaVersion_V2_0)
+}
@@ -6,7 +6,7 @@ import (
 	"github.com/aws/jsii-runtime-go"
 )
 
-func CreateCognitoUserPool(stack awscdk.Stack) awscognito.UserPool {
+func CreateCognitoUserPool(stack awscdk.Stack, enableSupportGroup bool) awscognito.UserPool {
 
 	// Create a Cognito User Pool
 	userPool := awscognito.NewUserPool(stack, jsii.String("UserPool"), &awscognito.UserPoolProps{
@@ -25,6 +25,12 @@ func CreateCognitoUserPool(stack awscdk.Stack) awscognito.UserPool {
 		RemovalPolicy:   awscdk.RemovalPolicy_DESTROY,
 	})
 
+	// The pre-token-generation trigger adds claims to access tokens, which
+	// Cognito only allows on the Essentials tier or above. This CDK version
+	// has no property for the tier, so it is set on the template directly.
+	cfnUserPool := userPool.Node().DefaultChild().(awscognito.CfnUserPool)
+	cfnUserPool.AddPropertyOverride(jsii.String("UserPoolTier"), jsii.String("ESSENTIALS"))
+
 	readAccessScope := awscognito.NewResourceServerScope(&awscognito.ResourceServerScopeProps{
 		ScopeName:        jsii.String("read"),
 		ScopeDescription: jsii.String("Read access"),
@@ -72,6 +78,23 @@ func CreateCognitoUserPool(stack awscdk.Stack) awscognito.UserPool {
 		},
 	})
 
+	// Groups checked by the Lambda against the cognito:groups claim
+	awscognito.NewCfnUserPoolGroup(stack, jsii.String("AdminsGroup"), &awscognito.CfnUserPoolGroupProps{
+		UserPoolId:  userPool.UserPoolId(),
+		GroupName:   jsii.String("admins"),
+		Description: jsii.String("Administrators allowed to run privileged operations"),
+		Precedence:  jsii.Number(0),
+	})
+
+	if enableSupportGroup {
+		awscognito.NewCfnUserPoolGroup(stack, jsii.String("SupportGroup"), &awscognito.CfnUserPoolGroupProps{
+			UserPoolId:  userPool.UserPoolId(),
+			GroupName:   jsii.String("support"),
+			Description: jsii.String("Support staff allowed to read other users' accounts"),
+			Precedence:  jsii.Number(10),
+		})
+	}
+
 	awscdk.NewCfnOutput(stack, jsii.String("UserPoolID"), &awscdk.CfnOutputProps{
 		Value:       userPool.UserPoolId(),
 		Description: jsii.String("User Pool Client ID"),
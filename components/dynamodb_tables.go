@@ -26,6 +26,8 @@ func CreateDynamoDBTables(stack awscdk.Stack) {
 			Name: jsii.String("api_key"),
 			Type: awsdynamodb.AttributeType_STRING,
 		},
+		// Expired and revoked keys are removed by DynamoDB
+		TimeToLiveAttribute: jsii.String("ttl"),
 		GlobalSecondaryIndexes: &[]*awsdynamodb.GlobalSecondaryIndexPropsV2{
 			{
 				IndexName: jsii.String("user_id-index"),
@@ -40,7 +42,107 @@ func CreateDynamoDBTables(stack awscdk.Stack) {
 	}
 
 	// Transactions Table Fields
+	// Rows are keyed by user and ULID transaction id, so a user's history is
+	// a single query in time order
 	transactionsTableProps := &awsdynamodb.TablePropsV2{
+		TableName: jsii.String("transactions_v2"),
+		Billing:   awsdynamodb.Billing_OnDemand(),
+		PartitionKey: &awsdynamodb.Attribute{
+			Name: jsii.String("user_id"),
+			Type: awsdynamodb.AttributeType_STRING,
+		},
+		SortKey: &awsdynamodb.Attribute{
+			Name: jsii.String("transaction_id"),
+			Type: awsdynamodb.AttributeType_STRING,
+		},
+		RemovalPolicy: awscdk.RemovalPolicy_DESTROY,
+	}
+
+	// Ledger Entries Table Fields
+	// Immutable double-entry journal; each item is one balanced entry
+	ledgerEntriesTableProps := &awsdynamodb.TablePropsV2{
+		TableName: jsii.String("ledger_entries"),
+		Billing:   awsdynamodb.Billing_OnDemand(),
+		PartitionKey: &awsdynamodb.Attribute{
+			Name: jsii.String("entry_id"),
+			Type: awsdynamodb.AttributeType_STRING,
+		},
+		PointInTimeRecovery: jsii.Bool(true),
+		RemovalPolicy:       awscdk.RemovalPolicy_RETAIN,
+	}
+
+	// Idempotency Keys Table Fields
+	// Results of requests made with an idempotency key, replayed for a day
+	idempotencyTableProps := &awsdynamodb.TablePropsV2{
+		TableName: jsii.String("idempotency_keys"),
+		Billing:   awsdynamodb.Billing_OnDemand(),
+		PartitionKey: &awsdynamodb.Attribute{
+			Name: jsii.String("idempotency_key"),
+			Type: awsdynamodb.AttributeType_STRING,
+		},
+		TimeToLiveAttribute: jsii.String("ttl"),
+		RemovalPolicy:       awscdk.RemovalPolicy_DESTROY,
+	}
+
+	// Rate Limits Table Fields
+	// One limiter per API key; items expire once the limiter is full again
+	rateLimitsTableProps := &awsdynamodb.TablePropsV2{
+		TableName: jsii.String("rate_limits"),
+		Billing:   awsdynamodb.Billing_OnDemand(),
+		PartitionKey: &awsdynamodb.Attribute{
+			Name: jsii.String("rate_key"),
+			Type: awsdynamodb.AttributeType_STRING,
+		},
+		TimeToLiveAttribute: jsii.String("ttl"),
+		RemovalPolicy:       awscdk.RemovalPolicy_DESTROY,
+	}
+
+	// Plans Table Fields
+	// Subscription plans, seeded with the defaults by the seed-plans command
+	plansTableProps := &awsdynamodb.TablePropsV2{
+		TableName: jsii.String("plans"),
+		Billing:   awsdynamodb.Billing_OnDemand(),
+		PartitionKey: &awsdynamodb.Attribute{
+			Name: jsii.String("plan_id"),
+			Type: awsdynamodb.AttributeType_STRING,
+		},
+		RemovalPolicy: awscdk.RemovalPolicy_DESTROY,
+	}
+
+	// Prices Table Fields
+	// Price tables of metered operations, edited by finance and read by the
+	// Lambda within a minute of a change
+	pricesTableProps := &awsdynamodb.TablePropsV2{
+		TableName: jsii.String("prices"),
+		Billing:   awsdynamodb.Billing_OnDemand(),
+		PartitionKey: &awsdynamodb.Attribute{
+			Name: jsii.String("operation"),
+			Type: awsdynamodb.AttributeType_STRING,
+		},
+		PointInTimeRecovery: jsii.Bool(true),
+		RemovalPolicy:       awscdk.RemovalPolicy_RETAIN,
+	}
+
+	// Usage Table Fields
+	// Calls and metered cost per user and calendar month (YYYY-MM)
+	usageTableProps := &awsdynamodb.TablePropsV2{
+		TableName: jsii.String("usage"),
+		Billing:   awsdynamodb.Billing_OnDemand(),
+		PartitionKey: &awsdynamodb.Attribute{
+			Name: jsii.String("user_id"),
+			Type: awsdynamodb.AttributeType_STRING,
+		},
+		SortKey: &awsdynamodb.Attribute{
+			Name: jsii.String("period"),
+			Type: awsdynamodb.AttributeType_STRING,
+		},
+		RemovalPolicy: awscdk.RemovalPolicy_DESTROY,
+	}
+
+	// Legacy Transactions Table Fields
+	// Keyed by millisecond ids; kept until migrate-transactions has copied
+	// its rows into transactions_v2, and retained if removed from the stack
+	legacyTransactionsTableProps := &awsdynamodb.TablePropsV2{
 		TableName: jsii.String("transactions"),
 		Billing:   awsdynamodb.Billing_OnDemand(),
 		PartitionKey: &awsdynamodb.Attribute{
@@ -57,13 +159,20 @@ func CreateDynamoDBTables(stack awscdk.Stack) {
 				ProjectionType: awsdynamodb.ProjectionType_ALL,
 			},
 		},
-		RemovalPolicy: awscdk.RemovalPolicy_DESTROY,
+		RemovalPolicy: awscdk.RemovalPolicy_RETAIN,
 	}
 
 	// Create Tables
 
 	awsdynamodb.NewTableV2(stack, jsii.String("UsersTable"), usersTableProps)
 	awsdynamodb.NewTableV2(stack, jsii.String("ApiKeysTable"), apiKeysTableProps)
-	awsdynamodb.NewTableV2(stack, jsii.String("TransactionsTable"), transactionsTableProps)
+	awsdynamodb.NewTableV2(stack, jsii.String("TransactionsTable"), legacyTransactionsTableProps)
+	awsdynamodb.NewTableV2(stack, jsii.String("TransactionsV2Table"), transactionsTableProps)
+	awsdynamodb.NewTableV2(stack, jsii.String("IdempotencyKeysTable"), idempotencyTableProps)
+	awsdynamodb.NewTableV2(stack, jsii.String("LedgerEntriesTable"), ledgerEntriesTableProps)
+	awsdynamodb.NewTableV2(stack, jsii.String("RateLimitsTable"), rateLimitsTableProps)
+	awsdynamodb.NewTableV2(stack, jsii.String("PlansTable"), plansTableProps)
+	awsdynamodb.NewTableV2(stack, jsii.String("UsageTable"), usageTableProps)
+	awsdynamodb.NewTableV2(stack, jsii.String("PricesTable"), pricesTableProps)
 
 }
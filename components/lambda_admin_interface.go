@@ -9,6 +9,8 @@ import (
 	"github.com/aws/aws-cdk-go/awscdk/v2/awscognito"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssecretsmanager"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/jsii-runtime-go"
 )
@@ -23,7 +25,28 @@ type LambdaImageStackProps struct {
 	stackDetails StackConfigs
 }
 
-func NewLambdaImageDeployStack(stack awscdk.Stack, userPool awscognito.UserPool, imageFolder string, apiName string) {
+// LambdaImage is the container image, role and environment shared by every
+// function built from the lambda folder. LAMBDA_HANDLER selects which entry
+// point a function runs.
+type LambdaImage struct {
+	Code        awslambda.Code
+	Role        awsiam.IRole
+	Environment map[string]*string
+}
+
+// environmentWith returns the shared environment plus the given entries.
+func (image LambdaImage) environmentWith(extra map[string]*string) *map[string]*string {
+	environment := map[string]*string{}
+	for name, value := range image.Environment {
+		environment[name] = value
+	}
+	for name, value := range extra {
+		environment[name] = value
+	}
+	return &environment
+}
+
+func NewLambdaImageDeployStack(stack awscdk.Stack, userPool awscognito.UserPool, exportsBucket awss3.Bucket, imageFolder string, apiName string) LambdaImage {
 
 	dir, _ := os.Getwd()
 
@@ -39,15 +62,62 @@ func NewLambdaImageDeployStack(stack awscdk.Stack, userPool awscognito.UserPool,
 		},
 	})
 
+	// Pepper mixed into every API key hash, kept out of the api_keys table
+	apiKeyPepper := awssecretsmanager.NewSecret(stack, jsii.String("ApiKeyPepper"), &awssecretsmanager.SecretProps{
+		Description: jsii.String("Pepper for hashing API keys at rest"),
+		GenerateSecretString: &awssecretsmanager.SecretStringGenerator{
+			PasswordLength:     jsii.Number(64),
+			ExcludePunctuation: jsii.Bool(true),
+		},
+	})
+	apiKeyPepper.GrantRead(dynamoDBRole, nil)
+
+	// Exports are written by the Lambda and downloaded with URLs it presigns
+	exportsBucket.GrantReadWrite(dynamoDBRole, nil)
+
+	// Personal data exports read the user's attributes and account deletion
+	// disables and deletes their sign-in. This is a
+	// policy of its own rather than a grant on the role, because the
+	// Cognito trigger functions share the role and the pool depends on
+	// them, which a grant naming the pool would turn into a cycle.
+	awsiam.NewPolicy(stack, jsii.String("UserPoolAdminPolicy"), &awsiam.PolicyProps{
+		Roles: &[]awsiam.IRole{dynamoDBRole},
+		Statements: &[]awsiam.PolicyStatement{
+			awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+				Actions: jsii.Strings(
+					"cognito-idp:AdminDisableUser",
+					"cognito-idp:AdminUserGlobalSignOut",
+					"cognito-idp:AdminDeleteUser",
+					"cognito-idp:AdminGetUser",
+				),
+				Resources: jsii.Strings(*userPool.UserPoolArn()),
+			}),
+		},
+	})
+
+	image := LambdaImage{
+		Code: ecr_image,
+		Role: dynamoDBRole,
+		Environment: map[string]*string{
+			"API_KEY_PEPPER_SECRET_ARN": apiKeyPepper.SecretArn(),
+			"EXPORT_BUCKET_NAME":        exportsBucket.BucketName(),
+		},
+	}
+
 	// Create Lambda function
 	lambdaFn := awslambda.NewFunction(stack, jsii.String("lambdaFromImage"), &awslambda.FunctionProps{
-		Code: ecr_image,
+		Code: image.Code,
 		// Handler and Runtime must be *FROM_IMAGE* when provisioning Lambda from container.
 		Handler:      awslambda.Handler_FROM_IMAGE(),
 		Runtime:      awslambda.Runtime_FROM_IMAGE(),
 		FunctionName: jsii.String(apiName),
 		Timeout:      awscdk.Duration_Seconds(jsii.Number(60)),
-		Role:         dynamoDBRole,
+		Role:         image.Role,
+		// Only the API function is told the pool; the trigger functions
+		// are part of it
+		Environment: image.environmentWith(map[string]*string{
+			"USER_POOL_ID": userPool.UserPoolId(),
+		}),
 	})
 
 	lambdaFn.AddAlias(jsii.String("Live"), &awslambda.AliasOptions{})
@@ -57,6 +127,27 @@ func NewLambdaImageDeployStack(stack awscdk.Stack, userPool awscognito.UserPool,
 		CognitoUserPools: &[]awscognito.IUserPool{userPool},
 	})
 
+	// Machine clients authenticate with an API key in the x-api-key or
+	// Authorization: Bearer header instead of a Cognito token
+	apiKeyAuthorizerFn := awslambda.NewFunction(stack, jsii.String("apiKeyAuthorizerFromImage"), &awslambda.FunctionProps{
+		Code:        image.Code,
+		Handler:     awslambda.Handler_FROM_IMAGE(),
+		Runtime:     awslambda.Runtime_FROM_IMAGE(),
+		Timeout:     awscdk.Duration_Seconds(jsii.Number(10)),
+		Role:        image.Role,
+		Environment: image.environmentWith(map[string]*string{"LAMBDA_HANDLER": jsii.String("authorizer")}),
+	})
+
+	// Either header may carry the key, so API Gateway cannot require or
+	// cache on a single identity source; the function caches verified keys
+	// itself instead
+	apiKeyAuthorizer := awsapigateway.NewRequestAuthorizer(stack, jsii.String("ApiKeyAuthorizer"), &awsapigateway.RequestAuthorizerProps{
+		Handler:         apiKeyAuthorizerFn,
+		IdentitySources: &[]*string{awsapigateway.IdentitySource_Header(jsii.String("Authorization"))},
+		ResultsCacheTtl: awscdk.Duration_Seconds(jsii.Number(0)),
+	})
+	apiKeyAuthorizer.Node().DefaultChild().(awscdk.CfnResource).AddPropertyDeletionOverride(jsii.String("IdentitySource"))
+
 	// Create an API Gateway
 	restApi := awsapigateway.NewRestApi(stack, jsii.String("myRESTApi"), &awsapigateway.RestApiProps{
 		RestApiName: jsii.String(apiName),
@@ -75,6 +166,15 @@ func NewLambdaImageDeployStack(stack awscdk.Stack, userPool awscognito.UserPool,
 					"application/json": awsapigateway.Model_EMPTY_MODEL(), // Specify JSON as the response content type
 				},
 			},
+			{
+				StatusCode: jsii.String("429"),
+				ResponseParameters: &map[string]*bool{
+					"method.response.header.Access-Control-Allow-Origin": jsii.Bool(true),
+				},
+				ResponseModels: &map[string]awsapigateway.IModel{
+					"application/json": awsapigateway.Model_EMPTY_MODEL(),
+				},
+			},
 		},
 		AuthorizationType: awsapigateway.AuthorizationType_COGNITO,
 		Authorizer:        authorizer,
@@ -87,25 +187,99 @@ func NewLambdaImageDeployStack(stack awscdk.Stack, userPool awscognito.UserPool,
 				"method.response.header.Access-Control-Allow-Origin": jsii.String("'*'"),
 			},
 		},
+		// Rate-limited calls and calls over the plan's quota fail with an
+		// error whose JSON message, including retry_after_seconds, becomes
+		// the body
+		{
+			StatusCode:       jsii.String("429"),
+			SelectionPattern: jsii.String(`.*"code":"(RATE_LIMITED|QUOTA_EXCEEDED)".*`),
+			ResponseParameters: &map[string]*string{
+				"method.response.header.Access-Control-Allow-Origin": jsii.String("'*'"),
+			},
+			ResponseTemplates: &map[string]*string{
+				"application/json": jsii.String("$input.path('$.errorMessage')"),
+			},
+		},
 	}
 
+	// Wrap the client body with the caller's Cognito claims so the Lambda
+	// knows who is calling. Passthrough is disabled so a client can never
+	// supply its own identity. The Idempotency-Key header is passed through
+	// for retry-safe money-moving operations.
+	requestTemplate := `{
+  "operation": $input.json('$.operation'),
+  "payload": $input.json('$.payload'),
+  "idempotency_key": "$util.escapeJavaScript($input.params('Idempotency-Key'))",
+  "identity": {
+    "sub": "$util.escapeJavaScript($context.authorizer.claims.sub)",
+    "email": "$util.escapeJavaScript($context.authorizer.claims.email)",
+    "groups": "$util.escapeJavaScript($context.authorizer.claims['cognito:groups'])",
+    "scope": "$util.escapeJavaScript($context.authorizer.claims.scope)"
+  }
+}`
+
 	integrationOptions := &awsapigateway.LambdaIntegrationOptions{
 		IntegrationResponses: integrationResponse,
 		Proxy:                jsii.Bool(false),
+		RequestTemplates: &map[string]*string{
+			"application/json": jsii.String(requestTemplate),
+		},
+		PassthroughBehavior: awsapigateway.PassthroughBehavior_NEVER,
 	}
 
+	// API key routes take the caller from the API key authorizer's context
+	// instead of Cognito claims
+	apiKeyRequestTemplate := `{
+  "operation": $input.json('$.operation'),
+  "payload": $input.json('$.payload'),
+  "idempotency_key": "$util.escapeJavaScript($input.params('Idempotency-Key'))",
+  "identity": {
+    "sub": "$util.escapeJavaScript($context.authorizer.user_id)",
+    "api_key_id": "$util.escapeJavaScript($context.authorizer.key_id)"
+  }
+}`
+
+	apiKeyIntegrationOptions := &awsapigateway.LambdaIntegrationOptions{
+		IntegrationResponses: integrationResponse,
+		Proxy:                jsii.Bool(false),
+		RequestTemplates: &map[string]*string{
+			"application/json": jsii.String(apiKeyRequestTemplate),
+		},
+		PassthroughBehavior: awsapigateway.PassthroughBehavior_NEVER,
+	}
+
+	apiKeyMethodOptions := &awsapigateway.MethodOptions{
+		MethodResponses:   methodOptions.MethodResponses,
+		AuthorizationType: awsapigateway.AuthorizationType_CUSTOM,
+		Authorizer:        apiKeyAuthorizer,
+	}
+
+	corsHeaders := append(*awsapigateway.Cors_DEFAULT_HEADERS(), jsii.String("Idempotency-Key"))
+
 	// Create a resource and add method
 	corrEndpoint := restApi.Root().AddResource(jsii.String("correlation"), &awsapigateway.ResourceOptions{
 		DefaultCorsPreflightOptions: &awsapigateway.CorsOptions{
 			AllowOrigins: awsapigateway.Cors_ALL_ORIGINS(),
+			AllowHeaders: &corsHeaders,
 		},
 	})
 
 	corrEndpoint.AddMethod(jsii.String("POST"), awsapigateway.NewLambdaIntegration(lambdaFn, integrationOptions), methodOptions)
 
+	// The same operations for machine clients, authenticated by API key
+	machineCorrEndpoint := restApi.Root().AddResource(jsii.String("machine"), nil).AddResource(jsii.String("correlation"), &awsapigateway.ResourceOptions{
+		DefaultCorsPreflightOptions: &awsapigateway.CorsOptions{
+			AllowOrigins: awsapigateway.Cors_ALL_ORIGINS(),
+			AllowHeaders: &corsHeaders,
+		},
+	})
+
+	machineCorrEndpoint.AddMethod(jsii.String("POST"), awsapigateway.NewLambdaIntegration(lambdaFn, apiKeyIntegrationOptions), apiKeyMethodOptions)
+
 	awscdk.NewCfnOutput(stack, jsii.String("myRESTApiEndpoint"), &awscdk.CfnOutputProps{
 		Value:       restApi.Url(),
 		Description: jsii.String("REST API Endpoint"),
 	})
 
+	return image
 }
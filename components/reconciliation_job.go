@@ -0,0 +1,35 @@
+package components
+
+import (
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsevents"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awseventstargets"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// NewReconciliationJob runs the wallet reconciliation every night. It only
+// reports drift unless fix is set, in which case it also posts correcting
+// ledger entries. Reports are written under reconciliation/ in the exports
+// bucket.
+func NewReconciliationJob(stack awscdk.Stack, image LambdaImage, fix bool) {
+
+	reconcileFn := awslambda.NewFunction(stack, jsii.String("reconcileFromImage"), &awslambda.FunctionProps{
+		Code:        image.Code,
+		Handler:     awslambda.Handler_FROM_IMAGE(),
+		Runtime:     awslambda.Runtime_FROM_IMAGE(),
+		Timeout:     awscdk.Duration_Minutes(jsii.Number(15)),
+		Role:        image.Role,
+		Environment: image.environmentWith(map[string]*string{"LAMBDA_HANDLER": jsii.String("reconcile")}),
+	})
+
+	schedule := awsevents.NewRule(stack, jsii.String("ReconciliationSchedule"), &awsevents.RuleProps{
+		Schedule: awsevents.Schedule_Cron(&awsevents.CronOptions{
+			Hour:   jsii.String("3"),
+			Minute: jsii.String("0"),
+		}),
+	})
+	schedule.AddTarget(awseventstargets.NewLambdaFunction(reconcileFn, &awseventstargets.LambdaFunctionProps{
+		Event: awsevents.RuleTargetInput_FromObject(map[string]interface{}{"fix": fix}),
+	}))
+}
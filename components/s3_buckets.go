@@ -0,0 +1,28 @@
+package components
+
+import (
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
+	"github.com/aws/jsii-runtime-go"
+)
+
+func CreateExportsBucket(stack awscdk.Stack) awss3.Bucket {
+
+	// Private bucket for generated exports, downloaded only through
+	// presigned URLs. Files are short lived and removed after a week.
+	exportsBucket := awss3.NewBucket(stack, jsii.String("ExportsBucket"), &awss3.BucketProps{
+		BlockPublicAccess: awss3.BlockPublicAccess_BLOCK_ALL(),
+		Encryption:        awss3.BucketEncryption_S3_MANAGED,
+		EnforceSSL:        jsii.Bool(true),
+		LifecycleRules: &[]*awss3.LifecycleRule{
+			{
+				Prefix:     jsii.String("exports/"),
+				Expiration: awscdk.Duration_Days(jsii.Number(7)),
+			},
+		},
+		RemovalPolicy:     awscdk.RemovalPolicy_DESTROY,
+		AutoDeleteObjects: jsii.Bool(true),
+	})
+
+	return exportsBucket
+}
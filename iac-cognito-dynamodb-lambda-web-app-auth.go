@@ -12,8 +12,15 @@ import (
 )
 
 type StackConfigs struct {
-	ImageFolder string
-	ApiName     string
+	ImageFolder        string
+	ApiName            string
+	EnableSupportGroup bool
+	// ReconcileFix lets the nightly reconciliation post correcting entries
+	// instead of only reporting drift.
+	ReconcileFix bool
+	// SignUpPromo is the wallet balance, in USD, granted to users when
+	// they confirm their sign-up; empty for none.
+	SignUpPromo string
 }
 
 type MyCdkStackProps struct {
@@ -30,13 +37,20 @@ func NewMyCdkStack(scope constructs.Construct, id string, props *MyCdkStackProps
 
 	imageFolder := props.stackDetails.ImageFolder
 	apiName := props.stackDetails.ApiName
+	enableSupportGroup := props.stackDetails.EnableSupportGroup
 
 	// Call the function to create DynamoDB tables
 	components.CreateDynamoDBTables(stack)
 
-	userPool := components.CreateCognitoUserPool(stack)
+	userPool := components.CreateCognitoUserPool(stack, enableSupportGroup)
 
-	components.NewLambdaImageDeployStack(stack, userPool, imageFolder, apiName)
+	exportsBucket := components.CreateExportsBucket(stack)
+
+	image := components.NewLambdaImageDeployStack(stack, userPool, exportsBucket, imageFolder, apiName)
+
+	components.NewReconciliationJob(stack, image, props.stackDetails.ReconcileFix)
+
+	components.NewCognitoTriggers(stack, userPool, image, props.stackDetails.SignUpPromo)
 
 	return stack
 }
@@ -49,8 +63,11 @@ func main() {
 			Env: env(),
 		},
 		stackDetails: StackConfigs{
-			ImageFolder: "lambda",
-			ApiName:     "probablyAPI",
+			ImageFolder:        "lambda",
+			ApiName:            "probablyAPI",
+			EnableSupportGroup: true,
+			ReconcileFix:       false,
+			SignUpPromo:        "",
 		},
 	})
 
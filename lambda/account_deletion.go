@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+const (
+	// redactedDescription replaces descriptions someone typed in, which
+	// may say who the user was.
+	redactedDescription = "[redacted]"
+	// redactBatchSize is how many transactions are read at a time.
+	redactBatchSize = 100
+	// closeWalletAttempts is how many times closeWallet reads the balance
+	// before giving up on a wallet that keeps moving.
+	closeWalletAttempts = 3
+)
+
+var errAccountDeleting = &OperationError{
+	Code:    "ACCOUNT_DELETING",
+	Message: "account is being deleted",
+}
+
+// AccountDeletion is the result of deleteAccount.
+type AccountDeletion struct {
+	UserID string `json:"user_id"`
+	// ClosingBalance is what was left in the wallet and moved to suspense.
+	ClosingBalance       *Money `json:"closing_balance,omitempty"`
+	ApiKeysDeleted       int    `json:"api_keys_deleted"`
+	TransactionsRedacted int    `json:"transactions_redacted"`
+	UsagePeriodsDeleted  int    `json:"usage_periods_deleted"`
+	ExportsDeleted       int    `json:"exports_deleted"`
+}
+
+// holdsTypedText reports whether a transaction's description was typed by a
+// person: memos from logTransaction, and rows migrated from the original
+// table. Every other description is a fixed system text.
+func holdsTypedText(transaction Transaction) bool {
+	return transaction.Type == transactionTypeManual || transaction.LegacyTransactionID != ""
+}
+
+// closeWallet moves whatever is left in the wallet, in credit or owed, to
+// suspense so the books still balance once the wallet is gone. The balance
+// is read afresh, and read again after each posting, so a movement that
+// lands while the account is being deleted is closed out too rather than
+// left behind or overdrawn.
+func closeWallet(ctx context.Context, userID string) (*Money, error) {
+	var closed *Money
+	for attempt := 0; ; attempt++ {
+		user, err := userStore.GetUser(ctx, userID)
+		if err != nil {
+			return closed, fmt.Errorf("failed to get user, %v", err)
+		}
+		balance := user.WalletAmount
+		if balance.IsZero() {
+			return closed, nil
+		}
+		if attempt == closeWalletAttempts {
+			return closed, fmt.Errorf("wallet balance still changing after %d attempts", closeWalletAttempts)
+		}
+
+		err = postWalletEntry(ctx, userID, balance.Neg(), accountSuspense, transactionTypeAccountClosure, "account deleted")
+		if err == errInsufficientFunds {
+			// The balance fell after it was read; read it again
+			continue
+		}
+		if err != nil {
+			return closed, err
+		}
+
+		if closed == nil {
+			closed = &balance
+			continue
+		}
+		total, err := closed.Add(balance)
+		if err != nil {
+			return closed, err
+		}
+		closed = &total
+	}
+}
+
+// redactTransactions redacts the description of every transaction of the
+// user that holds typed text. Rows already redacted are skipped, so a
+// resumed deletion only does what is left.
+func redactTransactions(ctx context.Context, userID string) (int, error) {
+	redacted := 0
+	query := TransactionQuery{UserID: userID, Limit: redactBatchSize}
+	for {
+		page, err := ledgerStore.ListTransactions(ctx, query)
+		if err != nil {
+			return redacted, err
+		}
+		for _, transaction := range page.Transactions {
+			if !holdsTypedText(transaction) || transaction.Description == redactedDescription {
+				continue
+			}
+			err = ledgerStore.RedactTransaction(ctx, userID, transaction.TransactionID, redactedDescription)
+			if err != nil {
+				return redacted, fmt.Errorf("transaction %s, %v", transaction.TransactionID, err)
+			}
+			redacted++
+		}
+		if page.Next == "" {
+			return redacted, nil
+		}
+		query.After = page.Next
+	}
+}
+
+// deleteAccount removes the user and everything that identifies them. The
+// journal and the transactions stay for accounting exactly as they were,
+// apart from typed descriptions, which are redacted. They are keyed on the
+// user id, a random Cognito sub that nothing links to a person once the
+// users row and the Cognito user are gone.
+//
+// Every step can be repeated and skips work already done, so a deletion
+// that fails part way is finished by running it again. The users row goes
+// last and marks the deletion as in progress until then; once the Cognito
+// user is disabled only an administrator can resume it.
+func deleteAccount(ctx context.Context, userID string) (string, error) {
+	user, err := userStore.GetUser(ctx, userID)
+	if err == errUserNotFound {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get user, %v", err)
+	}
+
+	// Stop calls being charged to the account while it is taken apart
+	if user.Status != accountStatusDeleting {
+		err = userStore.SetStatus(ctx, userID, accountStatusDeleting)
+		if err != nil {
+			return "", fmt.Errorf("failed to mark account for deletion, %v", err)
+		}
+	}
+
+	err = userDirectory.DisableUser(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to disable sign-in, %v", err)
+	}
+
+	deletion := AccountDeletion{UserID: userID}
+
+	keys, err := apiKeyStore.ListApiKeys(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to list API keys, %v", err)
+	}
+	for _, key := range keys {
+		err = apiKeyStore.DeleteApiKey(ctx, key.KeyID)
+		if err != nil {
+			return "", fmt.Errorf("failed to delete API key %s, %v", key.KeyID, err)
+		}
+		deletion.ApiKeysDeleted++
+	}
+
+	deletion.ClosingBalance, err = closeWallet(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to close wallet, %v", err)
+	}
+
+	deletion.TransactionsRedacted, err = redactTransactions(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to redact transactions, %v", err)
+	}
+
+	deletion.UsagePeriodsDeleted, err = usageStore.DeleteUsage(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to delete usage, %v", err)
+	}
+
+	// Exports hold the user's transactions and personal data in full
+	deletion.ExportsDeleted, err = objectStore.DeletePrefix(ctx, exportPrefix(userID))
+	if err != nil {
+		return "", fmt.Errorf("failed to delete exports, %v", err)
+	}
+
+	err = userDirectory.DeleteUser(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to delete sign-in, %v", err)
+	}
+
+	err = userStore.DeleteUser(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to delete user, %v", err)
+	}
+
+	log.Printf("deleted account, user_id=%s, api_keys=%d, transactions_redacted=%d, exports=%d", userID, deletion.ApiKeysDeleted, deletion.TransactionsRedacted, deletion.ExportsDeleted)
+
+	deletionJson, err := json.Marshal(deletion)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal account deletion JSON, %v", err)
+	}
+	return string(deletionJson), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDeleteAccountKeepsTheBooks(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com","wallet_amount":{"amount":"5","currency":"USD"}}`)
+	if _, err := issueApiKey(ctx, "user-1", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	err := ledgerStore.CreateTransaction(ctx, Transaction{TransactionID: "01MEMO", UserID: "user-1", Amount: newMoney(0, "USD"), Type: transactionTypeManual, Description: "paid by one@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := ledgerStore.ListTransactions(ctx, TransactionQuery{UserID: "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := map[string]JournalEntry{}
+	for _, transaction := range page.Transactions {
+		if entry, err := ledgerStore.GetEntry(ctx, transaction.TransactionID); err == nil {
+			entries[entry.EntryID] = entry
+		}
+	}
+	if len(entries) == 0 {
+		t.Fatal("the opening balance has no journal entry")
+	}
+	exportedObject(t, mustInvoke(t, "exportTransactionHistory", `{"user_id":"user-1","format":"csv"}`))
+	if err := objectStore.PutObject(ctx, exportPrefix("user-10")+"kept.csv", "text/csv", strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := deleteAccount(ctx, "user-1"); err != nil {
+		t.Fatalf("deleteAccount failed, %v", err)
+	}
+
+	if _, err := userStore.GetUser(ctx, "user-1"); err != errUserNotFound {
+		t.Errorf("get user error = %v, want %v", err, errUserNotFound)
+	}
+	if keys, _ := apiKeyStore.ListApiKeys(ctx, "user-1"); len(keys) != 0 {
+		t.Errorf("%d API keys left", len(keys))
+	}
+	objects := objectStore.(*memoryObjectStore).objects
+	if len(objects) != 1 {
+		t.Errorf("objects left = %v, want only user-10's export", objects)
+	}
+
+	page, err = ledgerStore.ListTransactions(ctx, TransactionQuery{UserID: "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := false
+	for _, transaction := range page.Transactions {
+		switch transaction.Type {
+		case transactionTypeManual:
+			if transaction.Description != redactedDescription {
+				t.Errorf("memo description = %q, want it redacted", transaction.Description)
+			}
+		case transactionTypeAccountClosure:
+			closed = transaction.Amount == newMoney(-5000000, "USD")
+		}
+	}
+	if !closed {
+		t.Error("the balance was not moved to suspense")
+	}
+	for entryID, before := range entries {
+		after, err := ledgerStore.GetEntry(ctx, entryID)
+		if err != nil {
+			t.Fatalf("journal entry %s is gone, %v", entryID, err)
+		}
+		if !reflect.DeepEqual(after, before) {
+			t.Errorf("journal entry %s changed from %+v to %+v", entryID, before, after)
+		}
+	}
+
+	// Once finished, a repeat finds nothing left to delete
+	if _, err := deleteAccount(ctx, "user-1"); err != errUserNotFound {
+		t.Errorf("repeat deleteAccount error = %v, want %v", err, errUserNotFound)
+	}
+}
+
+// toppingUpDirectory tops the wallet up while sign-in is being disabled,
+// after deleteAccount has first read the user.
+type toppingUpDirectory struct {
+	memoryUserDirectory
+}
+
+func (toppingUpDirectory) DisableUser(ctx context.Context, userID string) error {
+	return postWalletEntry(ctx, userID, newMoney(2000000, "USD"), accountPromotions, transactionTypeTopUp, "wallet top-up")
+}
+
+func TestDeleteAccountClosesTheCurrentBalance(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com","wallet_amount":{"amount":"5","currency":"USD"}}`)
+	userDirectory = toppingUpDirectory{}
+
+	result, err := deleteAccount(ctx, "user-1")
+	if err != nil {
+		t.Fatalf("deleteAccount failed, %v", err)
+	}
+	deletion := AccountDeletion{}
+	if err := json.Unmarshal([]byte(result), &deletion); err != nil {
+		t.Fatal(err)
+	}
+	if deletion.ClosingBalance == nil || *deletion.ClosingBalance != newMoney(7000000, "USD") {
+		t.Errorf("closing balance = %v, want 7.000000 USD", deletion.ClosingBalance)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// API keys have the form pc_<key id>_<secret>. The key id is a short public
+// prefix used as the lookup key; only a salted, peppered hash of the secret
+// is ever stored.
+const apiKeyPrefix = "pc"
+
+// apiKeyPepper is mixed into every API key hash. It is loaded at cold start
+// and never stored alongside the keys.
+var apiKeyPepper []byte
+
+// newApiKeySecret returns a freshly generated key id and the full key that
+// embeds it.
+func newApiKeySecret() (keyID string, fullKey string, secret string, err error) {
+	idBytes := make([]byte, 6)
+	_, err = rand.Read(idBytes)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	keyHolder := make([]byte, 32) // 32 bytes will be 256 bits
+	_, err = rand.Read(keyHolder)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	keyID = hex.EncodeToString(idBytes)
+	secret = base64.RawURLEncoding.EncodeToString(keyHolder)
+	return keyID, fmt.Sprintf("%s_%s_%s", apiKeyPrefix, keyID, secret), secret, nil
+}
+
+// parseApiKey splits a presented key into its key id and secret. Keys issued
+// before hashing was introduced are bare base64 strings; their key id is
+// derived from the key itself, matching migrateLegacyApiKeys.
+func parseApiKey(presented string) (keyID string, secret string) {
+	parts := strings.SplitN(presented, "_", 3)
+	if len(parts) == 3 && parts[0] == apiKeyPrefix && parts[1] != "" && parts[2] != "" {
+		return parts[1], parts[2]
+	}
+	return legacyApiKeyID(presented), presented
+}
+
+func legacyApiKeyID(rawKey string) string {
+	sum := sha256.Sum256([]byte(rawKey))
+	return "legacy" + hex.EncodeToString(sum[:6])
+}
+
+func newApiKeySalt() (string, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(salt), nil
+}
+
+// hashApiKeySecret computes HMAC-SHA256(pepper, salt || secret).
+func hashApiKeySecret(salt string, secret string) string {
+	mac := hmac.New(sha256.New, apiKeyPepper)
+	mac.Write([]byte(salt))
+	mac.Write([]byte(secret))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+const (
+	apiKeyStatusActive  = "active"
+	apiKeyStatusRevoked = "revoked"
+
+	// apiKeyCreateAttempts is how many fresh key ids are tried before
+	// giving up, should an id already be taken.
+	apiKeyCreateAttempts = 3
+
+	defaultRotationGracePeriod = 24 * time.Hour
+	maxRotationGracePeriod     = 30 * 24 * time.Hour
+)
+
+// usable reports whether the key may authenticate a call at the given time.
+func (k ApiKey) usable(now time.Time) bool {
+	return k.Status == apiKeyStatusActive && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+// setExpiry sets ExpiresAt and the matching TTL. A nil expiry clears both.
+func (k *ApiKey) setExpiry(expiresAt *time.Time) {
+	k.ExpiresAt = expiresAt
+	k.TTL = 0
+	if expiresAt != nil {
+		k.TTL = expiresAt.Unix()
+	}
+}
+
+func sortApiKeysNewestFirst(keys []ApiKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+}
+
+var (
+	errApiKeyNotActive = &OperationError{
+		Code:    "API_KEY_NOT_ACTIVE",
+		Message: "only active API keys can be changed",
+	}
+	errApiKeyRotated = &OperationError{
+		Code:    "API_KEY_ROTATED",
+		Message: "API key has been rotated; it expires when the rotation's grace period ends",
+	}
+)
+
+// apiKeyUpdateRejection reports why an update limited to active keys that
+// have not been rotated was refused for key.
+func apiKeyUpdateRejection(key ApiKey) error {
+	if key.ReplacedBy != "" && key.Status == apiKeyStatusActive {
+		return errApiKeyRotated
+	}
+	return errApiKeyNotActive
+}
+
+// isApiKeyRejected reports whether err means the presented key cannot be
+// used, as opposed to the lookup itself failing.
+func isApiKeyRejected(err error) bool {
+	return err == errApiKeyNotFound || err == errApiKeyRevoked || err == errApiKeyExpired
+}
+
+// issueApiKey creates and stores a new key for the user. The returned full
+// key is not stored anywhere and cannot be recovered later. Key ids are
+// random, so one that is already taken is replaced by a fresh one rather
+// than overwriting the other key.
+func issueApiKey(ctx context.Context, userID string, label string, expiresAt *time.Time) (GeneratedApiKey, error) {
+	for attempt := 0; attempt < apiKeyCreateAttempts; attempt++ {
+		keyID, apiKey, secret, err := newApiKeySecret()
+		if err != nil {
+			return GeneratedApiKey{}, err
+		}
+
+		salt, err := newApiKeySalt()
+		if err != nil {
+			return GeneratedApiKey{}, err
+		}
+
+		keyItem := ApiKey{
+			KeyID:     keyID,
+			UserID:    userID,
+			Label:     label,
+			Status:    apiKeyStatusActive,
+			Salt:      salt,
+			Hash:      hashApiKeySecret(salt, secret),
+			CreatedAt: time.Now().UTC(),
+		}
+		keyItem.setExpiry(expiresAt)
+
+		err = apiKeyStore.CreateApiKey(ctx, keyItem)
+		if err == errApiKeyExists {
+			log.Printf("API key id collision, key_id=%s", keyID)
+			continue
+		}
+		if err != nil {
+			return GeneratedApiKey{}, fmt.Errorf("failed to store API key, %v", err)
+		}
+
+		return GeneratedApiKey{KeyID: keyID, ApiKey: apiKey}, nil
+	}
+	return GeneratedApiKey{}, fmt.Errorf("failed to store API key, no free key id after %d attempts", apiKeyCreateAttempts)
+}
+
+// verifyApiKey authenticates the presented key and records its use.
+func verifyApiKey(ctx context.Context, presented string) (ApiKey, error) {
+	key, err := authenticateApiKey(ctx, presented)
+	if err != nil {
+		return ApiKey{}, err
+	}
+
+	err = apiKeyStore.TouchApiKey(ctx, key.KeyID, time.Now().UTC())
+	if err != nil {
+		log.Printf("failed to record API key use, key_id=%s, %v", key.KeyID, err)
+	}
+
+	return key, nil
+}
+
+// authenticateApiKey looks the presented key up by its key id and checks the
+// secret against the stored hash in constant time. An unknown id and a wrong
+// secret are both reported as errApiKeyNotFound. Only once the secret has
+// been proven are revoked and expired keys reported as such.
+func authenticateApiKey(ctx context.Context, presented string) (ApiKey, error) {
+	keyID, secret := parseApiKey(presented)
+
+	key, err := apiKeyStore.GetApiKey(ctx, keyID)
+	if err != nil && err != errApiKeyNotFound {
+		return ApiKey{}, err
+	}
+
+	// Hash even when the id is unknown so lookups take the same time.
+	computed := hashApiKeySecret(key.Salt, secret)
+	if err == errApiKeyNotFound || subtle.ConstantTimeCompare([]byte(computed), []byte(key.Hash)) != 1 {
+		return ApiKey{}, errApiKeyNotFound
+	}
+
+	err = checkApiKeyUsable(key)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	return key, nil
+}
+
+// checkApiKeyUsable reports a revoked or expired key as such.
+func checkApiKeyUsable(key ApiKey) error {
+	if key.Status != apiKeyStatusActive {
+		return errApiKeyRevoked
+	}
+	// DynamoDB TTL deletes lazily, so expiry is enforced here as well.
+	if !key.usable(time.Now().UTC()) {
+		return errApiKeyExpired
+	}
+	return nil
+}
+
+// callerApiKey returns the key a callAPI request is made with: the one the
+// API key authorizer verified, or else the one presented in the payload. The
+// authorizer's key is read again, so a revocation takes effect at once even
+// while the authorizer's result is cached. Dry runs do not record the key's
+// use.
+func callerApiKey(ctx context.Context, presented string, dryRun bool) (ApiKey, error) {
+	identity, ok := identityFromContext(ctx)
+	if !ok || identity.ApiKeyID == "" {
+		if presented == "" {
+			return ApiKey{}, &ValidationError{Fields: []FieldError{{Field: "api_key", Message: "is required"}}}
+		}
+		if dryRun {
+			return authenticateApiKey(ctx, presented)
+		}
+		return verifyApiKey(ctx, presented)
+	}
+
+	key, err := apiKeyStore.GetApiKey(ctx, identity.ApiKeyID)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	err = checkApiKeyUsable(key)
+	if err != nil {
+		return ApiKey{}, err
+	}
+
+	if !dryRun {
+		err = apiKeyStore.TouchApiKey(ctx, key.KeyID, time.Now().UTC())
+		if err != nil {
+			log.Printf("failed to record API key use, key_id=%s, %v", key.KeyID, err)
+		}
+	}
+	return key, nil
+}
+
+// loadOwnedApiKey fetches a key by id on behalf of the caller, applying the
+// same ownership rules as resolveUserID.
+func loadOwnedApiKey(ctx context.Context, op *Operation, keyID string) (ApiKey, error) {
+	key, err := apiKeyStore.GetApiKey(ctx, keyID)
+	if err == errApiKeyNotFound {
+		return ApiKey{}, err
+	}
+	if err != nil {
+		return ApiKey{}, fmt.Errorf("failed to get API key, %v", err)
+	}
+
+	_, err = resolveUserID(ctx, op, key.UserID)
+	if err != nil {
+		// Do not reveal that another user's key exists
+		if _, forbidden := err.(*OperationError); forbidden {
+			return ApiKey{}, errApiKeyNotFound
+		}
+		return ApiKey{}, err
+	}
+	return key, nil
+}
+
+func listApiKeys(ctx context.Context, userID string) (string, error) {
+	apiKeys, err := apiKeyStore.ListApiKeys(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to list API keys, %v", err)
+	}
+	sortApiKeysNewestFirst(apiKeys)
+
+	apiKeysJson, err := json.Marshal(apiKeys)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal API keys JSON, %v", err)
+	}
+
+	return string(apiKeysJson), nil
+}
+
+// revokeApiKey stops key working. callAPI reads the key on every call and
+// refuses it at once; the other API key routes trust the authorizer's cache,
+// so they accept it for up to authorizerCacheTTL more.
+func revokeApiKey(ctx context.Context, key ApiKey) (string, error) {
+	if key.Status == apiKeyStatusRevoked {
+		return "API key revoked successfully", nil
+	}
+
+	err := apiKeyStore.RevokeApiKey(ctx, key.KeyID, time.Now().UTC())
+	// Revoked by another request since it was read
+	if err == errApiKeyNotActive {
+		return "API key revoked successfully", nil
+	}
+	if err == errApiKeyNotFound {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to revoke API key, %v", err)
+	}
+
+	return "API key revoked successfully", nil
+}
+
+// rotateApiKey issues a replacement for key and lets the old key keep
+// working until the grace period ends. A key can only be rotated once. Like
+// a revoked key, the old key is accepted on routes other than callAPI for
+// up to authorizerCacheTTL after the grace period.
+func rotateApiKey(ctx context.Context, key ApiKey, gracePeriod time.Duration) (string, error) {
+	now := time.Now().UTC()
+	if key.ReplacedBy != "" {
+		return "", errApiKeyRotated
+	}
+	if !key.usable(now) {
+		return "", errApiKeyNotActive
+	}
+
+	generated, err := issueApiKey(ctx, key.UserID, key.Label, nil)
+	if err != nil {
+		return "", err
+	}
+
+	graceEnd := now.Add(gracePeriod)
+	if key.ExpiresAt != nil && key.ExpiresAt.Before(graceEnd) {
+		graceEnd = *key.ExpiresAt
+	}
+
+	err = apiKeyStore.RotateApiKey(ctx, key.KeyID, generated.KeyID, graceEnd)
+	if err != nil {
+		// Withdraw the replacement so the old key has only one
+		deleteErr := apiKeyStore.DeleteApiKey(ctx, generated.KeyID)
+		if deleteErr != nil {
+			log.Printf("failed to delete unused replacement API key, key_id=%s, %v", generated.KeyID, deleteErr)
+		}
+		if isCallerError(err) {
+			return "", err
+		}
+		return "", fmt.Errorf("failed to update rotated API key, %v", err)
+	}
+
+	generatedJson, err := json.Marshal(generated)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal API key JSON, %v", err)
+	}
+
+	return string(generatedJson), nil
+}
+
+// setApiKeyExpiry changes when an active key stops working. The expiry of a
+// rotated key ends its grace period and cannot be changed.
+func setApiKeyExpiry(ctx context.Context, key ApiKey, expiresAt *time.Time) (string, error) {
+	if key.Status != apiKeyStatusActive {
+		return "", errApiKeyNotActive
+	}
+	if key.ReplacedBy != "" {
+		return "", errApiKeyRotated
+	}
+
+	err := apiKeyStore.SetApiKeyExpiry(ctx, key.KeyID, expiresAt)
+	if isCallerError(err) {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to update API key expiry, %v", err)
+	}
+
+	return "API key expiry updated successfully", nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// collidingApiKeyStore reports the first collisions creates as taken ids.
+type collidingApiKeyStore struct {
+	ApiKeyStore
+	collisions int
+	attempts   int
+}
+
+func (s *collidingApiKeyStore) CreateApiKey(ctx context.Context, key ApiKey) error {
+	s.attempts++
+	if s.attempts <= s.collisions {
+		return errApiKeyExists
+	}
+	return s.ApiKeyStore.CreateApiKey(ctx, key)
+}
+
+func TestIssueApiKeyRetriesTakenIDs(t *testing.T) {
+	resetStores(t)
+	store := &collidingApiKeyStore{ApiKeyStore: apiKeyStore, collisions: apiKeyCreateAttempts - 1}
+	apiKeyStore = store
+
+	generated, err := issueApiKey(context.Background(), "user-1", "", nil)
+	if err != nil {
+		t.Fatalf("issueApiKey failed, %v", err)
+	}
+	if store.attempts != apiKeyCreateAttempts {
+		t.Errorf("%d attempts, want %d", store.attempts, apiKeyCreateAttempts)
+	}
+	if _, err := authenticateApiKey(context.Background(), generated.ApiKey); err != nil {
+		t.Errorf("issued key does not authenticate, %v", err)
+	}
+}
+
+func TestIssueApiKeyGivesUpAfterAttempts(t *testing.T) {
+	resetStores(t)
+	apiKeyStore = &collidingApiKeyStore{ApiKeyStore: apiKeyStore, collisions: apiKeyCreateAttempts}
+
+	_, err := issueApiKey(context.Background(), "user-1", "", nil)
+	if err == nil {
+		t.Fatal("issueApiKey succeeded with every id taken")
+	}
+}
+
+func TestMemoryStoreCreateApiKeyKeepsExisting(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+
+	if err := apiKeyStore.CreateApiKey(ctx, ApiKey{KeyID: "abc", UserID: "user-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := apiKeyStore.CreateApiKey(ctx, ApiKey{KeyID: "abc", UserID: "user-2"}); err != errApiKeyExists {
+		t.Fatalf("error = %v, want %v", err, errApiKeyExists)
+	}
+	key, err := apiKeyStore.GetApiKey(ctx, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.UserID != "user-1" {
+		t.Errorf("user_id = %q, the existing key was overwritten", key.UserID)
+	}
+}
+
+func TestGenerateAndUseApiKey(t *testing.T) {
+	resetStores(t)
+
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com"}`)
+	result := mustInvoke(t, "generateApiKey", `{"user_id":"user-1","label":"ci"}`)
+	generated := GeneratedApiKey{}
+	if err := json.Unmarshal([]byte(result), &generated); err != nil {
+		t.Fatalf("generateApiKey returned invalid JSON %q, %v", result, err)
+	}
+
+	key, err := verifyApiKey(context.Background(), generated.ApiKey)
+	if err != nil {
+		t.Fatalf("verifyApiKey failed, %v", err)
+	}
+	if key.UserID != "user-1" || key.Label != "ci" {
+		t.Errorf("key = %+v", key)
+	}
+	if key.Hash == "" || key.Hash == generated.ApiKey {
+		t.Error("the key is not stored hashed")
+	}
+
+	// A wrong secret under a real key id is rejected like an unknown key
+	keyID, _ := parseApiKey(generated.ApiKey)
+	if _, err := verifyApiKey(context.Background(), "pc_"+keyID+"_wrong"); err != errApiKeyNotFound {
+		t.Errorf("wrong secret error = %v, want %v", err, errApiKeyNotFound)
+	}
+}
+
+func TestExpiredApiKeyIsRejected(t *testing.T) {
+	resetStores(t)
+
+	generated, err := issueApiKey(context.Background(), "user-1", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Minute)
+	if err := apiKeyStore.SetApiKeyExpiry(context.Background(), generated.KeyID, &past); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := verifyApiKey(context.Background(), generated.ApiKey); err != errApiKeyExpired {
+		t.Errorf("error = %v, want %v", err, errApiKeyExpired)
+	}
+}
+
+// newTestApiKey issues a key for user-1 and returns it as stored.
+func newTestApiKey(t *testing.T) (ApiKey, GeneratedApiKey) {
+	t.Helper()
+	generated, err := issueApiKey(context.Background(), "user-1", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := apiKeyStore.GetApiKey(context.Background(), generated.KeyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, generated
+}
+
+func TestRevokeKeepsLastUsedAndCannotBeUndone(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	key, generated := newTestApiKey(t)
+
+	if _, err := verifyApiKey(ctx, generated.ApiKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := revokeApiKey(ctx, key); err != nil {
+		t.Fatalf("revokeApiKey failed, %v", err)
+	}
+
+	// A stale copy of the active key must not bring it back
+	if _, err := setApiKeyExpiry(ctx, key, nil); err != errApiKeyNotActive {
+		t.Errorf("setApiKeyExpiry on a stale copy error = %v, want %v", err, errApiKeyNotActive)
+	}
+	if _, err := rotateApiKey(ctx, key, time.Hour); err != errApiKeyNotActive {
+		t.Errorf("rotateApiKey on a stale copy error = %v, want %v", err, errApiKeyNotActive)
+	}
+	if _, err := revokeApiKey(ctx, key); err != nil {
+		t.Errorf("second revokeApiKey failed, %v", err)
+	}
+
+	stored, err := apiKeyStore.GetApiKey(ctx, key.KeyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != apiKeyStatusRevoked {
+		t.Errorf("status = %q, want revoked", stored.Status)
+	}
+	if stored.LastUsedAt == nil {
+		t.Error("last_used_at was lost")
+	}
+	if keys, _ := apiKeyStore.ListApiKeys(ctx, "user-1"); len(keys) != 1 {
+		t.Errorf("%d keys, the failed rotation left its replacement behind", len(keys))
+	}
+	if _, err := verifyApiKey(ctx, generated.ApiKey); err != errApiKeyRevoked {
+		t.Errorf("verify error = %v, want %v", err, errApiKeyRevoked)
+	}
+}
+
+func TestRotatedKeyExpiryIsFixed(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	key, _ := newTestApiKey(t)
+
+	if _, err := rotateApiKey(ctx, key, time.Hour); err != nil {
+		t.Fatalf("rotateApiKey failed, %v", err)
+	}
+	rotated, err := apiKeyStore.GetApiKey(ctx, key.KeyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.ReplacedBy == "" || rotated.ExpiresAt == nil {
+		t.Fatalf("rotated key = %+v, want replaced_by and expires_at", rotated)
+	}
+
+	if _, err := setApiKeyExpiry(ctx, rotated, nil); err != errApiKeyRotated {
+		t.Errorf("clearing a rotated key's expiry error = %v, want %v", err, errApiKeyRotated)
+	}
+	// Even through a copy read before the rotation
+	if _, err := setApiKeyExpiry(ctx, key, nil); err != errApiKeyRotated {
+		t.Errorf("stale setApiKeyExpiry error = %v, want %v", err, errApiKeyRotated)
+	}
+	if _, err := rotateApiKey(ctx, rotated, time.Hour); err != errApiKeyRotated {
+		t.Errorf("second rotation error = %v, want %v", err, errApiKeyRotated)
+	}
+
+	after, err := apiKeyStore.GetApiKey(ctx, key.KeyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.ExpiresAt == nil || !after.ExpiresAt.Equal(*rotated.ExpiresAt) {
+		t.Errorf("expires_at = %v, want %v", after.ExpiresAt, rotated.ExpiresAt)
+	}
+	if keys, _ := apiKeyStore.ListApiKeys(ctx, "user-1"); len(keys) != 2 {
+		t.Errorf("%d keys, want the old key and one replacement", len(keys))
+	}
+}
+
+func TestSetApiKeyExpiry(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	key, _ := newTestApiKey(t)
+
+	later := time.Now().Add(time.Hour).UTC()
+	if _, err := setApiKeyExpiry(ctx, key, &later); err != nil {
+		t.Fatalf("setApiKeyExpiry failed, %v", err)
+	}
+	stored, _ := apiKeyStore.GetApiKey(ctx, key.KeyID)
+	if stored.ExpiresAt == nil || stored.TTL != later.Unix() {
+		t.Errorf("stored = %+v, want expiry and ttl at %v", stored, later)
+	}
+
+	if _, err := setApiKeyExpiry(ctx, stored, nil); err != nil {
+		t.Fatalf("clearing the expiry failed, %v", err)
+	}
+	stored, _ = apiKeyStore.GetApiKey(ctx, key.KeyID)
+	if stored.ExpiresAt != nil || stored.TTL != 0 {
+		t.Errorf("stored = %+v, want no expiry", stored)
+	}
+}
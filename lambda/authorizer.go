@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// authorizerCacheTTL is how long a verified key is trusted without
+	// reading the api_keys table again. callAPI reads the key itself, so
+	// revoking or rotating a key stops its calls at once; other operations
+	// notice within this time.
+	authorizerCacheTTL = time.Minute
+	// authorizerCacheSize caps the cached keys. Once it is reached, expired
+	// entries are dropped, then arbitrary ones.
+	authorizerCacheSize = 10000
+)
+
+// errUnauthorized is the exact error API Gateway turns into a 401 response.
+var errUnauthorized = errors.New("Unauthorized")
+
+type cachedAuthorization struct {
+	key      ApiKey
+	loadedAt time.Time
+}
+
+var authorizerCache = struct {
+	sync.Mutex
+	// authorizations are keyed by a hash of the presented key, so full
+	// keys are never held in memory longer than a request.
+	authorizations map[string]cachedAuthorization
+}{authorizations: map[string]cachedAuthorization{}}
+
+// presentedApiKey reads the key from the x-api-key header, or from an
+// "Authorization: Bearer" header. Header names are matched in any case.
+func presentedApiKey(headers map[string]string) string {
+	for name, value := range headers {
+		switch strings.ToLower(name) {
+		case "x-api-key":
+			if value != "" {
+				return strings.TrimSpace(value)
+			}
+		case "authorization":
+			scheme, token, ok := strings.Cut(strings.TrimSpace(value), " ")
+			if ok && strings.EqualFold(scheme, "Bearer") {
+				return strings.TrimSpace(token)
+			}
+		}
+	}
+	return ""
+}
+
+// authorizeApiKey verifies the presented key, reusing a recent result for
+// the same key while the key is still usable.
+func authorizeApiKey(ctx context.Context, presented string) (cachedAuthorization, error) {
+	now := time.Now()
+	digest := sha256.Sum256([]byte(presented))
+	cacheKey := hex.EncodeToString(digest[:])
+
+	authorizerCache.Lock()
+	cached, ok := authorizerCache.authorizations[cacheKey]
+	if ok && (now.Sub(cached.loadedAt) >= authorizerCacheTTL || !cached.key.usable(now)) {
+		delete(authorizerCache.authorizations, cacheKey)
+		ok = false
+	}
+	authorizerCache.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	key, err := verifyApiKey(ctx, presented)
+	if err != nil {
+		return cachedAuthorization{}, err
+	}
+
+	authorization := cachedAuthorization{key: key, loadedAt: now}
+	authorizerCache.Lock()
+	if len(authorizerCache.authorizations) >= authorizerCacheSize {
+		evictAuthorizations(now)
+	}
+	authorizerCache.authorizations[cacheKey] = authorization
+	authorizerCache.Unlock()
+	return authorization, nil
+}
+
+// evictAuthorizations makes room in the full cache, dropping expired
+// entries first. The caller holds the lock.
+func evictAuthorizations(now time.Time) {
+	for cacheKey, cached := range authorizerCache.authorizations {
+		if now.Sub(cached.loadedAt) >= authorizerCacheTTL {
+			delete(authorizerCache.authorizations, cacheKey)
+		}
+	}
+	for cacheKey := range authorizerCache.authorizations {
+		if len(authorizerCache.authorizations) < authorizerCacheSize {
+			return
+		}
+		delete(authorizerCache.authorizations, cacheKey)
+	}
+}
+
+// authorizerHandler is the API Gateway request authorizer for API key
+// routes. It allows the request when the x-api-key or bearer header holds a
+// usable key, and passes the key's owner and the key id to the integration
+// as authorizer context.
+func authorizerHandler(ctx context.Context, event events.APIGatewayCustomAuthorizerRequestTypeRequest) (events.APIGatewayCustomAuthorizerResponse, error) {
+	presented := presentedApiKey(event.Headers)
+	if presented == "" {
+		return events.APIGatewayCustomAuthorizerResponse{}, errUnauthorized
+	}
+
+	authorization, err := authorizeApiKey(ctx, presented)
+	if isApiKeyRejected(err) {
+		return events.APIGatewayCustomAuthorizerResponse{}, errUnauthorized
+	}
+	if err != nil {
+		log.Printf("failed to authorize API key, %v", err)
+		return events.APIGatewayCustomAuthorizerResponse{}, fmt.Errorf("failed to authorize API key")
+	}
+
+	return events.APIGatewayCustomAuthorizerResponse{
+		PrincipalID: authorization.key.UserID,
+		PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
+			Version: "2012-10-17",
+			Statement: []events.IAMPolicyStatement{
+				{
+					Action:   []string{"execute-api:Invoke"},
+					Effect:   "Allow",
+					Resource: []string{event.MethodArn},
+				},
+			},
+		},
+		Context: map[string]interface{}{
+			"user_id": authorization.key.UserID,
+			"key_id":  authorization.key.KeyID,
+		},
+	}, nil
+}
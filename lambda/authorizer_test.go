@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func authorizerRequest(headers map[string]string) events.APIGatewayCustomAuthorizerRequestTypeRequest {
+	return events.APIGatewayCustomAuthorizerRequestTypeRequest{
+		MethodArn: "arn:aws:execute-api:us-east-1:123456789012:api/prod/POST/call",
+		Headers:   headers,
+	}
+}
+
+func TestAuthorizerAllowsUsableKeys(t *testing.T) {
+	resetStores(t)
+	apiKey := newCallingUser(t)
+
+	for _, headers := range []map[string]string{
+		{"X-Api-Key": apiKey},
+		{"authorization": "bearer " + apiKey},
+	} {
+		response, err := authorizerHandler(context.Background(), authorizerRequest(headers))
+		if err != nil {
+			t.Fatalf("headers %v rejected, %v", headers, err)
+		}
+		statement := response.PolicyDocument.Statement[0]
+		if statement.Effect != "Allow" || statement.Resource[0] != authorizerRequest(nil).MethodArn {
+			t.Errorf("statement = %+v", statement)
+		}
+		if response.PrincipalID != "user-1" || response.Context["user_id"] != "user-1" || response.Context["key_id"] == nil {
+			t.Errorf("response = %+v", response)
+		}
+	}
+}
+
+func TestAuthorizerRejectsBadKeys(t *testing.T) {
+	resetStores(t)
+	apiKey := newCallingUser(t)
+	keyID, _ := parseApiKey(apiKey)
+
+	for _, headers := range []map[string]string{
+		{},
+		{"x-api-key": "pc_" + keyID + "_wrong"},
+		{"authorization": "Basic " + apiKey},
+	} {
+		if _, err := authorizerHandler(context.Background(), authorizerRequest(headers)); err != errUnauthorized {
+			t.Errorf("headers %v error = %v, want %v", headers, err, errUnauthorized)
+		}
+	}
+}
+
+func TestAuthorizerStopsTrustingRevokedKeys(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	apiKey := newCallingUser(t)
+	request := authorizerRequest(map[string]string{"x-api-key": apiKey})
+
+	if _, err := authorizerHandler(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+	keyID, _ := parseApiKey(apiKey)
+	key, err := apiKeyStore.GetApiKey(ctx, keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := revokeApiKey(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached authorization lives on until it expires
+	if _, err := authorizerHandler(ctx, request); err != nil {
+		t.Errorf("cached key rejected early, %v", err)
+	}
+	for cacheKey, cached := range authorizerCache.authorizations {
+		cached.loadedAt = cached.loadedAt.Add(-authorizerCacheTTL)
+		authorizerCache.authorizations[cacheKey] = cached
+	}
+	if _, err := authorizerHandler(ctx, request); err != errUnauthorized {
+		t.Errorf("revoked key error = %v, want %v", err, errUnauthorized)
+	}
+}
+
+func TestAuthorizerCacheEvictsEntries(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	apiKey := newCallingUser(t)
+	request := authorizerRequest(map[string]string{"x-api-key": apiKey})
+
+	// A full cache drops expired entries first, then arbitrary ones
+	now := time.Now()
+	for i := 0; i < authorizerCacheSize; i++ {
+		loadedAt := now
+		if i%2 == 0 {
+			loadedAt = now.Add(-authorizerCacheTTL)
+		}
+		authorizerCache.authorizations[fmt.Sprintf("filler-%d", i)] = cachedAuthorization{loadedAt: loadedAt}
+	}
+	if _, err := authorizerHandler(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(authorizerCache.authorizations); n != authorizerCacheSize/2+1 {
+		t.Errorf("%d cached after sweep, want %d", n, authorizerCacheSize/2+1)
+	}
+
+	// An expired entry is dropped when it is looked up
+	for cacheKey, cached := range authorizerCache.authorizations {
+		cached.loadedAt = cached.loadedAt.Add(-authorizerCacheTTL)
+		authorizerCache.authorizations[cacheKey] = cached
+	}
+	keyID, _ := parseApiKey(apiKey)
+	key, err := apiKeyStore.GetApiKey(ctx, keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := revokeApiKey(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	before := len(authorizerCache.authorizations)
+	if _, err := authorizerHandler(ctx, request); err != errUnauthorized {
+		t.Fatalf("revoked key error = %v, want %v", err, errUnauthorized)
+	}
+	if n := len(authorizerCache.authorizations); n != before-1 {
+		t.Errorf("%d cached after lookup, want %d", n, before-1)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cognitoidentityprovider"
+	"github.com/aws/aws-sdk-go/service/cognitoidentityprovider/cognitoidentityprovideriface"
+)
+
+// cognitoUserDirectory implements UserDirectory on the user pool created by
+// CreateCognitoUserPool. The pool signs users in by email, so Cognito
+// generates each username, and it is the same as the user's sub.
+type cognitoUserDirectory struct {
+	cognito    cognitoidentityprovideriface.CognitoIdentityProviderAPI
+	userPoolID string
+}
+
+func newCognitoUserDirectory(client cognitoidentityprovideriface.CognitoIdentityProviderAPI, userPoolID string) *cognitoUserDirectory {
+	return &cognitoUserDirectory{cognito: client, userPoolID: userPoolID}
+}
+
+func isCognitoUserNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == cognitoidentityprovider.ErrCodeUserNotFoundException
+}
+
+func (d *cognitoUserDirectory) DisableUser(ctx context.Context, userID string) error {
+	if d.userPoolID == "" {
+		return fmt.Errorf("USER_POOL_ID is not set")
+	}
+
+	_, err := d.cognito.AdminDisableUserWithContext(ctx, &cognitoidentityprovider.AdminDisableUserInput{
+		UserPoolId: aws.String(d.userPoolID),
+		Username:   aws.String(userID),
+	})
+	if isCognitoUserNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Disabling stops new sign-ins; signing out revokes refresh tokens so
+	// existing sessions end when their access tokens expire.
+	_, err = d.cognito.AdminUserGlobalSignOutWithContext(ctx, &cognitoidentityprovider.AdminUserGlobalSignOutInput{
+		UserPoolId: aws.String(d.userPoolID),
+		Username:   aws.String(userID),
+	})
+	if isCognitoUserNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *cognitoUserDirectory) DeleteUser(ctx context.Context, userID string) error {
+	if d.userPoolID == "" {
+		return fmt.Errorf("USER_POOL_ID is not set")
+	}
+
+	_, err := d.cognito.AdminDeleteUserWithContext(ctx, &cognitoidentityprovider.AdminDeleteUserInput{
+		UserPoolId: aws.String(d.userPoolID),
+		Username:   aws.String(userID),
+	})
+	if isCognitoUserNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *cognitoUserDirectory) GetUserAttributes(ctx context.Context, userID string) (map[string]string, error) {
+	if d.userPoolID == "" {
+		return nil, fmt.Errorf("USER_POOL_ID is not set")
+	}
+
+	result, err := d.cognito.AdminGetUserWithContext(ctx, &cognitoidentityprovider.AdminGetUserInput{
+		UserPoolId: aws.String(d.userPoolID),
+		Username:   aws.String(userID),
+	})
+	if isCognitoUserNotFound(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := map[string]string{}
+	for _, attribute := range result.UserAttributes {
+		attributes[aws.StringValue(attribute.Name)] = aws.StringValue(attribute.Value)
+	}
+	return attributes, nil
+}
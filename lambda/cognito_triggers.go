@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// confirmSignUpTrigger is the post-confirmation trigger source for a new
+// sign-up. Password resets fire the same trigger as
+// PostConfirmation_ConfirmForgotPassword and must not provision anything.
+const confirmSignUpTrigger = "PostConfirmation_ConfirmSignUp"
+
+const (
+	// tokenClaimsCacheTTL is how long a user's claims are reused for
+	// further tokens, such as refreshes, without reading the users table.
+	tokenClaimsCacheTTL = time.Minute
+	// tokenClaimsTimeout bounds the users table read. Cognito gives a
+	// trigger five seconds; past this budget the token is issued with
+	// the last known claims, or none, rather than failing the sign-in.
+	tokenClaimsTimeout = 1500 * time.Millisecond
+)
+
+// Account statuses reported in the account_status claim.
+const (
+	accountStatusActive = "active"
+	// accountStatusInsufficientFunds means the wallet and credit limit
+	// no longer cover any charge.
+	accountStatusInsufficientFunds = "insufficient_funds"
+	// accountStatusDeleting means deleteAccount has started on the user.
+	accountStatusDeleting = "deleting"
+)
+
+// accountStatus summarises whether the user can currently be charged. A
+// wallet whose credit limit cannot be added to it cannot be charged either.
+func (u User) accountStatus() string {
+	if u.Status == accountStatusDeleting {
+		return accountStatusDeleting
+	}
+	available, err := u.available()
+	if err != nil || available.IsNegative() || available.IsZero() {
+		return accountStatusInsufficientFunds
+	}
+	return accountStatusActive
+}
+
+// tokenClaims are the custom claims added to a user's ID and access tokens.
+func tokenClaims(user User) map[string]string {
+	claims := map[string]string{
+		"plan":           user.planID(),
+		"account_status": user.accountStatus(),
+	}
+	if user.OrgID != "" {
+		claims["org_id"] = user.OrgID
+	}
+	return claims
+}
+
+type cachedTokenClaims struct {
+	claims   map[string]string
+	loadedAt time.Time
+}
+
+var tokenClaimsCache = struct {
+	sync.Mutex
+	claims map[string]cachedTokenClaims
+}{claims: map[string]cachedTokenClaims{}}
+
+// lookupTokenClaims returns the user's claims from the cache while they are
+// fresh, otherwise from the users table. If the read fails or times out,
+// stale cached claims are still better than none. It returns false when
+// there is nothing to add, such as for a user without a users row.
+func lookupTokenClaims(ctx context.Context, userID string) (map[string]string, bool) {
+	now := time.Now()
+
+	tokenClaimsCache.Lock()
+	cached, ok := tokenClaimsCache.claims[userID]
+	tokenClaimsCache.Unlock()
+	if ok && now.Sub(cached.loadedAt) < tokenClaimsCacheTTL {
+		return cached.claims, true
+	}
+
+	readCtx, cancel := context.WithTimeout(ctx, tokenClaimsTimeout)
+	defer cancel()
+	user, err := userStore.GetUser(readCtx, userID)
+	if err == errUserNotFound {
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("failed to read token claims, user_id=%s, stale=%t, %v", userID, ok, err)
+		return cached.claims, ok
+	}
+
+	claims := tokenClaims(user)
+	tokenClaimsCache.Lock()
+	tokenClaimsCache.claims[userID] = cachedTokenClaims{claims: claims, loadedAt: now}
+	tokenClaimsCache.Unlock()
+	return claims, true
+}
+
+// preTokenGenerationHandler is the Cognito pre-token-generation trigger. It
+// adds the user's plan, account status and organisation to their ID and
+// access tokens, so clients can read them without a getUser call. It never
+// fails: a token without the claims is better than a failed sign-in.
+func preTokenGenerationHandler(ctx context.Context, event events.CognitoEventUserPoolsPreTokenGenV2) (events.CognitoEventUserPoolsPreTokenGenV2, error) {
+	// Keep the caller's groups, which the auth middleware relies on
+	event.Response.ClaimsAndScopeOverrideDetails.GroupOverrideDetails = event.Request.GroupConfiguration
+
+	claims, ok := lookupTokenClaims(ctx, event.Request.UserAttributes["sub"])
+	if !ok {
+		return event, nil
+	}
+	event.Response.ClaimsAndScopeOverrideDetails.IDTokenGeneration.ClaimsToAddOrOverride = claims
+	event.Response.ClaimsAndScopeOverrideDetails.AccessTokenGeneration.ClaimsToAddOrOverride = claims
+	return event, nil
+}
+
+// signUpWallet returns the opening balance of a new user: the SIGN_UP_PROMO
+// amount in USD, e.g. "5.00", or zero.
+func signUpWallet() (Money, error) {
+	promo := os.Getenv("SIGN_UP_PROMO")
+	if promo == "" {
+		return newMoney(0, defaultCurrency), nil
+	}
+	amount, err := ParseMoney(promo, defaultCurrency)
+	if err != nil {
+		return Money{}, fmt.Errorf("invalid SIGN_UP_PROMO, %v", err)
+	}
+	if amount.IsNegative() {
+		return Money{}, fmt.Errorf("invalid SIGN_UP_PROMO, must not be negative")
+	}
+	return amount, nil
+}
+
+// postConfirmationHandler is the Cognito post-confirmation trigger. It
+// creates the users row for a newly confirmed user, keyed on their sub.
+// Cognito may deliver the same confirmation more than once, and createUser
+// treats a repeat as success. A row that exists with another email or
+// currency, or that is being deleted, fails the confirmation instead.
+func postConfirmationHandler(ctx context.Context, event events.CognitoEventUserPoolsPostConfirmation) (events.CognitoEventUserPoolsPostConfirmation, error) {
+	if event.TriggerSource != confirmSignUpTrigger {
+		return event, nil
+	}
+
+	sub := event.Request.UserAttributes["sub"]
+	if sub == "" {
+		return event, fmt.Errorf("post confirmation event for %s has no sub", event.UserName)
+	}
+
+	wallet, err := signUpWallet()
+	if err != nil {
+		return event, err
+	}
+
+	_, err = createUser(ctx, User{
+		UserID:       sub,
+		Email:        event.Request.UserAttributes["email"],
+		WalletAmount: wallet,
+		CreditLimit:  newMoney(0, wallet.Currency),
+	})
+	if err == errUserExists {
+		log.Printf("post confirmation does not match the existing user, user_id=%s", sub)
+		return event, fmt.Errorf("user %s already exists with another email or currency", sub)
+	}
+	if err == errAccountDeleting {
+		log.Printf("post confirmation for a user being deleted, user_id=%s", sub)
+		return event, fmt.Errorf("user %s is being deleted", sub)
+	}
+	if err != nil {
+		return event, err
+	}
+
+	log.Printf("provisioned user from sign-up, user_id=%s", sub)
+	return event, nil
+}
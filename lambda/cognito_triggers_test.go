@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func postConfirmationEvent(triggerSource string) events.CognitoEventUserPoolsPostConfirmation {
+	event := events.CognitoEventUserPoolsPostConfirmation{}
+	event.TriggerSource = triggerSource
+	event.UserName = "one"
+	event.Request.UserAttributes = map[string]string{"sub": "user-1", "email": "one@example.com"}
+	return event
+}
+
+func TestPostConfirmationProvisionsOnce(t *testing.T) {
+	resetStores(t)
+	t.Setenv("SIGN_UP_PROMO", "5.00")
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := postConfirmationHandler(ctx, postConfirmationEvent(confirmSignUpTrigger)); err != nil {
+			t.Fatalf("delivery %d failed, %v", i+1, err)
+		}
+	}
+	user := getTestUser(t, "user-1")
+	if user.Email != "one@example.com" || user.WalletAmount != newMoney(5000000, "USD") {
+		t.Errorf("user = %+v, want the promo balance", user)
+	}
+	page, err := ledgerStore.ListTransactions(ctx, TransactionQuery{UserID: "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Transactions) != 1 {
+		t.Errorf("%d transactions, want a single opening balance", len(page.Transactions))
+	}
+}
+
+func TestPostConfirmationRejectsConflictingUsers(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"other@example.com"}`)
+
+	if _, err := postConfirmationHandler(ctx, postConfirmationEvent(confirmSignUpTrigger)); err == nil {
+		t.Error("confirmation for a user with another email succeeded")
+	}
+	if user := getTestUser(t, "user-1"); user.Email != "other@example.com" {
+		t.Errorf("email = %q, want the existing one kept", user.Email)
+	}
+
+	resetStores(t)
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com"}`)
+	if err := userStore.SetStatus(ctx, "user-1", accountStatusDeleting); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := postConfirmationHandler(ctx, postConfirmationEvent(confirmSignUpTrigger)); err == nil {
+		t.Error("confirmation for a user being deleted succeeded")
+	}
+}
+
+func TestPostConfirmationIgnoresPasswordResets(t *testing.T) {
+	resetStores(t)
+
+	_, err := postConfirmationHandler(context.Background(), postConfirmationEvent("PostConfirmation_ConfirmForgotPassword"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := userStore.GetUser(context.Background(), "user-1"); err != errUserNotFound {
+		t.Errorf("get user error = %v, a password reset provisioned a user", err)
+	}
+}
+
+func TestSignUpPromoMustBeValid(t *testing.T) {
+	for _, promo := range []string{"-1", "five"} {
+		t.Setenv("SIGN_UP_PROMO", promo)
+		if _, err := signUpWallet(); err == nil {
+			t.Errorf("SIGN_UP_PROMO %q accepted", promo)
+		}
+	}
+}
+
+func preTokenEvent(sub string) events.CognitoEventUserPoolsPreTokenGenV2 {
+	event := events.CognitoEventUserPoolsPreTokenGenV2{}
+	event.Request.UserAttributes = map[string]string{"sub": sub}
+	event.Request.GroupConfiguration.GroupsToOverride = []string{adminsGroup}
+	return event
+}
+
+func TestPreTokenGenerationAddsClaims(t *testing.T) {
+	resetStores(t)
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com","wallet_amount":{"amount":"5","currency":"USD"}}`)
+
+	event, err := preTokenGenerationHandler(context.Background(), preTokenEvent("user-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	details := event.Response.ClaimsAndScopeOverrideDetails
+	for name, claims := range map[string]map[string]string{
+		"id":     details.IDTokenGeneration.ClaimsToAddOrOverride,
+		"access": details.AccessTokenGeneration.ClaimsToAddOrOverride,
+	} {
+		if claims["plan"] != defaultPlan || claims["account_status"] != accountStatusActive {
+			t.Errorf("%s token claims = %v", name, claims)
+		}
+	}
+	if groups := details.GroupOverrideDetails.GroupsToOverride; len(groups) != 1 || groups[0] != adminsGroup {
+		t.Errorf("groups = %v, want the caller's groups kept", groups)
+	}
+}
+
+func TestPreTokenGenerationUsesCachedClaimsWhenReadsFail(t *testing.T) {
+	resetStores(t)
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com"}`)
+	if _, ok := lookupTokenClaims(context.Background(), "user-1"); !ok {
+		t.Fatal("no claims for user-1")
+	}
+
+	// A user without a row gets a token without claims
+	event, err := preTokenGenerationHandler(context.Background(), preTokenEvent("nobody"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims := event.Response.ClaimsAndScopeOverrideDetails.IDTokenGeneration.ClaimsToAddOrOverride; len(claims) != 0 {
+		t.Errorf("claims = %v, want none", claims)
+	}
+
+	// Stale claims are still served when the users table cannot be read
+	tokenClaimsCache.claims["user-1"] = cachedTokenClaims{
+		claims:   tokenClaimsCache.claims["user-1"].claims,
+		loadedAt: tokenClaimsCache.claims["user-1"].loadedAt.Add(-2 * tokenClaimsCacheTTL),
+	}
+	userStore = failingUserStore{userStore}
+	claims, ok := lookupTokenClaims(context.Background(), "user-1")
+	if !ok || claims["account_status"] != accountStatusInsufficientFunds {
+		t.Errorf("claims = %v, want the cached claims", claims)
+	}
+}
+
+// failingUserStore fails every read.
+type failingUserStore struct {
+	UserStore
+}
+
+func (s failingUserStore) GetUser(ctx context.Context, userID string) (User, error) {
+	return User{}, errors.New("table unavailable")
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runCommand runs one of the local maintenance commands and returns the
+// process exit code.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "local":
+		runLocal()
+		return 0
+	case "reconcile":
+		return runReconcile(args[1:])
+	case "migrate-api-keys":
+		return runMigrateApiKeys()
+	case "migrate-money":
+		return runMigrateMoney()
+	case "migrate-transactions":
+		return runMigrateTransactions()
+	case "seed-plans":
+		return runSeedPlans()
+	case "seed-prices":
+		return runSeedPrices()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		return 2
+	}
+}
+
+// runLocal feeds newline-delimited requests from stdin through the handler so
+// the operations can be exercised without the Lambda runtime, typically with
+// STORE_BACKEND=memory.
+func runLocal() {
+	metricsOutput = os.Stderr
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		request := Request{}
+		err := json.Unmarshal(scanner.Bytes(), &request)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid request, %v\n", err)
+			continue
+		}
+
+		result, err := handler(context.Background(), request)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", request.Operation, err)
+			continue
+		}
+		fmt.Println(result)
+	}
+}
+
+// runReconcile compares every wallet with its ledger and prints the drift
+// report. With --fix it also posts correcting ledger entries.
+func runReconcile(args []string) int {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	fix := flags.Bool("fix", false, "post reconciliation entries for drifted wallets")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	report, err := reconcileWallets(context.Background(), *fix)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to reconcile wallets, %v\n", err)
+		return 1
+	}
+
+	reportJson, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to marshal reconciliation report, %v\n", err)
+		return 1
+	}
+	fmt.Println(string(reportJson))
+	if len(report.Drifted) > 0 && !*fix {
+		return 3
+	}
+	return 0
+}
+
+// runMigrateApiKeys rewrites API keys stored in plain text by earlier
+// versions into hashed rows.
+func runMigrateApiKeys() int {
+	store, ok := apiKeyStore.(*dynamoStore)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "migrate-api-keys requires the DynamoDB backend")
+		return 1
+	}
+
+	migrated, err := store.migrateLegacyApiKeys(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to migrate API keys, %v\n", err)
+		return 1
+	}
+	fmt.Printf("migrated %d API keys\n", migrated)
+	return 0
+}
+
+// runMigrateMoney converts wallet balances and credit limits stored as floats
+// by earlier versions into micro-units.
+func runMigrateMoney() int {
+	store, ok := userStore.(*dynamoStore)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "migrate-money requires the DynamoDB backend")
+		return 1
+	}
+
+	migrated, err := store.migrateLegacyMoney(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to migrate balances, %v\n", err)
+		return 1
+	}
+	fmt.Printf("migrated %d users\n", migrated)
+	return 0
+}
+
+// runMigrateTransactions copies transactions from the original table, keyed by
+// millisecond ids, into transactions_v2.
+func runMigrateTransactions() int {
+	store, ok := ledgerStore.(*dynamoStore)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "migrate-transactions requires the DynamoDB backend")
+		return 1
+	}
+
+	migrated, err := store.migrateLegacyTransactions(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to migrate transactions, %v\n", err)
+		return 1
+	}
+	fmt.Printf("migrated %d transactions\n", migrated)
+	return 0
+}
+
+// runSeedPlans writes the default subscription plans missing from the plans
+// table.
+func runSeedPlans() int {
+	seeded, err := seedPlans(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to seed plans, %v\n", err)
+		return 1
+	}
+	fmt.Printf("seeded %d plans\n", seeded)
+	return 0
+}
+
+// runSeedPrices writes the default price tables missing from the prices
+// table.
+func runSeedPrices() int {
+	seeded, err := seedPriceTables(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to seed prices, %v\n", err)
+		return 1
+	}
+	fmt.Printf("seeded %d price tables\n", seeded)
+	return 0
+}
@@ -0,0 +1,1437 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const (
+	usersTableName        = "users"
+	apiKeysTableName      = "api_keys"
+	transactionsTableName = "transactions_v2"
+	// legacyTransactionsTableName is keyed by millisecond transaction ids
+	// and only read by migrateLegacyTransactions.
+	legacyTransactionsTableName = "transactions"
+	idempotencyTableName        = "idempotency_keys"
+	journalTableName            = "ledger_entries"
+	rateLimitsTableName         = "rate_limits"
+	plansTableName              = "plans"
+	usageTableName              = "usage"
+	pricesTableName             = "prices"
+
+	userIDIndexName = "user_id-index"
+
+	// Cancellation reason code reported for a failed condition inside
+	// TransactWriteItems.
+	conditionalCheckFailedReason = "ConditionalCheckFailed"
+
+	// rateLimitAttempts bounds the retries when concurrent requests race
+	// to update the same limiter.
+	rateLimitAttempts = 5
+)
+
+// dynamoStore implements UserStore, ApiKeyStore, LedgerStore,
+// IdempotencyStore, RateLimitStore, PlanStore, UsageStore and PriceStore on
+// top of the tables created by CreateDynamoDBTables.
+type dynamoStore struct {
+	db dynamodbiface.DynamoDBAPI
+}
+
+func isConditionalCheckFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+func newDynamoStore(db dynamodbiface.DynamoDBAPI) *dynamoStore {
+	return &dynamoStore{db: db}
+}
+
+func (s *dynamoStore) CreateUser(ctx context.Context, user User) error {
+	userItem, err := dynamodbattribute.MarshalMap(user)
+	if err != nil {
+		return fmt.Errorf("failed to marshal user, %v", err)
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName:           aws.String(usersTableName),
+		Item:                userItem,
+		ConditionExpression: aws.String("attribute_not_exists(user_id)"),
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, input)
+	if isConditionalCheckFailed(err) {
+		return errUserExists
+	}
+	return err
+}
+
+func (s *dynamoStore) GetUser(ctx context.Context, userID string) (User, error) {
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(usersTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"user_id": {
+				S: aws.String(userID),
+			},
+		},
+	}
+
+	result, err := s.db.GetItemWithContext(ctx, input)
+	if err != nil {
+		return User{}, err
+	}
+
+	if result.Item == nil {
+		return User{}, errUserNotFound
+	}
+
+	user := User{}
+	err = dynamodbattribute.UnmarshalMap(result.Item, &user)
+	if err != nil {
+		return User{}, fmt.Errorf("failed to unmarshal user, %v", err)
+	}
+
+	return user, nil
+}
+
+func (s *dynamoStore) SetCreditLimit(ctx context.Context, userID string, creditLimit Money) error {
+	creditLimitValue, err := dynamodbattribute.Marshal(creditLimit)
+	if err != nil {
+		return fmt.Errorf("failed to marshal credit limit, %v", err)
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(usersTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"user_id": {
+				S: aws.String(userID),
+			},
+		},
+		UpdateExpression:    aws.String("SET credit_limit = :credit_limit"),
+		ConditionExpression: aws.String("attribute_exists(user_id)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":credit_limit": creditLimitValue,
+		},
+	}
+
+	_, err = s.db.UpdateItemWithContext(ctx, input)
+	if isConditionalCheckFailed(err) {
+		return errUserNotFound
+	}
+	return err
+}
+
+func (s *dynamoStore) SetPlan(ctx context.Context, userID string, planID string) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(usersTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"user_id": {
+				S: aws.String(userID),
+			},
+		},
+		UpdateExpression:    aws.String("SET #plan = :plan"),
+		ConditionExpression: aws.String("attribute_exists(user_id)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#plan": aws.String("plan"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":plan": {
+				S: aws.String(planID),
+			},
+		},
+	}
+
+	_, err := s.db.UpdateItemWithContext(ctx, input)
+	if isConditionalCheckFailed(err) {
+		return errUserNotFound
+	}
+	return err
+}
+
+func (s *dynamoStore) SetStatus(ctx context.Context, userID string, status string) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(usersTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"user_id": {
+				S: aws.String(userID),
+			},
+		},
+		UpdateExpression:    aws.String("SET #status = :status"),
+		ConditionExpression: aws.String("attribute_exists(user_id)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String("status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":status": {
+				S: aws.String(status),
+			},
+		},
+	}
+
+	_, err := s.db.UpdateItemWithContext(ctx, input)
+	if isConditionalCheckFailed(err) {
+		return errUserNotFound
+	}
+	return err
+}
+
+func (s *dynamoStore) DeleteUser(ctx context.Context, userID string) error {
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(usersTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"user_id": {
+				S: aws.String(userID),
+			},
+		},
+	}
+
+	_, err := s.db.DeleteItemWithContext(ctx, input)
+	return err
+}
+
+func (s *dynamoStore) ListUsers(ctx context.Context, after string, limit int) ([]User, string, error) {
+	input := &dynamodb.ScanInput{
+		TableName: aws.String(usersTableName),
+		Limit:     aws.Int64(int64(limit)),
+	}
+	if after != "" {
+		input.ExclusiveStartKey = map[string]*dynamodb.AttributeValue{
+			"user_id": {
+				S: aws.String(after),
+			},
+		}
+	}
+
+	result, err := s.db.ScanWithContext(ctx, input)
+	if err != nil {
+		return nil, "", err
+	}
+
+	users := []User{}
+	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &users)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal users, %v", err)
+	}
+
+	next := ""
+	if len(result.LastEvaluatedKey) > 0 {
+		next = aws.StringValue(result.LastEvaluatedKey["user_id"].S)
+	}
+	return users, next, nil
+}
+
+func (s *dynamoStore) CreateApiKey(ctx context.Context, key ApiKey) error {
+	keyItem, err := dynamodbattribute.MarshalMap(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal API key, %v", err)
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName:           aws.String(apiKeysTableName),
+		Item:                keyItem,
+		ConditionExpression: aws.String("attribute_not_exists(api_key)"),
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, input)
+	if isConditionalCheckFailed(err) {
+		return errApiKeyExists
+	}
+	return err
+}
+
+func (s *dynamoStore) GetApiKey(ctx context.Context, keyID string) (ApiKey, error) {
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(apiKeysTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"api_key": {
+				S: aws.String(keyID),
+			},
+		},
+	}
+
+	result, err := s.db.GetItemWithContext(ctx, input)
+	if err != nil {
+		return ApiKey{}, err
+	}
+
+	if result.Item == nil {
+		return ApiKey{}, errApiKeyNotFound
+	}
+
+	key := ApiKey{}
+	err = dynamodbattribute.UnmarshalMap(result.Item, &key)
+	if err != nil {
+		return ApiKey{}, fmt.Errorf("failed to unmarshal API key, %v", err)
+	}
+
+	return key, nil
+}
+
+func (s *dynamoStore) RevokeApiKey(ctx context.Context, keyID string, revokedAt time.Time) error {
+	revokedAtValue, err := dynamodbattribute.Marshal(revokedAt)
+	if err != nil {
+		return fmt.Errorf("failed to marshal revocation time, %v", err)
+	}
+
+	return s.updateActiveApiKey(ctx, keyID, &dynamodb.UpdateItemInput{
+		UpdateExpression:    aws.String("SET #status = :revoked, expires_at = :expires_at, #ttl = :ttl"),
+		ConditionExpression: aws.String("#status = :active"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String("status"),
+			"#ttl":    aws.String("ttl"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":revoked":    {S: aws.String(apiKeyStatusRevoked)},
+			":active":     {S: aws.String(apiKeyStatusActive)},
+			":expires_at": revokedAtValue,
+			":ttl":        {N: aws.String(strconv.FormatInt(revokedAt.Unix(), 10))},
+		},
+	})
+}
+
+func (s *dynamoStore) RotateApiKey(ctx context.Context, keyID string, replacedBy string, expiresAt time.Time) error {
+	expiresAtValue, err := dynamodbattribute.Marshal(expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to marshal expiry, %v", err)
+	}
+
+	return s.updateActiveApiKey(ctx, keyID, &dynamodb.UpdateItemInput{
+		UpdateExpression:    aws.String("SET replaced_by = :replaced_by, expires_at = :expires_at, #ttl = :ttl"),
+		ConditionExpression: aws.String("#status = :active AND attribute_not_exists(replaced_by)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String("status"),
+			"#ttl":    aws.String("ttl"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":active":      {S: aws.String(apiKeyStatusActive)},
+			":replaced_by": {S: aws.String(replacedBy)},
+			":expires_at":  expiresAtValue,
+			":ttl":         {N: aws.String(strconv.FormatInt(expiresAt.Unix(), 10))},
+		},
+	})
+}
+
+func (s *dynamoStore) SetApiKeyExpiry(ctx context.Context, keyID string, expiresAt *time.Time) error {
+	input := &dynamodb.UpdateItemInput{
+		UpdateExpression:    aws.String("REMOVE expires_at, #ttl"),
+		ConditionExpression: aws.String("#status = :active AND attribute_not_exists(replaced_by)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String("status"),
+			"#ttl":    aws.String("ttl"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":active": {S: aws.String(apiKeyStatusActive)},
+		},
+	}
+	if expiresAt != nil {
+		expiresAtValue, err := dynamodbattribute.Marshal(*expiresAt)
+		if err != nil {
+			return fmt.Errorf("failed to marshal expiry, %v", err)
+		}
+		input.UpdateExpression = aws.String("SET expires_at = :expires_at, #ttl = :ttl")
+		input.ExpressionAttributeValues[":expires_at"] = expiresAtValue
+		input.ExpressionAttributeValues[":ttl"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(expiresAt.Unix(), 10))}
+	}
+
+	return s.updateActiveApiKey(ctx, keyID, input)
+}
+
+// updateActiveApiKey runs a conditional update of the key. When the
+// condition fails the key is read again to report why.
+func (s *dynamoStore) updateActiveApiKey(ctx context.Context, keyID string, input *dynamodb.UpdateItemInput) error {
+	input.TableName = aws.String(apiKeysTableName)
+	input.Key = map[string]*dynamodb.AttributeValue{
+		"api_key": {
+			S: aws.String(keyID),
+		},
+	}
+
+	_, err := s.db.UpdateItemWithContext(ctx, input)
+	if !isConditionalCheckFailed(err) {
+		return err
+	}
+
+	key, err := s.GetApiKey(ctx, keyID)
+	if err != nil {
+		return err
+	}
+	return apiKeyUpdateRejection(key)
+}
+
+func (s *dynamoStore) TouchApiKey(ctx context.Context, keyID string, usedAt time.Time) error {
+	usedAtValue, err := dynamodbattribute.Marshal(usedAt)
+	if err != nil {
+		return fmt.Errorf("failed to marshal last used time, %v", err)
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(apiKeysTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"api_key": {
+				S: aws.String(keyID),
+			},
+		},
+		UpdateExpression:    aws.String("SET last_used_at = :used_at"),
+		ConditionExpression: aws.String("attribute_exists(api_key)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":used_at": usedAtValue,
+		},
+	}
+
+	_, err = s.db.UpdateItemWithContext(ctx, input)
+	if isConditionalCheckFailed(err) {
+		return errApiKeyNotFound
+	}
+	return err
+}
+
+func (s *dynamoStore) ListApiKeys(ctx context.Context, userID string) ([]ApiKey, error) {
+	input := &dynamodb.QueryInput{
+		TableName: aws.String(apiKeysTableName),
+		IndexName: aws.String(userIDIndexName),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"user_id": {
+				ComparisonOperator: aws.String("EQ"),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(userID),
+					},
+				},
+			},
+		},
+	}
+
+	keys := []ApiKey{}
+	for {
+		result, err := s.db.QueryWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+
+		page := []ApiKey{}
+		err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal API keys, %v", err)
+		}
+		keys = append(keys, page...)
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return keys, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+func (s *dynamoStore) DeleteApiKey(ctx context.Context, keyID string) error {
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(apiKeysTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"api_key": {
+				S: aws.String(keyID),
+			},
+		},
+	}
+
+	_, err := s.db.DeleteItemWithContext(ctx, input)
+	return err
+}
+
+// migrateLegacyApiKeys replaces every API key row that still holds a plain
+// text key with a hashed row under the key id parseApiKey derives for it, so
+// existing keys keep working.
+func (s *dynamoStore) migrateLegacyApiKeys(ctx context.Context) (int, error) {
+	migrated := 0
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String(apiKeysTableName),
+		FilterExpression: aws.String("attribute_not_exists(#hash)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#hash": aws.String("hash"),
+		},
+	}
+
+	for {
+		result, err := s.db.ScanWithContext(ctx, input)
+		if err != nil {
+			return migrated, err
+		}
+
+		for _, item := range result.Items {
+			rawKey := aws.StringValue(item["api_key"].S)
+			salt, err := newApiKeySalt()
+			if err != nil {
+				return migrated, err
+			}
+
+			keyItem, err := dynamodbattribute.MarshalMap(ApiKey{
+				KeyID:     legacyApiKeyID(rawKey),
+				UserID:    aws.StringValue(item["user_id"].S),
+				Label:     "migrated",
+				Status:    apiKeyStatusActive,
+				Salt:      salt,
+				Hash:      hashApiKeySecret(salt, rawKey),
+				CreatedAt: time.Now().UTC(),
+			})
+			if err != nil {
+				return migrated, fmt.Errorf("failed to marshal API key, %v", err)
+			}
+
+			_, err = s.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+				TransactItems: []*dynamodb.TransactWriteItem{
+					{
+						Put: &dynamodb.Put{
+							TableName: aws.String(apiKeysTableName),
+							Item:      keyItem,
+						},
+					},
+					{
+						Delete: &dynamodb.Delete{
+							TableName: aws.String(apiKeysTableName),
+							Key: map[string]*dynamodb.AttributeValue{
+								"api_key": item["api_key"],
+							},
+						},
+					},
+				},
+			})
+			if err != nil {
+				return migrated, err
+			}
+			migrated++
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return migrated, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// migrateLegacyMoney rewrites users whose wallet_amount or credit_limit is
+// still a plain float into the micro-unit map PostEntry updates. Each
+// rewrite is conditional on the old value so a concurrent change is not lost.
+func (s *dynamoStore) migrateLegacyMoney(ctx context.Context) (int, error) {
+	migrated := 0
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String(usersTableName),
+		FilterExpression: aws.String("attribute_type(wallet_amount, :number) OR attribute_type(credit_limit, :number)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":number": {
+				S: aws.String(dynamodb.ScalarAttributeTypeN),
+			},
+		},
+	}
+
+	for {
+		result, err := s.db.ScanWithContext(ctx, input)
+		if err != nil {
+			return migrated, err
+		}
+
+		for _, item := range result.Items {
+			user := User{}
+			err = dynamodbattribute.UnmarshalMap(item, &user)
+			if err != nil {
+				return migrated, fmt.Errorf("failed to unmarshal user, %v", err)
+			}
+			user.CreditLimit.Currency = user.WalletAmount.Currency
+
+			userItem, err := dynamodbattribute.MarshalMap(user)
+			if err != nil {
+				return migrated, fmt.Errorf("failed to marshal user, %v", err)
+			}
+
+			condition := "wallet_amount = :wallet_amount"
+			values := map[string]*dynamodb.AttributeValue{
+				":wallet_amount": item["wallet_amount"],
+			}
+			if item["credit_limit"] == nil {
+				condition += " AND attribute_not_exists(credit_limit)"
+			} else {
+				condition += " AND credit_limit = :credit_limit"
+				values[":credit_limit"] = item["credit_limit"]
+			}
+
+			_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+				TableName:                 aws.String(usersTableName),
+				Item:                      userItem,
+				ConditionExpression:       aws.String(condition),
+				ExpressionAttributeValues: values,
+			})
+			if isConditionalCheckFailed(err) {
+				return migrated, fmt.Errorf("user %s changed during migration, run the command again", user.UserID)
+			}
+			if err != nil {
+				return migrated, err
+			}
+			migrated++
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return migrated, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+func marshalTransaction(transaction Transaction) (map[string]*dynamodb.AttributeValue, error) {
+	transactionItem, err := dynamodbattribute.MarshalMap(transaction)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal transaction, %v", err)
+	}
+	return transactionItem, nil
+}
+
+// walletUpdate builds the conditional update that applies one wallet posting
+// to the user's balance.
+func (s *dynamoStore) walletUpdate(ctx context.Context, userID string, amount Money) (*dynamodb.TransactWriteItem, error) {
+	// Amounts are added in micro-units and only to a wallet in the same
+	// currency.
+	condition := "attribute_exists(user_id) AND wallet_amount.#currency = :currency"
+	values := map[string]*dynamodb.AttributeValue{
+		":amount": {
+			N: aws.String(strconv.FormatInt(amount.Micros, 10)),
+		},
+		":currency": {
+			S: aws.String(amount.Currency),
+		},
+	}
+
+	if amount.IsNegative() {
+		// Condition expressions cannot do arithmetic, so the lowest balance
+		// that covers the debit is computed from the current credit limit,
+		// and the condition pins that limit in case it changes meanwhile.
+		user, err := s.GetUser(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+
+		minimum, err := amount.Neg().Sub(user.CreditLimit)
+		if err != nil {
+			return nil, err
+		}
+		condition += " AND wallet_amount.micros >= :minimum"
+		values[":minimum"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(minimum.Micros, 10)),
+		}
+		values[":credit_limit"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(user.CreditLimit.Micros, 10)),
+		}
+		if user.CreditLimit.IsZero() {
+			condition += " AND (attribute_not_exists(credit_limit) OR credit_limit.micros = :credit_limit)"
+		} else {
+			condition += " AND credit_limit.micros = :credit_limit"
+		}
+	}
+
+	return &dynamodb.TransactWriteItem{
+		Update: &dynamodb.Update{
+			TableName: aws.String(usersTableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"user_id": {
+					S: aws.String(userID),
+				},
+			},
+			UpdateExpression:    aws.String("SET wallet_amount.micros = wallet_amount.micros + :amount"),
+			ConditionExpression: aws.String(condition),
+			ExpressionAttributeNames: map[string]*string{
+				"#currency": aws.String("currency"),
+			},
+			ExpressionAttributeValues: values,
+		},
+	}, nil
+}
+
+// entryWrites returns the puts that record a journal entry: the entry
+// itself, a guard that stops an entry being reversed twice, and a history
+// row per wallet. Every put is conditional on the item not existing, since
+// entries are immutable.
+func entryWrites(entry JournalEntry) ([]*dynamodb.TransactWriteItem, error) {
+	entryItem, err := dynamodbattribute.MarshalMap(entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal journal entry, %v", err)
+	}
+
+	writes := []*dynamodb.TransactWriteItem{
+		{
+			Put: &dynamodb.Put{
+				TableName:           aws.String(journalTableName),
+				Item:                entryItem,
+				ConditionExpression: aws.String("attribute_not_exists(entry_id)"),
+			},
+		},
+	}
+
+	if entry.ReversalOf != "" {
+		writes = append(writes, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName: aws.String(journalTableName),
+				Item: map[string]*dynamodb.AttributeValue{
+					"entry_id": {
+						S: aws.String(reversalGuardID(entry.ReversalOf)),
+					},
+					"reversed_by": {
+						S: aws.String(entry.EntryID),
+					},
+				},
+				ConditionExpression: aws.String("attribute_not_exists(entry_id)"),
+			},
+		})
+	}
+
+	for _, transaction := range entry.walletTransactions() {
+		transactionItem, err := marshalTransaction(transaction)
+		if err != nil {
+			return nil, err
+		}
+		writes = append(writes, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName:           aws.String(transactionsTableName),
+				Item:                transactionItem,
+				ConditionExpression: aws.String("attribute_not_exists(transaction_id)"),
+			},
+		})
+	}
+	return writes, nil
+}
+
+// reversalGuardID is the journal item that exists once an entry has been
+// reversed.
+func reversalGuardID(entryID string) string {
+	return "reversal#" + entryID
+}
+
+// PostEntry writes the entry and updates every wallet it touches in one
+// TransactWriteItems call, so no part can land without the rest.
+func (s *dynamoStore) PostEntry(ctx context.Context, entry JournalEntry) error {
+	writes, err := entryWrites(entry)
+	if err != nil {
+		return err
+	}
+	guarded := entry.ReversalOf != ""
+
+	// Remember which write belongs to which posting to explain failures
+	walletPostings := []Posting{}
+	for _, posting := range entry.Postings {
+		userID, ok := walletOwner(posting.Account)
+		if !ok {
+			continue
+		}
+		update, err := s.walletUpdate(ctx, userID, posting.Amount)
+		if err != nil {
+			return err
+		}
+		writes = append(writes, update)
+		walletPostings = append(walletPostings, posting)
+	}
+
+	_, err = s.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: writes,
+	})
+	reasons := cancellationReasons(err)
+	if reasons == nil {
+		return err
+	}
+
+	if guarded && len(reasons) > 1 && reasons[1] == conditionalCheckFailedReason {
+		return errAlreadyReversed
+	}
+	firstUpdate := len(writes) - len(walletPostings)
+	for i, posting := range walletPostings {
+		if firstUpdate+i < len(reasons) && reasons[firstUpdate+i] == conditionalCheckFailedReason {
+			return s.walletUpdateRejection(ctx, posting)
+		}
+	}
+	return fmt.Errorf("transaction cancelled, %v", reasons)
+}
+
+// walletUpdateRejection reads the wallet again to explain why its update's
+// condition failed.
+func (s *dynamoStore) walletUpdateRejection(ctx context.Context, posting Posting) error {
+	userID, _ := walletOwner(posting.Account)
+	user, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user.WalletAmount.Currency != posting.Amount.Currency {
+		return errCurrencyMismatch
+	}
+	if posting.Amount.IsNegative() {
+		return errInsufficientFunds
+	}
+	return fmt.Errorf("wallet update for %s was rejected", userID)
+}
+
+func (s *dynamoStore) RecordEntry(ctx context.Context, entry JournalEntry) error {
+	writes, err := entryWrites(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: writes,
+	})
+	if reasons := cancellationReasons(err); reasons != nil {
+		return fmt.Errorf("transaction cancelled, %v", reasons)
+	}
+	return err
+}
+
+func (s *dynamoStore) GetEntry(ctx context.Context, entryID string) (JournalEntry, error) {
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(journalTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"entry_id": {
+				S: aws.String(entryID),
+			},
+		},
+	}
+
+	result, err := s.db.GetItemWithContext(ctx, input)
+	if err != nil {
+		return JournalEntry{}, err
+	}
+
+	// Reversal guards share the table but are not entries
+	if result.Item == nil || result.Item["postings"] == nil {
+		return JournalEntry{}, errEntryNotFound
+	}
+
+	entry := JournalEntry{}
+	err = dynamodbattribute.UnmarshalMap(result.Item, &entry)
+	if err != nil {
+		return JournalEntry{}, fmt.Errorf("failed to unmarshal journal entry, %v", err)
+	}
+
+	return entry, nil
+}
+
+// cancellationReasons returns the per-item cancellation codes of a failed
+// TransactWriteItems call, or nil if err is not a cancellation.
+func cancellationReasons(err error) []string {
+	cancelled, ok := err.(*dynamodb.TransactionCanceledException)
+	if !ok {
+		return nil
+	}
+
+	reasons := make([]string, len(cancelled.CancellationReasons))
+	for i, reason := range cancelled.CancellationReasons {
+		reasons[i] = aws.StringValue(reason.Code)
+	}
+	return reasons
+}
+
+func (s *dynamoStore) CreateTransaction(ctx context.Context, transaction Transaction) error {
+	transactionItem, err := marshalTransaction(transaction)
+	if err != nil {
+		return err
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName:           aws.String(transactionsTableName),
+		Item:                transactionItem,
+		ConditionExpression: aws.String("attribute_not_exists(transaction_id)"),
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, input)
+	if isConditionalCheckFailed(err) {
+		return errTransactionExists
+	}
+	return err
+}
+
+// ListTransactions queries the user's partition newest first. Time ranges and
+// the page cursor become a range on the ULID sort key; type and amount are
+// applied as a filter, so the query keeps reading until the page is full.
+func (s *dynamoStore) ListTransactions(ctx context.Context, query TransactionQuery) (TransactionPage, error) {
+	names := map[string]*string{}
+	values := map[string]*dynamodb.AttributeValue{
+		":user_id": {
+			S: aws.String(query.UserID),
+		},
+	}
+
+	lower, upper := "", ""
+	if query.From != nil {
+		lower = transactionIDLowerBound(*query.From)
+	}
+	if query.To != nil {
+		upper = transactionIDUpperBound(*query.To)
+	}
+	// The cursor item itself is read again and skipped below.
+	if query.After != "" && (upper == "" || query.After < upper) {
+		upper = query.After
+	}
+
+	keyCondition := "user_id = :user_id"
+	switch {
+	case lower != "" && upper != "":
+		keyCondition += " AND transaction_id BETWEEN :lower AND :upper"
+	case lower != "":
+		keyCondition += " AND transaction_id >= :lower"
+	case upper != "":
+		keyCondition += " AND transaction_id <= :upper"
+	}
+	if lower != "" {
+		values[":lower"] = &dynamodb.AttributeValue{S: aws.String(lower)}
+	}
+	if upper != "" {
+		values[":upper"] = &dynamodb.AttributeValue{S: aws.String(upper)}
+	}
+
+	filters := []string{}
+	if len(query.Types) > 0 {
+		placeholders := make([]string, len(query.Types))
+		for i, transactionType := range query.Types {
+			placeholders[i] = fmt.Sprintf(":type%d", i)
+			values[placeholders[i]] = &dynamodb.AttributeValue{S: aws.String(transactionType)}
+		}
+		names["#type"] = aws.String("type")
+		filters = append(filters, fmt.Sprintf("#type IN (%s)", strings.Join(placeholders, ", ")))
+	}
+	if query.MinAmount != nil {
+		filters = append(filters, "amount.micros >= :min_amount")
+		values[":min_amount"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(query.MinAmount.Micros, 10))}
+	}
+	if query.MaxAmount != nil {
+		filters = append(filters, "amount.micros <= :max_amount")
+		values[":max_amount"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(query.MaxAmount.Micros, 10))}
+	}
+	for _, bound := range []*Money{query.MinAmount, query.MaxAmount} {
+		if bound != nil && bound.Currency != "" {
+			filters = append(filters, "amount.currency = :amount_currency")
+			values[":amount_currency"] = &dynamodb.AttributeValue{S: aws.String(bound.Currency)}
+			break
+		}
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(transactionsTableName),
+		KeyConditionExpression:    aws.String(keyCondition),
+		ExpressionAttributeValues: values,
+		ScanIndexForward:          aws.Bool(false),
+	}
+	if len(names) > 0 {
+		input.ExpressionAttributeNames = names
+	}
+	if len(filters) > 0 {
+		input.FilterExpression = aws.String(strings.Join(filters, " AND "))
+	}
+	if query.Limit > 0 {
+		input.Limit = aws.Int64(int64(query.Limit) + 1)
+	}
+
+	page := TransactionPage{Transactions: []Transaction{}}
+	for {
+		result, err := s.db.QueryWithContext(ctx, input)
+		if err != nil {
+			return TransactionPage{}, err
+		}
+
+		transactions := []Transaction{}
+		err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &transactions)
+		if err != nil {
+			return TransactionPage{}, fmt.Errorf("failed to unmarshal transactions, %v", err)
+		}
+
+		for i, transaction := range transactions {
+			if transaction.TransactionID == query.After {
+				continue
+			}
+			page.Transactions = append(page.Transactions, transaction)
+			if query.Limit > 0 && len(page.Transactions) == query.Limit {
+				if i < len(transactions)-1 || len(result.LastEvaluatedKey) > 0 {
+					page.Next = transaction.TransactionID
+				}
+				return page, nil
+			}
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return page, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+func (s *dynamoStore) RedactTransaction(ctx context.Context, userID string, transactionID string, description string) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(transactionsTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"user_id": {
+				S: aws.String(userID),
+			},
+			"transaction_id": {
+				S: aws.String(transactionID),
+			},
+		},
+		UpdateExpression:    aws.String("SET #description = :description"),
+		ConditionExpression: aws.String("attribute_exists(transaction_id)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#description": aws.String("description"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":description": {
+				S: aws.String(description),
+			},
+		},
+	}
+
+	_, err := s.db.UpdateItemWithContext(ctx, input)
+	if isConditionalCheckFailed(err) {
+		return errEntryNotFound
+	}
+	return err
+}
+
+// migrateLegacyTransactions copies every row of the original transactions
+// table into transactions_v2. The new id keeps the row's millisecond
+// timestamp and derives its random part from the old key, so running the
+// migration again skips rows that were already copied.
+func (s *dynamoStore) migrateLegacyTransactions(ctx context.Context) (int, error) {
+	migrated := 0
+	input := &dynamodb.ScanInput{
+		TableName: aws.String(legacyTransactionsTableName),
+	}
+
+	for {
+		result, err := s.db.ScanWithContext(ctx, input)
+		if err != nil {
+			return migrated, err
+		}
+
+		for _, item := range result.Items {
+			legacyID := aws.StringValue(item["transaction_id"].N)
+			millis, err := strconv.ParseInt(legacyID, 10, 64)
+			if err != nil {
+				return migrated, fmt.Errorf("invalid legacy transaction id %q, %v", legacyID, err)
+			}
+			delete(item, "transaction_id")
+
+			transaction := Transaction{}
+			err = dynamodbattribute.UnmarshalMap(item, &transaction)
+			if err != nil {
+				return migrated, fmt.Errorf("failed to unmarshal transaction, %v", err)
+			}
+
+			sum := sha256.Sum256([]byte(transaction.UserID + "/" + legacyID))
+			entropy := [10]byte{}
+			copy(entropy[:], sum[:])
+			transaction.TransactionID = ulidFromEntropy(time.UnixMilli(millis), entropy)
+			transaction.LegacyTransactionID = legacyID
+			transaction.Type = legacyTransactionType(transaction.Description)
+
+			transactionItem, err := marshalTransaction(transaction)
+			if err != nil {
+				return migrated, err
+			}
+
+			_, err = s.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+				TableName:           aws.String(transactionsTableName),
+				Item:                transactionItem,
+				ConditionExpression: aws.String("attribute_not_exists(transaction_id)"),
+			})
+			if isConditionalCheckFailed(err) {
+				continue
+			}
+			if err != nil {
+				return migrated, err
+			}
+			migrated++
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return migrated, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+func (s *dynamoStore) ClaimIdempotencyKey(ctx context.Context, record IdempotencyRecord, now time.Time) (IdempotencyRecord, bool, error) {
+	recordItem, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		return IdempotencyRecord{}, false, fmt.Errorf("failed to marshal idempotency record, %v", err)
+	}
+	// TTL deletion is lazy, so expired records are treated as absent.
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(idempotencyTableName),
+		Item:      recordItem,
+		ConditionExpression: aws.String("attribute_not_exists(idempotency_key) OR #ttl <= :now" +
+			" OR (#status = :in_progress AND locked_until < :now)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#ttl":    aws.String("ttl"),
+			"#status": aws.String("status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {
+				N: aws.String(strconv.FormatInt(now.Unix(), 10)),
+			},
+			":in_progress": {
+				S: aws.String(idempotencyStatusInProgress),
+			},
+		},
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, input)
+	if failed, ok := err.(*dynamodb.ConditionalCheckFailedException); ok {
+		existing := IdempotencyRecord{}
+		err = dynamodbattribute.UnmarshalMap(failed.Item, &existing)
+		if err != nil {
+			return IdempotencyRecord{}, false, fmt.Errorf("failed to unmarshal idempotency record, %v", err)
+		}
+		return existing, false, nil
+	}
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	return IdempotencyRecord{}, true, nil
+}
+
+func (s *dynamoStore) CompleteIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	recordItem, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal idempotency record, %v", err)
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(idempotencyTableName),
+		Item:      recordItem,
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, input)
+	return err
+}
+
+func (s *dynamoStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(idempotencyTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"idempotency_key": {
+				S: aws.String(key),
+			},
+		},
+	}
+
+	_, err := s.db.DeleteItemWithContext(ctx, input)
+	return err
+}
+
+// TakeRateLimit reads the limiter's theoretical arrival time and writes the
+// advanced one back only if no other request changed it in between, retrying
+// when it did. The item expires once the limiter is back to full burst.
+func (s *dynamoStore) TakeRateLimit(ctx context.Context, key string, limit RateLimit, now time.Time) (bool, time.Duration, error) {
+	for attempt := 0; attempt < rateLimitAttempts; attempt++ {
+		result, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(rateLimitsTableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"rate_key": {
+					S: aws.String(key),
+				},
+			},
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return false, 0, err
+		}
+
+		previous := time.Time{}
+		previousAttr, exists := result.Item["tat"]
+		if exists {
+			millis, err := strconv.ParseInt(aws.StringValue(previousAttr.N), 10, 64)
+			if err != nil {
+				return false, 0, fmt.Errorf("invalid rate limit state for %s, %v", key, err)
+			}
+			previous = time.UnixMilli(millis)
+		}
+
+		tat, allowed, retryAfter := limit.allow(previous, now)
+		if !allowed {
+			return false, retryAfter, nil
+		}
+
+		input := &dynamodb.PutItemInput{
+			TableName: aws.String(rateLimitsTableName),
+			Item: map[string]*dynamodb.AttributeValue{
+				"rate_key": {
+					S: aws.String(key),
+				},
+				"tat": {
+					N: aws.String(strconv.FormatInt(tat.UnixMilli(), 10)),
+				},
+				"ttl": {
+					N: aws.String(strconv.FormatInt(tat.Unix()+1, 10)),
+				},
+			},
+			ConditionExpression: aws.String("attribute_not_exists(rate_key)"),
+		}
+		if exists {
+			input.ConditionExpression = aws.String("tat = :previous")
+			input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+				":previous": previousAttr,
+			}
+		}
+
+		_, err = s.db.PutItemWithContext(ctx, input)
+		if _, ok := err.(*dynamodb.ConditionalCheckFailedException); ok {
+			continue
+		}
+		if err != nil {
+			return false, 0, err
+		}
+		return true, 0, nil
+	}
+	return false, 0, fmt.Errorf("rate limit for %s is too contended", key)
+}
+
+func (s *dynamoStore) GetPlan(ctx context.Context, planID string) (Plan, error) {
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(plansTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"plan_id": {
+				S: aws.String(planID),
+			},
+		},
+	}
+
+	result, err := s.db.GetItemWithContext(ctx, input)
+	if err != nil {
+		return Plan{}, err
+	}
+	if result.Item == nil {
+		return Plan{}, errPlanNotFound
+	}
+
+	plan := Plan{}
+	err = dynamodbattribute.UnmarshalMap(result.Item, &plan)
+	if err != nil {
+		return Plan{}, fmt.Errorf("failed to unmarshal plan, %v", err)
+	}
+	return plan, nil
+}
+
+func (s *dynamoStore) PutPlan(ctx context.Context, plan Plan) error {
+	planItem, err := dynamodbattribute.MarshalMap(plan)
+	if err != nil {
+		return fmt.Errorf("failed to marshal plan, %v", err)
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(plansTableName),
+		Item:      planItem,
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, input)
+	return err
+}
+
+func (s *dynamoStore) GetPriceTable(ctx context.Context, operation string) (PriceTable, error) {
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(pricesTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"operation": {
+				S: aws.String(operation),
+			},
+		},
+	}
+
+	result, err := s.db.GetItemWithContext(ctx, input)
+	if err != nil {
+		return PriceTable{}, err
+	}
+	if result.Item == nil {
+		return PriceTable{}, errPriceNotFound
+	}
+
+	table := PriceTable{}
+	err = dynamodbattribute.UnmarshalMap(result.Item, &table)
+	if err != nil {
+		return PriceTable{}, fmt.Errorf("failed to unmarshal price table, %v", err)
+	}
+	return table, nil
+}
+
+func (s *dynamoStore) PutPriceTable(ctx context.Context, table PriceTable) error {
+	tableItem, err := dynamodbattribute.MarshalMap(table)
+	if err != nil {
+		return fmt.Errorf("failed to marshal price table, %v", err)
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(pricesTableName),
+		Item:      tableItem,
+	}
+
+	_, err = s.db.PutItemWithContext(ctx, input)
+	return err
+}
+
+func usageKey(userID string, period string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"user_id": {
+			S: aws.String(userID),
+		},
+		"period": {
+			S: aws.String(period),
+		},
+	}
+}
+
+// CountCall increments the counter in place; the limit is a condition on
+// the same update, so concurrent calls can never overshoot it.
+func (s *dynamoStore) CountCall(ctx context.Context, userID string, period string, limit int64) (int64, error) {
+	input := &dynamodb.UpdateItemInput{
+		TableName:        aws.String(usageTableName),
+		Key:              usageKey(userID, period),
+		UpdateExpression: aws.String("ADD calls :one"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one": {
+				N: aws.String("1"),
+			},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueUpdatedNew),
+	}
+	if limit > 0 {
+		input.ConditionExpression = aws.String("attribute_not_exists(calls) OR calls < :limit")
+		input.ExpressionAttributeValues[":limit"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(limit, 10)),
+		}
+	}
+
+	result, err := s.db.UpdateItemWithContext(ctx, input)
+	if isConditionalCheckFailed(err) {
+		return limit, errQuotaLimitReached
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(aws.StringValue(result.Attributes["calls"].N), 10, 64)
+}
+
+func (s *dynamoStore) ReleaseCall(ctx context.Context, userID string, period string) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName:           aws.String(usageTableName),
+		Key:                 usageKey(userID, period),
+		UpdateExpression:    aws.String("ADD calls :minus_one"),
+		ConditionExpression: aws.String("calls > :zero"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":minus_one": {
+				N: aws.String("-1"),
+			},
+			":zero": {
+				N: aws.String("0"),
+			},
+		},
+	}
+
+	_, err := s.db.UpdateItemWithContext(ctx, input)
+	if isConditionalCheckFailed(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *dynamoStore) AddUsageCost(ctx context.Context, userID string, period string, cost Money) (Money, error) {
+	input := &dynamodb.UpdateItemInput{
+		TableName:        aws.String(usageTableName),
+		Key:              usageKey(userID, period),
+		UpdateExpression: aws.String("ADD cost_micros :cost SET currency = if_not_exists(currency, :currency)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":cost": {
+				N: aws.String(strconv.FormatInt(cost.Micros, 10)),
+			},
+			":currency": {
+				S: aws.String(cost.Currency),
+			},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueUpdatedNew),
+	}
+
+	result, err := s.db.UpdateItemWithContext(ctx, input)
+	if err != nil {
+		return Money{}, err
+	}
+	micros, err := strconv.ParseInt(aws.StringValue(result.Attributes["cost_micros"].N), 10, 64)
+	if err != nil {
+		return Money{}, err
+	}
+	return newMoney(micros, cost.Currency), nil
+}
+
+func (s *dynamoStore) GetUsage(ctx context.Context, userID string, period string) (Usage, error) {
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(usageTableName),
+		Key:       usageKey(userID, period),
+	}
+
+	result, err := s.db.GetItemWithContext(ctx, input)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	usage := Usage{UserID: userID, Period: period}
+	if calls, ok := result.Item["calls"]; ok {
+		usage.Calls, err = strconv.ParseInt(aws.StringValue(calls.N), 10, 64)
+		if err != nil {
+			return Usage{}, fmt.Errorf("failed to parse usage calls, %v", err)
+		}
+	}
+	if cost, ok := result.Item["cost_micros"]; ok {
+		usage.Cost.Micros, err = strconv.ParseInt(aws.StringValue(cost.N), 10, 64)
+		if err != nil {
+			return Usage{}, fmt.Errorf("failed to parse usage cost, %v", err)
+		}
+		usage.Cost.Currency = aws.StringValue(result.Item["currency"].S)
+	}
+	return usage, nil
+}
+
+// DeleteUsage reads only the keys of the user's partition and deletes the
+// periods one by one; a user has one item per month of use.
+func (s *dynamoStore) DeleteUsage(ctx context.Context, userID string) (int, error) {
+	deleted := 0
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(usageTableName),
+		KeyConditionExpression: aws.String("user_id = :user_id"),
+		ProjectionExpression:   aws.String("user_id, #period"),
+		ExpressionAttributeNames: map[string]*string{
+			"#period": aws.String("period"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":user_id": {
+				S: aws.String(userID),
+			},
+		},
+	}
+
+	for {
+		result, err := s.db.QueryWithContext(ctx, input)
+		if err != nil {
+			return deleted, err
+		}
+
+		for _, item := range result.Items {
+			_, err = s.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+				TableName: aws.String(usageTableName),
+				Key:       usageKey(userID, aws.StringValue(item["period"].S)),
+			})
+			if err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return deleted, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// cancellingDynamoDB holds a single user and cancels every transaction,
+// failing the condition of the writes that fail reports true for.
+type cancellingDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	user  User
+	fails func(write *dynamodb.TransactWriteItem) bool
+}
+
+func (db *cancellingDynamoDB) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, options ...request.Option) (*dynamodb.GetItemOutput, error) {
+	item, err := dynamodbattribute.MarshalMap(db.user)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.GetItemOutput{Item: item}, nil
+}
+
+func (db *cancellingDynamoDB) TransactWriteItemsWithContext(ctx aws.Context, input *dynamodb.TransactWriteItemsInput, options ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	reasons := make([]*dynamodb.CancellationReason, len(input.TransactItems))
+	for i, write := range input.TransactItems {
+		code := "None"
+		if db.fails(write) {
+			code = conditionalCheckFailedReason
+		}
+		reasons[i] = &dynamodb.CancellationReason{Code: aws.String(code)}
+	}
+	return nil, &dynamodb.TransactionCanceledException{CancellationReasons: reasons}
+}
+
+func isWalletUpdate(write *dynamodb.TransactWriteItem) bool {
+	return write.Update != nil && aws.StringValue(write.Update.TableName) == usersTableName
+}
+
+func TestDynamoStorePostEntryExplainsCancellations(t *testing.T) {
+	ctx := context.Background()
+	user := User{UserID: "user-1", WalletAmount: newMoney(1000000, "USD"), CreditLimit: newMoney(0, "USD")}
+
+	for _, test := range []struct {
+		name   string
+		amount Money
+		fails  func(write *dynamodb.TransactWriteItem) bool
+		want   error
+	}{
+		{"overdraft", newMoney(-3000000, "USD"), isWalletUpdate, errInsufficientFunds},
+		{"other currency", newMoney(3000000, "EUR"), isWalletUpdate, errCurrencyMismatch},
+	} {
+		store := newDynamoStore(&cancellingDynamoDB{user: user, fails: test.fails})
+		entry, err := newWalletEntry("user-1", test.amount, accountRevenue, transactionTypeUsage, "api call cost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := store.PostEntry(ctx, entry); err != test.want {
+			t.Errorf("%s error = %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	// A cancellation that is not the wallet's condition is not taken for
+	// one
+	journalFails := func(write *dynamodb.TransactWriteItem) bool {
+		return write.Put != nil && aws.StringValue(write.Put.TableName) == journalTableName
+	}
+	store := newDynamoStore(&cancellingDynamoDB{user: user, fails: journalFails})
+	entry, err := newWalletEntry("user-1", newMoney(-500000, "USD"), accountRevenue, transactionTypeUsage, "api call cost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.PostEntry(ctx, entry)
+	if err == nil || isCallerError(err) {
+		t.Errorf("journal conflict error = %v, want an internal error", err)
+	}
+
+	// The reversal guard failing means the entry was reversed already
+	entry.ReversalOf = "01ORIGINAL"
+	if err := store.PostEntry(ctx, entry); err != errAlreadyReversed {
+		t.Errorf("second reversal error = %v, want %v", err, errAlreadyReversed)
+	}
+}
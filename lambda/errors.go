@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// FieldError describes a single payload field that failed validation.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when a request payload cannot be decoded or
+// fails validation. It lists every offending field so the caller can fix
+// them all at once. Error renders it as JSON, which is what the Lambda
+// runtime hands back to API Gateway as the errorMessage.
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	body, err := json.Marshal(struct {
+		Code    string       `json:"code"`
+		Message string       `json:"message"`
+		Fields  []FieldError `json:"fields"`
+	}{
+		Code:    "VALIDATION_ERROR",
+		Message: "invalid payload",
+		Fields:  e.Fields,
+	})
+	if err != nil {
+		return "invalid payload"
+	}
+	return string(body)
+}
+
+// OperationError is a failure the caller is expected to act on, identified by
+// a stable machine-readable code. Like ValidationError it renders as JSON.
+type OperationError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// RetryAfterSeconds is set when the request may succeed if repeated
+	// after waiting.
+	RetryAfterSeconds int `json:"retry_after_seconds,omitempty"`
+}
+
+func (e *OperationError) Error() string {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return e.Message
+	}
+	return string(body)
+}
+
+var errInsufficientFunds = &OperationError{
+	Code:    "INSUFFICIENT_FUNDS",
+	Message: "wallet balance and credit limit do not cover this charge",
+}
+
+func errForbidden(message string) error {
+	return &OperationError{Code: "FORBIDDEN", Message: message}
+}
+
+// isCallerError reports whether err describes a problem with the request
+// that should reach the caller as is, rather than be wrapped as an internal
+// failure.
+func isCallerError(err error) bool {
+	switch err.(type) {
+	case *ValidationError, *OperationError:
+		return true
+	}
+	return err == errUserNotFound || err == errUserExists || err == errEntryNotFound || isApiKeyRejected(err)
+}
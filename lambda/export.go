@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	exportFormatCSV   = "csv"
+	exportFormatJSONL = "jsonl"
+
+	// exportURLLifetime is how long the presigned download link works.
+	exportURLLifetime = 15 * time.Minute
+	// exportPageSize is how many transactions are read per store call while
+	// streaming an export.
+	exportPageSize = maxTransactionPageSize
+)
+
+// exportPrefix is the folder all of a user's exports are written under.
+func exportPrefix(userID string) string {
+	return "exports/" + userID + "/"
+}
+
+var exportFormats = []string{exportFormatCSV, exportFormatJSONL}
+
+var exportContentTypes = map[string]string{
+	exportFormatCSV:   "text/csv",
+	exportFormatJSONL: "application/x-ndjson",
+}
+
+// exportTransactionHistory streams every one of the user's transactions into
+// a file in the object store and returns a presigned link to download it.
+// Transactions are written as they are read, page by page, so exports of any
+// size run in constant memory.
+func exportTransactionHistory(ctx context.Context, userID string, format string) (string, error) {
+	exportID, err := newULID(time.Now())
+	if err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("%s%s.%s", exportPrefix(userID), exportID, format)
+
+	count, err := uploadExport(ctx, key, exportContentTypes[format], func(w io.Writer) (int, error) {
+		return writeTransactionExport(ctx, w, userID, format)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to write export, %v", err)
+	}
+
+	url, err := objectStore.PresignGetObject(ctx, key, exportURLLifetime)
+	if err != nil {
+		return "", fmt.Errorf("failed to presign export URL, %v", err)
+	}
+
+	resultJson, err := json.Marshal(struct {
+		URL          string    `json:"url"`
+		ExpiresAt    time.Time `json:"expires_at"`
+		Format       string    `json:"format"`
+		Transactions int       `json:"transactions"`
+	}{
+		URL:          url,
+		ExpiresAt:    time.Now().UTC().Add(exportURLLifetime),
+		Format:       format,
+		Transactions: count,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal export JSON, %v", err)
+	}
+
+	return string(resultJson), nil
+}
+
+// uploadExport uploads what write produces to key as it is written, through
+// a pipe, and returns write's count.
+func uploadExport(ctx context.Context, key string, contentType string, write func(io.Writer) (int, error)) (int, error) {
+	reader, writer := io.Pipe()
+	written := make(chan int, 1)
+	go func() {
+		count, err := write(writer)
+		writer.CloseWithError(err)
+		written <- count
+	}()
+
+	err := objectStore.PutObject(ctx, key, contentType, reader)
+	// Unblock the writer if the upload gave up before reading everything
+	reader.CloseWithError(io.ErrClosedPipe)
+	return <-written, err
+}
+
+// writeTransactionExport writes the user's full ledger, newest first, and
+// returns how many transactions were written.
+func writeTransactionExport(ctx context.Context, w io.Writer, userID string, format string) (int, error) {
+	buffered := bufio.NewWriter(w)
+	encode := newExportEncoder(buffered, format)
+
+	count := 0
+	query := TransactionQuery{UserID: userID, Limit: exportPageSize}
+	for {
+		page, err := ledgerStore.ListTransactions(ctx, query)
+		if err != nil {
+			return count, fmt.Errorf("failed to query transactions, %v", err)
+		}
+
+		for _, transaction := range page.Transactions {
+			err = encode(transaction)
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+
+		if page.Next == "" {
+			break
+		}
+		query.After = page.Next
+	}
+
+	return count, buffered.Flush()
+}
+
+// newExportEncoder returns a function that writes one transaction in the
+// given format, writing the CSV header up front.
+func newExportEncoder(w io.Writer, format string) func(Transaction) error {
+	if format == exportFormatJSONL {
+		encoder := json.NewEncoder(w)
+		return func(transaction Transaction) error {
+			return encoder.Encode(transaction)
+		}
+	}
+
+	csvWriter := csv.NewWriter(w)
+	headerErr := csvWriter.Write([]string{"transaction_id", "created_at", "type", "amount", "currency", "description"})
+	return func(transaction Transaction) error {
+		if headerErr != nil {
+			return headerErr
+		}
+		createdAt := ""
+		if at, ok := ulidTimestamp(transaction.TransactionID); ok {
+			createdAt = at.Format(time.RFC3339Nano)
+		}
+		err := csvWriter.Write([]string{
+			transaction.TransactionID,
+			createdAt,
+			transaction.Type,
+			transaction.Amount.String(),
+			transaction.Amount.Currency,
+			spreadsheetSafe(transaction.Description),
+		})
+		if err != nil {
+			return err
+		}
+		csvWriter.Flush()
+		return csvWriter.Error()
+	}
+}
+
+// spreadsheetSafe stops free text from being evaluated as a formula when
+// the CSV is opened in a spreadsheet.
+func spreadsheetSafe(value string) string {
+	if value != "" && strings.ContainsAny(value[:1], "=+-@\t\r") {
+		return "'" + value
+	}
+	return value
+}
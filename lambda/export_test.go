@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// exportedObject returns what an export result's URL points at in the
+// in-memory object store.
+func exportedObject(t *testing.T, result string) string {
+	t.Helper()
+	export := struct {
+		URL          string `json:"url"`
+		Transactions int    `json:"transactions"`
+	}{}
+	if err := json.Unmarshal([]byte(result), &export); err != nil {
+		t.Fatalf("export returned invalid JSON %q, %v", result, err)
+	}
+	store := objectStore.(*memoryObjectStore)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	data, ok := store.objects[strings.TrimPrefix(export.URL, "memory://")]
+	if !ok {
+		t.Fatalf("no object at %s", export.URL)
+	}
+	return string(data)
+}
+
+func TestExportTransactionHistoryCSV(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com"}`)
+	if err := postWalletEntry(ctx, "user-1", newMoney(2500000, "USD"), accountPromotions, transactionTypeTopUp, "wallet top-up"); err != nil {
+		t.Fatal(err)
+	}
+	err := ledgerStore.CreateTransaction(ctx, Transaction{TransactionID: "01MEMO", UserID: "user-1", Amount: newMoney(0, "USD"), Type: transactionTypeManual, Description: "=HYPERLINK(\"x\")"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := exportedObject(t, mustInvoke(t, "exportTransactionHistory", `{"user_id":"user-1","format":"csv"}`))
+	rows, err := csv.NewReader(strings.NewReader(data)).ReadAll()
+	if err != nil {
+		t.Fatalf("export is not valid CSV, %v", err)
+	}
+	if len(rows) != 3 || rows[0][0] != "transaction_id" {
+		t.Fatalf("rows = %v, want a header and 2 transactions", rows)
+	}
+	for _, row := range rows[1:] {
+		switch row[2] {
+		case transactionTypeTopUp:
+			if row[3] != "2.500000" || row[4] != "USD" || row[1] == "" {
+				t.Errorf("top-up row = %v", row)
+			}
+		case transactionTypeManual:
+			if row[5] != "'=HYPERLINK(\"x\")" {
+				t.Errorf("description = %q, want it escaped for spreadsheets", row[5])
+			}
+		}
+	}
+}
+
+func TestExportTransactionHistoryJSONL(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com"}`)
+	for i := 0; i < 3; i++ {
+		if err := postWalletEntry(ctx, "user-1", newMoney(1000000, "USD"), accountPromotions, transactionTypeTopUp, "wallet top-up"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := exportedObject(t, mustInvoke(t, "exportTransactionHistory", `{"user_id":"user-1","format":"jsonl"}`))
+	lines := strings.Split(strings.TrimSpace(data), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("%d lines, want 3", len(lines))
+	}
+	for _, line := range lines {
+		transaction := Transaction{}
+		if err := json.Unmarshal([]byte(line), &transaction); err != nil {
+			t.Errorf("line %q is not a transaction, %v", line, err)
+		}
+	}
+
+	if _, err := invoke(t, "exportTransactionHistory", `{"user_id":"user-1","format":"xlsx"}`); errorCode(err) != "VALIDATION_ERROR" {
+		t.Errorf("unknown format error = %v, want a ValidationError", err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	idempotencyStatusInProgress = "in_progress"
+	idempotencyStatusCompleted  = "completed"
+
+	// idempotencyKeyLifetime is how long a completed result is replayed
+	// before the key can be used again.
+	idempotencyKeyLifetime = 24 * time.Hour
+	// idempotencyLockTimeout bounds how long an in-progress claim blocks
+	// retries, so a request that died mid-flight does not hold its key for
+	// the whole lifetime.
+	idempotencyLockTimeout = time.Minute
+
+	maxIdempotencyKeyLength = 255
+)
+
+// IdempotencyRecord remembers the outcome of a request made with an
+// idempotency key.
+type IdempotencyRecord struct {
+	// Key scopes the client's idempotency key to the operation and caller.
+	Key string `dynamodbav:"idempotency_key"`
+	// RequestHash detects the same key being reused for a different payload.
+	RequestHash string `dynamodbav:"request_hash"`
+	Status      string `dynamodbav:"status"`
+	Result      string `dynamodbav:"result,omitempty"`
+	// LockedUntil and TTL are unix seconds.
+	LockedUntil int64 `dynamodbav:"locked_until"`
+	TTL         int64 `dynamodbav:"ttl"`
+}
+
+var (
+	errIdempotencyKeyReused = &OperationError{
+		Code:    "IDEMPOTENCY_KEY_REUSED",
+		Message: "idempotency key was already used with a different request",
+	}
+	errIdempotencyInProgress = &OperationError{
+		Code:    "IDEMPOTENCY_IN_PROGRESS",
+		Message: "a request with this idempotency key is still in progress",
+	}
+)
+
+// idempotencyMiddleware makes operations that accept an idempotency key safe
+// to retry. The first request with a key claims it and stores its result;
+// replays of the same request get the stored result without running the
+// operation again. Failed requests release the key so they can be retried.
+// Dry runs change nothing, so they neither claim nor replay a key.
+func idempotencyMiddleware(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, inv *Invocation) (string, error) {
+		key := inv.Request.IdempotencyKey
+		if key == "" || inv.Operation.AcceptsIdempotencyKey && isDryRun(inv.Request.Payload) {
+			return next(ctx, inv)
+		}
+		if !inv.Operation.AcceptsIdempotencyKey {
+			return "", &ValidationError{Fields: []FieldError{{
+				Field:   "idempotency_key",
+				Message: fmt.Sprintf("is not supported by %s", inv.Operation.Name),
+			}}}
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return "", &ValidationError{Fields: []FieldError{{
+				Field:   "idempotency_key",
+				Message: fmt.Sprintf("must be at most %d characters", maxIdempotencyKeyLength),
+			}}}
+		}
+
+		now := time.Now().UTC()
+		record := IdempotencyRecord{
+			Key:         idempotencyScope(ctx, inv.Operation.Name, key),
+			RequestHash: hashRequestPayload(inv.Request.Payload),
+			Status:      idempotencyStatusInProgress,
+			LockedUntil: now.Add(idempotencyLockTimeout).Unix(),
+			TTL:         now.Add(idempotencyKeyLifetime).Unix(),
+		}
+
+		existing, claimed, err := idempotencyStore.ClaimIdempotencyKey(ctx, record, now)
+		if err != nil {
+			return "", fmt.Errorf("failed to claim idempotency key, %v", err)
+		}
+		if !claimed {
+			if existing.RequestHash != record.RequestHash {
+				return "", errIdempotencyKeyReused
+			}
+			if existing.Status != idempotencyStatusCompleted {
+				return "", errIdempotencyInProgress
+			}
+			return existing.Result, nil
+		}
+
+		result, err := next(ctx, inv)
+		if err != nil {
+			releaseErr := idempotencyStore.ReleaseIdempotencyKey(ctx, record.Key)
+			if releaseErr != nil {
+				log.Printf("failed to release idempotency key, operation=%s, %v", inv.Operation.Name, releaseErr)
+			}
+			return "", err
+		}
+
+		record.Status = idempotencyStatusCompleted
+		record.Result = result
+		err = idempotencyStore.CompleteIdempotencyKey(ctx, record)
+		if err != nil {
+			// The operation has already happened; report success and rely
+			// on the in-progress claim to turn away retries until it lapses.
+			log.Printf("failed to store idempotent result, operation=%s, %v", inv.Operation.Name, err)
+		}
+		return result, nil
+	}
+}
+
+// idempotencyScope keeps keys from different callers and operations apart.
+func idempotencyScope(ctx context.Context, operation string, key string) string {
+	caller := "direct"
+	if identity, ok := identityFromContext(ctx); ok {
+		caller = identity.Sub
+	}
+	return fmt.Sprintf("%s#%s#%s", operation, caller, key)
+}
+
+// hashRequestPayload hashes the payload with insignificant whitespace
+// removed, so a client re-serialising the same request still matches.
+func hashRequestPayload(payload []byte) string {
+	compacted := bytes.Buffer{}
+	if json.Compact(&compacted, payload) == nil {
+		payload = compacted.Bytes()
+	}
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
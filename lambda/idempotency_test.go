@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// invokeWithKey runs a direct request carrying an idempotency key.
+func invokeWithKey(t *testing.T, operation string, key string, payload string) (string, error) {
+	t.Helper()
+	return handler(context.Background(), Request{Operation: operation, IdempotencyKey: key, Payload: json.RawMessage(payload)})
+}
+
+func TestIdempotentRetryIsNotAppliedTwice(t *testing.T) {
+	resetStores(t)
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com"}`)
+	request := `{"user_id":"user-1","amount":{"amount":"2","currency":"USD"}}`
+
+	first, err := invokeWithKey(t, "addWallet", "top-up-1", request)
+	if err != nil {
+		t.Fatalf("addWallet failed, %v", err)
+	}
+	// Whitespace does not make it a different request
+	replay, err := invokeWithKey(t, "addWallet", "top-up-1", ` { "user_id": "user-1", "amount": {"amount":"2","currency":"USD"} } `)
+	if err != nil {
+		t.Fatalf("replay failed, %v", err)
+	}
+	if replay != first {
+		t.Errorf("replay = %q, want the stored result %q", replay, first)
+	}
+	if user := getTestUser(t, "user-1"); user.WalletAmount != newMoney(2000000, "USD") {
+		t.Errorf("wallet = %v, want a single top-up", user.WalletAmount)
+	}
+
+	_, err = invokeWithKey(t, "addWallet", "top-up-1", `{"user_id":"user-1","amount":{"amount":"3","currency":"USD"}}`)
+	if err != errIdempotencyKeyReused {
+		t.Errorf("different payload error = %v, want %v", err, errIdempotencyKeyReused)
+	}
+}
+
+func TestFailedRequestReleasesIdempotencyKey(t *testing.T) {
+	resetStores(t)
+	request := `{"user_id":"user-1","amount":{"amount":"2","currency":"USD"}}`
+
+	if _, err := invokeWithKey(t, "addWallet", "top-up-1", request); err != errUserNotFound {
+		t.Fatalf("addWallet for a missing user error = %v, want %v", err, errUserNotFound)
+	}
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com"}`)
+	if _, err := invokeWithKey(t, "addWallet", "top-up-1", request); err != nil {
+		t.Fatalf("retry after the failure was turned away, %v", err)
+	}
+	if user := getTestUser(t, "user-1"); user.WalletAmount != newMoney(2000000, "USD") {
+		t.Errorf("wallet = %v, want 2", user.WalletAmount)
+	}
+}
+
+func TestIdempotencyKeyScopedToCaller(t *testing.T) {
+	resetStores(t)
+	ctx := withIdentity(context.Background(), Identity{Sub: "user-1"})
+	other := withIdentity(context.Background(), Identity{Sub: "user-2"})
+
+	if idempotencyScope(ctx, "addWallet", "key") == idempotencyScope(other, "addWallet", "key") {
+		t.Error("two callers share an idempotency key")
+	}
+	if idempotencyScope(ctx, "addWallet", "key") == idempotencyScope(ctx, "updateWallet", "key") {
+		t.Error("two operations share an idempotency key")
+	}
+}
+
+func TestIdempotencyKeyOnUnsupportedOperation(t *testing.T) {
+	resetStores(t)
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com"}`)
+
+	_, err := invokeWithKey(t, "getUser", "key", `{"user_id":"user-1"}`)
+	if errorCode(err) != "VALIDATION_ERROR" {
+		t.Errorf("error = %v, want a ValidationError", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// RequestIdentity carries the Cognito authorizer claims that the API Gateway
+// request template copies into every request, or on API key routes the
+// user and key the API key authorizer verified. Requests invoked directly
+// against the Lambda (local runs, internal tooling) have no identity.
+type RequestIdentity struct {
+	Sub      string `json:"sub"`
+	Email    string `json:"email"`
+	Groups   string `json:"groups"`
+	Scope    string `json:"scope"`
+	ApiKeyID string `json:"api_key_id,omitempty"`
+}
+
+// Identity is the authenticated caller of the current request.
+type Identity struct {
+	Sub    string
+	Email  string
+	Groups []string
+	Scopes []string
+	// ApiKeyID is set when the caller authenticated with an API key
+	// rather than a Cognito token.
+	ApiKeyID string
+}
+
+type identityKey struct{}
+
+func withIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// identityFromContext returns the caller attached to ctx, if any.
+func identityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+func (i Identity) HasGroup(group string) bool {
+	return contains(i.Groups, group)
+}
+
+func (i Identity) HasScope(scope string) bool {
+	return contains(i.Scopes, scope)
+}
+
+// newIdentity converts the raw claims into an Identity. API Gateway renders
+// the cognito:groups claim either as "[a, b]" or "a,b" depending on the token,
+// so both forms are accepted.
+func newIdentity(claims RequestIdentity) Identity {
+	return Identity{
+		Sub:      claims.Sub,
+		Email:    claims.Email,
+		Groups:   splitClaim(strings.Trim(claims.Groups, "[]")),
+		Scopes:   splitClaim(claims.Scope),
+		ApiKeyID: claims.ApiKeyID,
+	}
+}
+
+func splitClaim(claim string) []string {
+	return strings.FieldsFunc(claim, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
+// resolveUserID returns the user a self-service operation acts on. Callers
+// with an identity may only act on their own user_id, which is also the
+// default when none is given, unless they hold the operation's OnBehalfRole.
+// Direct invocations have no identity and must name the user explicitly.
+func resolveUserID(ctx context.Context, op *Operation, requested string) (string, error) {
+	identity, ok := identityFromContext(ctx)
+	if !ok {
+		if requested == "" {
+			return "", &ValidationError{Fields: []FieldError{{Field: "user_id", Message: "is required"}}}
+		}
+		return requested, nil
+	}
+
+	if requested == "" || requested == identity.Sub {
+		return identity.Sub, nil
+	}
+	if op.OnBehalfRole != "" && hasRole(identity, op.OnBehalfRole) {
+		return requested, nil
+	}
+	return "", errForbidden("operation is limited to the caller's own user_id")
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCallerActsOnThemselves(t *testing.T) {
+	resetStores(t)
+	caller := &RequestIdentity{Sub: "user-1", Email: "one@example.com"}
+
+	// Without a user_id the caller registers and reads themselves
+	if _, err := invokeAs(t, caller, "createUser", `{}`); err != nil {
+		t.Fatalf("createUser failed, %v", err)
+	}
+	result, err := invokeAs(t, caller, "getUser", `{}`)
+	if err != nil {
+		t.Fatalf("getUser failed, %v", err)
+	}
+	user := User{}
+	if err := json.Unmarshal([]byte(result), &user); err != nil {
+		t.Fatal(err)
+	}
+	if user.UserID != "user-1" || user.Email != "one@example.com" {
+		t.Errorf("user = %+v, want the caller", user)
+	}
+
+	mustInvoke(t, "createUser", `{"user_id":"user-2","email":"two@example.com"}`)
+	if _, err := invokeAs(t, caller, "getUser", `{"user_id":"user-2"}`); errorCode(err) != "FORBIDDEN" {
+		t.Errorf("reading another user error = %v, want FORBIDDEN", err)
+	}
+}
+
+func TestCallerCannotClaimAnotherEmail(t *testing.T) {
+	resetStores(t)
+	caller := &RequestIdentity{Sub: "user-1", Email: "one@example.com"}
+
+	_, err := invokeAs(t, caller, "createUser", `{"email":"someone@example.com"}`)
+	if errorCode(err) != "FORBIDDEN" {
+		t.Errorf("error = %v, want FORBIDDEN", err)
+	}
+	_, err = invokeAs(t, caller, "createUser", `{"wallet_amount":{"amount":"100","currency":"USD"}}`)
+	if errorCode(err) != "FORBIDDEN" {
+		t.Errorf("self-granted balance error = %v, want FORBIDDEN", err)
+	}
+}
+
+func TestIdentityWithoutSubIsRejected(t *testing.T) {
+	resetStores(t)
+
+	_, err := invokeAs(t, &RequestIdentity{Email: "one@example.com"}, "getUser", `{}`)
+	if errorCode(err) != "FORBIDDEN" {
+		t.Errorf("error = %v, want FORBIDDEN", err)
+	}
+}
+
+func TestNewIdentitySplitsGroups(t *testing.T) {
+	for _, groups := range []string{"[admins, support]", "admins,support", "admins support"} {
+		identity := newIdentity(RequestIdentity{Sub: "user-1", Groups: groups})
+		if !identity.HasGroup(adminsGroup) || !identity.HasGroup(supportGroup) || len(identity.Groups) != 2 {
+			t.Errorf("groups %q parsed as %v", groups, identity.Groups)
+		}
+	}
+}
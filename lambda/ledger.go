@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// System accounts on the other side of every wallet movement. Each user's
+// wallet is the account "wallet:<user id>".
+const (
+	accountRevenue    = "revenue"
+	accountPromotions = "promotions"
+	accountRefunds    = "refunds"
+	// accountSuspense holds reconciliation differences until someone
+	// explains them.
+	accountSuspense = "suspense"
+
+	walletAccountPrefix = "wallet:"
+)
+
+// fundingAccounts are the accounts an administrator may move wallet funds
+// against with addWallet and updateWallet.
+var fundingAccounts = []string{accountPromotions, accountRefunds, accountRevenue}
+
+var systemAccounts = []string{accountRevenue, accountPromotions, accountRefunds, accountSuspense}
+
+func walletAccount(userID string) string {
+	return walletAccountPrefix + userID
+}
+
+// walletOwner returns the user id of a wallet account.
+func walletOwner(account string) (string, bool) {
+	if !strings.HasPrefix(account, walletAccountPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(account, walletAccountPrefix), true
+}
+
+// Posting is one side of a journal entry. A positive amount increases the
+// account's balance and a negative amount decreases it; the postings of an
+// entry always sum to zero.
+type Posting struct {
+	Account string `json:"account" dynamodbav:"account"`
+	Amount  Money  `json:"amount" dynamodbav:"amount"`
+}
+
+// JournalEntry is an immutable, balanced movement of money between
+// accounts. Entries are never changed once written; a mistake is undone by
+// posting its reversal.
+type JournalEntry struct {
+	EntryID     string    `json:"entry_id" dynamodbav:"entry_id"`
+	Type        string    `json:"type" dynamodbav:"type"`
+	Description string    `json:"description" dynamodbav:"description"`
+	Postings    []Posting `json:"postings" dynamodbav:"postings"`
+	// ReversalOf is the entry this one reverses.
+	ReversalOf string    `json:"reversal_of,omitempty" dynamodbav:"reversal_of,omitempty"`
+	CreatedAt  time.Time `json:"created_at" dynamodbav:"created_at"`
+}
+
+var (
+	errEntryNotFound   = errors.New("transaction not found")
+	errAlreadyReversed = &OperationError{
+		Code:    "ALREADY_REVERSED",
+		Message: "transaction has already been reversed",
+	}
+	errCurrencyMismatch = &OperationError{
+		Code:    "CURRENCY_MISMATCH",
+		Message: "amount is not in the wallet currency",
+	}
+)
+
+// validate checks that the entry balances in every currency and touches each
+// account at most once.
+func (e JournalEntry) validate() error {
+	if len(e.Postings) < 2 {
+		return fmt.Errorf("journal entry %s needs at least two postings", e.EntryID)
+	}
+
+	seen := map[string]bool{}
+	totals := map[string]int64{}
+	for _, posting := range e.Postings {
+		if _, ok := walletOwner(posting.Account); !ok && !contains(systemAccounts, posting.Account) {
+			return fmt.Errorf("journal entry %s posts to unknown account %q", e.EntryID, posting.Account)
+		}
+		if seen[posting.Account] {
+			return fmt.Errorf("journal entry %s posts to %s twice", e.EntryID, posting.Account)
+		}
+		if posting.Amount.IsZero() || posting.Amount.Currency == "" {
+			return fmt.Errorf("journal entry %s has an empty posting to %s", e.EntryID, posting.Account)
+		}
+		seen[posting.Account] = true
+		totals[posting.Amount.Currency] += posting.Amount.Micros
+	}
+	for currency, total := range totals {
+		if total != 0 {
+			return fmt.Errorf("journal entry %s does not balance in %s", e.EntryID, currency)
+		}
+	}
+	return nil
+}
+
+// walletTransactions returns the wallet history rows for the entry, one per
+// wallet it touches.
+func (e JournalEntry) walletTransactions() []Transaction {
+	transactions := []Transaction{}
+	for _, posting := range e.Postings {
+		userID, ok := walletOwner(posting.Account)
+		if !ok {
+			continue
+		}
+		transactions = append(transactions, Transaction{
+			TransactionID: e.EntryID,
+			UserID:        userID,
+			Amount:        posting.Amount,
+			Type:          e.Type,
+			Description:   e.Description,
+			Counterparty:  e.counterparty(posting.Account),
+			ReversalOf:    e.ReversalOf,
+		})
+	}
+	return transactions
+}
+
+// counterparty is the first other account in the entry.
+func (e JournalEntry) counterparty(account string) string {
+	for _, posting := range e.Postings {
+		if posting.Account != account {
+			return posting.Account
+		}
+	}
+	return ""
+}
+
+// reversal returns an entry that exactly undoes e.
+func (e JournalEntry) reversal(entryID string, now time.Time) JournalEntry {
+	postings := make([]Posting, len(e.Postings))
+	for i, posting := range e.Postings {
+		postings[i] = Posting{Account: posting.Account, Amount: posting.Amount.Neg()}
+	}
+	return JournalEntry{
+		EntryID:     entryID,
+		Type:        transactionTypeReversal,
+		Description: fmt.Sprintf("reversal of %s", e.EntryID),
+		Postings:    postings,
+		ReversalOf:  e.EntryID,
+		CreatedAt:   now,
+	}
+}
+
+// newWalletEntry builds an entry moving amount into the user's wallet from
+// counterAccount. A negative amount moves money out of the wallet.
+func newWalletEntry(userID string, amount Money, counterAccount string, entryType string, description string) (JournalEntry, error) {
+	now := time.Now().UTC()
+	entryID, err := newULID(now)
+	if err != nil {
+		return JournalEntry{}, err
+	}
+	return JournalEntry{
+		EntryID:     entryID,
+		Type:        entryType,
+		Description: description,
+		Postings: []Posting{
+			{Account: walletAccount(userID), Amount: amount},
+			{Account: counterAccount, Amount: amount.Neg()},
+		},
+		CreatedAt: now,
+	}, nil
+}
+
+// postWalletEntry moves amount between the user's wallet and counterAccount,
+// changing the balance and writing the journal entry atomically. An amount
+// without a currency is taken to be in the wallet's currency.
+func postWalletEntry(ctx context.Context, userID string, amount Money, counterAccount string, entryType string, description string) error {
+	user, err := userStore.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	amount, err = inWalletCurrency(user, "amount", amount)
+	if err != nil {
+		return err
+	}
+
+	entry, err := newWalletEntry(userID, amount, counterAccount, entryType, description)
+	if err != nil {
+		return err
+	}
+	err = entry.validate()
+	if err != nil {
+		return err
+	}
+	return ledgerStore.PostEntry(ctx, entry)
+}
+
+// recordWalletEntry journals a movement the wallet balance already reflects,
+// such as an opening balance, without changing the balance again.
+func recordWalletEntry(ctx context.Context, userID string, amount Money, counterAccount string, entryType string, description string) error {
+	entry, err := newWalletEntry(userID, amount, counterAccount, entryType, description)
+	if err != nil {
+		return err
+	}
+	err = entry.validate()
+	if err != nil {
+		return err
+	}
+	return ledgerStore.RecordEntry(ctx, entry)
+}
+
+// reversibleTypes are the entries that moved a wallet balance when posted.
+// Opening balances and reconciliation entries were only recorded, so
+// reversing them would move money that never moved.
+var reversibleTypes = []string{transactionTypeTopUp, transactionTypeAdjustment, transactionTypeUsage}
+
+// reverseTransaction posts the reversal of one of the user's transactions.
+func reverseTransaction(ctx context.Context, userID string, transactionID string) (string, error) {
+	entry, err := ledgerStore.GetEntry(ctx, transactionID)
+	if err == errEntryNotFound {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get transaction, %v", err)
+	}
+
+	// The entry must belong to the user named in the request
+	owned := false
+	for _, posting := range entry.Postings {
+		owned = owned || posting.Account == walletAccount(userID)
+	}
+	if !owned {
+		return "", errEntryNotFound
+	}
+	if !contains(reversibleTypes, entry.Type) {
+		return "", &OperationError{
+			Code:    "NOT_REVERSIBLE",
+			Message: fmt.Sprintf("%s transactions cannot be reversed", entry.Type),
+		}
+	}
+
+	now := time.Now().UTC()
+	reversalID, err := newULID(now)
+	if err != nil {
+		return "", err
+	}
+	err = ledgerStore.PostEntry(ctx, entry.reversal(reversalID, now))
+	if isCallerError(err) {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to reverse transaction, %v", err)
+	}
+
+	return "Transaction reversed successfully", nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPostWalletEntryMovesBalanceAndJournals(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com"}`)
+
+	if err := postWalletEntry(ctx, "user-1", newMoney(3000000, ""), accountPromotions, transactionTypeTopUp, "wallet top-up"); err != nil {
+		t.Fatalf("postWalletEntry failed, %v", err)
+	}
+	if user := getTestUser(t, "user-1"); user.WalletAmount != newMoney(3000000, "USD") {
+		t.Errorf("wallet = %v, want 3", user.WalletAmount)
+	}
+
+	// Debits beyond the balance and credit limit change nothing
+	err := postWalletEntry(ctx, "user-1", newMoney(-4000000, "USD"), accountRevenue, transactionTypeUsage, "api call cost")
+	if err != errInsufficientFunds {
+		t.Fatalf("overdraft error = %v, want %v", err, errInsufficientFunds)
+	}
+	if user := getTestUser(t, "user-1"); user.WalletAmount != newMoney(3000000, "USD") {
+		t.Errorf("wallet after a failed debit = %v, want 3", user.WalletAmount)
+	}
+
+	page, err := ledgerStore.ListTransactions(ctx, TransactionQuery{UserID: "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Transactions) != 1 {
+		t.Fatalf("%d transactions, want 1", len(page.Transactions))
+	}
+	entry, err := ledgerStore.GetEntry(ctx, page.Transactions[0].TransactionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entry.validate(); err != nil {
+		t.Errorf("journal entry does not balance, %v", err)
+	}
+}
+
+func TestReverseTransactionOnce(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com"}`)
+	if err := postWalletEntry(ctx, "user-1", newMoney(3000000, "USD"), accountPromotions, transactionTypeTopUp, "wallet top-up"); err != nil {
+		t.Fatal(err)
+	}
+	page, _ := ledgerStore.ListTransactions(ctx, TransactionQuery{UserID: "user-1"})
+	topUp := page.Transactions[0].TransactionID
+
+	if _, err := reverseTransaction(ctx, "user-2", topUp); err != errEntryNotFound {
+		t.Errorf("reversing another user's transaction error = %v, want %v", err, errEntryNotFound)
+	}
+	if _, err := reverseTransaction(ctx, "user-1", topUp); err != nil {
+		t.Fatalf("reverseTransaction failed, %v", err)
+	}
+	if _, err := reverseTransaction(ctx, "user-1", topUp); err != errAlreadyReversed {
+		t.Errorf("second reversal error = %v, want %v", err, errAlreadyReversed)
+	}
+	if user := getTestUser(t, "user-1"); !user.WalletAmount.IsZero() {
+		t.Errorf("wallet = %v, want 0", user.WalletAmount)
+	}
+}
+
+func TestMemoryStorePostEntryRejectsOtherCurrency(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com"}`)
+
+	entry, err := newWalletEntry("user-1", newMoney(1000000, "EUR"), accountPromotions, transactionTypeTopUp, "wallet top-up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ledgerStore.PostEntry(ctx, entry); err != errCurrencyMismatch {
+		t.Fatalf("error = %v, want %v", err, errCurrencyMismatch)
+	}
+	if user := getTestUser(t, "user-1"); !user.WalletAmount.IsZero() {
+		t.Errorf("wallet = %v, want 0", user.WalletAmount)
+	}
+	if _, err := ledgerStore.GetEntry(ctx, entry.EntryID); err != errEntryNotFound {
+		t.Errorf("the rejected entry was journaled")
+	}
+}
+
+func TestMemoryStoreTransactionsKeyedOnUser(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+
+	// A transfer between two wallets has one history row per wallet under
+	// the same transaction id
+	for _, userID := range []string{"user-1", "user-2"} {
+		err := ledgerStore.CreateTransaction(ctx, Transaction{TransactionID: "01TRANSFER", UserID: userID, Amount: newMoney(1, "USD"), Type: transactionTypeManual, Description: userID})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A row once written is never replaced
+	err := ledgerStore.CreateTransaction(ctx, Transaction{TransactionID: "01TRANSFER", UserID: "user-1", Amount: newMoney(2, "USD"), Type: transactionTypeManual, Description: "updated"})
+	if err != errTransactionExists {
+		t.Fatalf("error = %v, want %v", err, errTransactionExists)
+	}
+
+	for userID, want := range map[string]string{"user-1": "user-1", "user-2": "user-2"} {
+		page, err := ledgerStore.ListTransactions(ctx, TransactionQuery{UserID: userID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Transactions) != 1 || page.Transactions[0].Description != want {
+			t.Errorf("%s transactions = %+v, want one described %q", userID, page.Transactions, want)
+		}
+	}
+}
+
+func TestCallAPIRefusesUncoveredCalls(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	if err := planStore.PutPlan(ctx, Plan{PlanID: planFree, Name: "Free", MonthlyCallQuota: 1000, IncludedCredit: newMoney(0, "")}); err != nil {
+		t.Fatal(err)
+	}
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com"}`)
+	generated, err := issueApiKey(ctx, "user-1", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := callAPI(ctx, generated.ApiKey, false); err != errInsufficientFunds {
+		t.Fatalf("error = %v, want %v", err, errInsufficientFunds)
+	}
+	if usage := currentUsage(t); usage.Calls != 0 {
+		t.Errorf("calls = %d, the refused call used up quota", usage.Calls)
+	}
+	if user := getTestUser(t, "user-1"); !user.WalletAmount.IsZero() {
+		t.Errorf("wallet = %v, want it untouched", user.WalletAmount)
+	}
+}
+
+func TestPostWalletEntryWithMismatchedCreditLimit(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com","wallet_amount":{"amount":"5","currency":"USD"}}`)
+	// A stored row no validation would have written
+	if err := userStore.SetCreditLimit(ctx, "user-1", newMoney(1000000, "EUR")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := postWalletEntry(ctx, "user-1", newMoney(-1000000, "USD"), accountRevenue, transactionTypeUsage, "api call cost")
+	if err != errCurrencyMismatch {
+		t.Errorf("error = %v, want %v", err, errCurrencyMismatch)
+	}
+	if status := getTestUser(t, "user-1").accountStatus(); status != accountStatusInsufficientFunds {
+		t.Errorf("account status = %q, want it not chargeable", status)
+	}
+}
+
+func TestMemoryStorePostEntryIsAllOrNothing(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com","wallet_amount":{"amount":"5","currency":"USD"}}`)
+	mustInvoke(t, "createUser", `{"user_id":"user-2","email":"two@example.com"}`)
+	transfer := func(from string, to string) JournalEntry {
+		entryID, err := newULID(time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return JournalEntry{
+			EntryID: entryID,
+			Type:    transactionTypeAdjustment,
+			Postings: []Posting{
+				{Account: walletAccount(to), Amount: newMoney(3000000, "USD")},
+				{Account: walletAccount(from), Amount: newMoney(-3000000, "USD")},
+			},
+		}
+	}
+	transactions := func(userID string) int {
+		page, err := ledgerStore.ListTransactions(ctx, TransactionQuery{UserID: userID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(page.Transactions)
+	}
+
+	// The credit to user-1 would apply, but user-2 cannot cover the debit
+	failed := transfer("user-2", "user-1")
+	if err := ledgerStore.PostEntry(ctx, failed); err != errInsufficientFunds {
+		t.Fatalf("error = %v, want %v", err, errInsufficientFunds)
+	}
+	if user := getTestUser(t, "user-1"); user.WalletAmount != newMoney(5000000, "USD") {
+		t.Errorf("user-1 wallet = %v, want 5", user.WalletAmount)
+	}
+	if _, err := ledgerStore.GetEntry(ctx, failed.EntryID); err != errEntryNotFound {
+		t.Errorf("the rejected entry was journaled")
+	}
+	if transactions("user-1") != 1 || transactions("user-2") != 0 {
+		t.Errorf("history rows were written for the rejected entry")
+	}
+
+	posted := transfer("user-1", "user-2")
+	if err := ledgerStore.PostEntry(ctx, posted); err != nil {
+		t.Fatal(err)
+	}
+	if user := getTestUser(t, "user-1"); user.WalletAmount != newMoney(2000000, "USD") {
+		t.Errorf("user-1 wallet = %v, want 2", user.WalletAmount)
+	}
+	if user := getTestUser(t, "user-2"); user.WalletAmount != newMoney(3000000, "USD") {
+		t.Errorf("user-2 wallet = %v, want 3", user.WalletAmount)
+	}
+	if _, err := ledgerStore.GetEntry(ctx, posted.EntryID); err != nil {
+		t.Errorf("the posted entry was not journaled, %v", err)
+	}
+	if transactions("user-1") != 2 || transactions("user-2") != 1 {
+		t.Errorf("history rows missing for the posted entry")
+	}
+}
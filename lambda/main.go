@@ -2,139 +2,211 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	math_rand "math/rand"
+	"os"
 	"strconv"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cognitoidentityprovider"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
 )
 
 type Request struct {
-	Operation string      `json:"operation"`
-	Payload   interface{} `json:"payload"`
+	Operation string           `json:"operation"`
+	Payload   json.RawMessage  `json:"payload"`
+	Identity  *RequestIdentity `json:"identity,omitempty"`
+	// IdempotencyKey lets a client retry a money-moving request without it
+	// being applied twice.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
 }
 
 type User struct {
-	UserID       string  `json:"user_id"`
-	Email        string  `json:"email"`
-	WalletAmount float64 `json:"wallet_amount"`
+	UserID       string `json:"user_id"`
+	Email        string `json:"email"`
+	WalletAmount Money  `json:"wallet_amount"`
+	// CreditLimit is how far below zero the wallet may be debited.
+	CreditLimit Money `json:"credit_limit"`
+	// Plan is the user's subscription plan, the default plan when empty.
+	Plan string `json:"plan,omitempty"`
+	// OrgID is the organisation the user belongs to, if any.
+	OrgID string `json:"org_id,omitempty"`
+	// Status is set to accountStatusDeleting once deleteAccount has
+	// started on the user.
+	Status string `json:"status,omitempty"`
 }
 
+// available is the most that can currently be debited from the wallet. It
+// fails if the credit limit is stored in another currency.
+func (u User) available() (Money, error) {
+	return u.WalletAmount.Add(u.CreditLimit)
+}
+
+// ApiKey is the stored form of an API key. The secret itself is never kept;
+// the key id (the public prefix of the key) is the table's api_key partition
+// key and only a salted hash of the secret is stored. TTL mirrors ExpiresAt,
+// or the revocation time, so DynamoDB removes dead keys on its own.
 type ApiKey struct {
-	UserID string `json:"user_id"`
+	KeyID      string     `json:"key_id" dynamodbav:"api_key"`
+	UserID     string     `json:"user_id" dynamodbav:"user_id"`
+	Label      string     `json:"label,omitempty" dynamodbav:"label,omitempty"`
+	Status     string     `json:"status" dynamodbav:"status"`
+	Salt       string     `json:"-" dynamodbav:"salt"`
+	Hash       string     `json:"-" dynamodbav:"hash"`
+	CreatedAt  time.Time  `json:"created_at" dynamodbav:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" dynamodbav:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty" dynamodbav:"expires_at,omitempty"`
+	ReplacedBy string     `json:"replaced_by,omitempty" dynamodbav:"replaced_by,omitempty"`
+	TTL        int64      `json:"-" dynamodbav:"ttl,omitempty"`
+}
+
+// GeneratedApiKey is returned once, when a key is created. It is the only
+// time the full key is available.
+type GeneratedApiKey struct {
+	KeyID  string `json:"key_id"`
 	ApiKey string `json:"api_key"`
 }
 
 type Transaction struct {
-	TransactionID string  `json:"transaction_id"`
-	UserID        string  `json:"user_id"`
-	Amount        float64 `json:"amount"`
-	Description   string  `json:"description"`
+	TransactionID string `json:"transaction_id"`
+	UserID        string `json:"user_id"`
+	Amount        Money  `json:"amount"`
+	Type          string `json:"type"`
+	Description   string `json:"description"`
+	// Counterparty is the account on the other side of the journal entry.
+	Counterparty string `json:"counterparty,omitempty" dynamodbav:"counterparty,omitempty"`
+	ReversalOf   string `json:"reversal_of,omitempty" dynamodbav:"reversal_of,omitempty"`
+	// LegacyTransactionID is the millisecond id a migrated transaction had
+	// in the original transactions table.
+	LegacyTransactionID string `json:"legacy_transaction_id,omitempty" dynamodbav:"legacy_transaction_id,omitempty"`
 }
 
-var svc *dynamodb.DynamoDB
+// configureStores connects the stores to DynamoDB, S3 and Cognito, or keeps
+// everything in memory when STORE_BACKEND is "memory".
+func configureStores() {
+	if os.Getenv("STORE_BACKEND") == "memory" {
+		useMemoryStores()
+		return
+	}
 
-func init() {
 	sess, err := session.NewSession(&aws.Config{
 		Region: aws.String("us-east-1"),
 	})
 	if err != nil {
 		log.Fatalf("unable to create AWS session, %v", err)
 	}
-	svc = dynamodb.New(sess)
+	store := newDynamoStore(dynamodb.New(sess))
+	userStore, apiKeyStore, ledgerStore, idempotencyStore = store, store, store, store
+	rateLimitStore, planStore, usageStore, priceStore = store, store, store, store
+	pricingEngine = newTablePricingEngine(priceStore)
+
+	// Exports are written to the stack's bucket, and users are managed in
+	// the stack's user pool, both in the function's own region.
+	regionConfig := &aws.Config{}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		regionConfig.Region = aws.String(region)
+	}
+	objectStore = newS3ObjectStore(s3.New(sess, regionConfig), os.Getenv("EXPORT_BUCKET_NAME"))
+	userDirectory = newCognitoUserDirectory(cognitoidentityprovider.New(sess, regionConfig), os.Getenv("USER_POOL_ID"))
+
+	apiKeyPepper, err = loadApiKeyPepper(sess)
+	if err != nil {
+		log.Fatalf("unable to load API key pepper, %v", err)
+	}
 }
 
-func handler(ctx context.Context, request Request) (string, error) {
-	switch request.Operation {
-	case "createUser":
-		user := request.Payload.(map[string]interface{})
-		return createUser(user)
-	case "getUser":
-		userID := request.Payload.(string)
-		return getUser(userID)
-	//Admin Only
-	case "updateWallet":
-		payload := request.Payload.(map[string]interface{})
-		return updateWallet(payload["user_id"].(string), payload["amount"].(float64))
-	case "addWallet":
-		payload := request.Payload.(map[string]interface{})
-		return addWallet(payload["user_id"].(string), payload["amount"].(float64))
-	// Used by the front end application to display api keys
-	case "getApiKeyFromUser":
-		userID := request.Payload.(string)
-		return getApiKeyFromUser(userID)
-	// Use by the service that the API key is used for
-	case "getUserFromApiKey":
-		apiKey := request.Payload.(string)
-		return getUserFromApiKey(apiKey)
-	case "generateApiKey":
-		userID := request.Payload.(string)
-		return generateApiKey(userID)
-	case "logTransaction":
-		transaction := request.Payload.(map[string]interface{})
-		return logTransaction(transaction)
-	case "getTransactionHistory":
-		userID := request.Payload.(string)
-		return getTransactionHistory(userID)
-	case "callAPI":
-		apiKey := request.Payload.(string)
-		return callAPI(apiKey)
-	default:
-		return "", fmt.Errorf("invalid operation")
+// useMemoryStores replaces every store with a fresh in-memory one, for local
+// development and unit tests.
+func useMemoryStores() {
+	store := newMemoryStore()
+	userStore, apiKeyStore, ledgerStore, idempotencyStore = store, store, store, store
+	rateLimitStore, planStore, usageStore, priceStore = store, store, store, store
+	pricingEngine = newTablePricingEngine(priceStore)
+	objectStore = newMemoryObjectStore()
+	userDirectory = memoryUserDirectory{}
+	apiKeyPepper = []byte(os.Getenv("API_KEY_PEPPER"))
+	if len(apiKeyPepper) == 0 {
+		apiKeyPepper = []byte("local-development-pepper")
 	}
 }
 
-func createUser(user map[string]interface{}) (string, error) {
-	userItem, err := dynamodbattribute.MarshalMap(user)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal user, %v", err)
+// loadApiKeyPepper reads the pepper from API_KEY_PEPPER, or from the Secrets
+// Manager secret named by API_KEY_PEPPER_SECRET_ARN.
+func loadApiKeyPepper(sess *session.Session) ([]byte, error) {
+	if pepper := os.Getenv("API_KEY_PEPPER"); pepper != "" {
+		return []byte(pepper), nil
 	}
 
-	input := &dynamodb.PutItemInput{
-		TableName: aws.String("users"),
-		Item:      userItem,
+	secretArn := os.Getenv("API_KEY_PEPPER_SECRET_ARN")
+	if secretArn == "" {
+		return nil, fmt.Errorf("neither API_KEY_PEPPER nor API_KEY_PEPPER_SECRET_ARN is set")
 	}
 
-	_, err = svc.PutItem(input)
+	result, err := secretsmanager.New(sess).GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretArn),
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to create user, %v", err)
+		return nil, err
 	}
+	return []byte(aws.StringValue(result.SecretString)), nil
+}
 
-	return "User created successfully", nil
+func handler(ctx context.Context, request Request) (string, error) {
+	return registry.Dispatch(ctx, request)
 }
 
-func getUser(userID string) (string, error) {
-	input := &dynamodb.GetItemInput{
-		TableName: aws.String("users"),
-		Key: map[string]*dynamodb.AttributeValue{
-			"user_id": {
-				S: aws.String(userID),
-			},
-		},
+// createUser creates the user with their opening balance. Repeating a
+// request that created the user succeeds without changing anything, so it can
+// be retried; a different request for an existing user_id fails with
+// errUserExists.
+func createUser(ctx context.Context, user User) (string, error) {
+	err := userStore.CreateUser(ctx, user)
+	if err == errUserExists {
+		existing, getErr := userStore.GetUser(ctx, user.UserID)
+		if getErr != nil {
+			return "", err
+		}
+		if existing.Status == accountStatusDeleting {
+			return "", errAccountDeleting
+		}
+		// The wallet moves once the user exists, so only its currency has
+		// to match
+		if existing.Email != user.Email || existing.WalletAmount.Currency != user.WalletAmount.Currency {
+			return "", err
+		}
+		return "User created successfully", nil
 	}
-
-	result, err := svc.GetItem(input)
 	if err != nil {
-		return "", fmt.Errorf("failed to get user, %v", err)
+		return "", fmt.Errorf("failed to create user, %v", err)
 	}
 
-	if result.Item == nil {
-		return "", fmt.Errorf("user not found")
+	// Record a starting balance in the ledger so reconciliation can account
+	// for it. The user already exists at this point, so a failure is left
+	// for reconciliation to report rather than failing the request.
+	if !user.WalletAmount.IsZero() {
+		err = recordWalletEntry(ctx, user.UserID, user.WalletAmount, accountPromotions, transactionTypeOpeningBalance, "opening balance")
+		if err != nil {
+			log.Printf("failed to record opening balance, user_id=%s, %v", user.UserID, err)
+		}
 	}
 
-	user := User{}
-	err = dynamodbattribute.UnmarshalMap(result.Item, &user)
+	return "User created successfully", nil
+}
+
+func getUser(ctx context.Context, userID string) (string, error) {
+	user, err := userStore.GetUser(ctx, userID)
+	if err == errUserNotFound {
+		return "", err
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to unmarshal user, %v", err)
+		return "", fmt.Errorf("failed to get user, %v", err)
 	}
 
 	userJson, err := json.Marshal(user)
@@ -145,95 +217,54 @@ func getUser(userID string) (string, error) {
 	return string(userJson), nil
 }
 
-func getApiKeyFromUser(userID string) (string, error) {
-
-	indexName := "user_id-index" // Make sure this is the correct index name
-
-	input := &dynamodb.QueryInput{
-		TableName: aws.String("api_keys"),
-		IndexName: aws.String(indexName),
-		KeyConditions: map[string]*dynamodb.Condition{
-			"user_id": {
-				ComparisonOperator: aws.String("EQ"),
-				AttributeValueList: []*dynamodb.AttributeValue{
-					{
-						S: aws.String(userID),
-					},
-				},
-			},
-		},
-	}
-
-	result, err := svc.Query(input)
+func getApiKeyFromUser(ctx context.Context, userID string) (string, error) {
+	apiKeys, err := apiKeyStore.ListApiKeys(ctx, userID)
 	if err != nil {
 		return "", fmt.Errorf("failed to get API key, %v", err)
 	}
 
-	apiKeys := []ApiKey{}
-	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &apiKeys)
-	if err != nil {
-		return "", fmt.Errorf("API key not found")
-	}
-
-	apiKeyJson, err := json.Marshal(apiKeys[0])
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal API key JSON, %v", err)
+	// Show the newest key that can still be used
+	sortApiKeysNewestFirst(apiKeys)
+	now := time.Now()
+	for _, apiKey := range apiKeys {
+		if apiKey.usable(now) {
+			apiKeyJson, err := json.Marshal(apiKey)
+			if err != nil {
+				return "", fmt.Errorf("failed to marshal API key JSON, %v", err)
+			}
+			return string(apiKeyJson), nil
+		}
 	}
 
-	return string(apiKeyJson), nil
+	return "", errApiKeyNotFound
 }
 
-func getUserFromApiKey(apiKey string) (string, error) {
-	input := &dynamodb.GetItemInput{
-		TableName: aws.String("api_keys"),
-		Key: map[string]*dynamodb.AttributeValue{
-			"api_key": {
-				S: aws.String(apiKey),
-			},
-		},
+func getUserFromApiKey(ctx context.Context, apiKey string) (string, error) {
+	apiKeyData, err := verifyApiKey(ctx, apiKey)
+	if isApiKeyRejected(err) {
+		return "", err
 	}
-
-	result, err := svc.GetItem(input)
 	if err != nil {
 		return "", fmt.Errorf("failed to get API key, %v", err)
 	}
 
-	if result.Item == nil {
-		return "", fmt.Errorf("API key not found")
-	}
-
-	apiKeyData := ApiKey{}
-	err = dynamodbattribute.UnmarshalMap(result.Item, &apiKeyData)
-	if err != nil {
-		return "", fmt.Errorf("failed to unmarshal API key, %v", err)
-	}
-
 	return apiKeyData.UserID, nil
 }
 
-func addWallet(userID string, amount float64) (string, error) {
+func addWallet(ctx context.Context, userID string, amount Money, fundingAccount string, dryRun bool) (string, error) {
 
-	if amount <= 0 {
+	if amount.IsNegative() || amount.IsZero() {
 		return "", fmt.Errorf("invalid wallet amount")
 	}
 
-	input := &dynamodb.UpdateItemInput{
-		TableName: aws.String("users"),
-		Key: map[string]*dynamodb.AttributeValue{
-			"user_id": {
-				S: aws.String(userID),
-			},
-		},
-		UpdateExpression: aws.String("SET wallet_amount = wallet_amount + :amount"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":amount": {
-				N: aws.String(fmt.Sprintf("%f", amount)),
-			},
-		},
-		ReturnValues: aws.String("UPDATED_NEW"),
+	if dryRun {
+		return quoteWalletEntry(ctx, "addWallet", userID, amount)
 	}
 
-	_, err := svc.UpdateItem(input)
+	err := postWalletEntry(ctx, userID, amount, fundingAccount, transactionTypeTopUp, "wallet top-up")
+	if isCallerError(err) {
+		return "", err
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to update wallet amount, %v", err)
 	}
@@ -241,24 +272,15 @@ func addWallet(userID string, amount float64) (string, error) {
 	return "Wallet amount updated successfully", nil
 }
 
-func updateWallet(userID string, amount float64) (string, error) {
-	input := &dynamodb.UpdateItemInput{
-		TableName: aws.String("users"),
-		Key: map[string]*dynamodb.AttributeValue{
-			"user_id": {
-				S: aws.String(userID),
-			},
-		},
-		UpdateExpression: aws.String("SET wallet_amount = wallet_amount + :amount"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":amount": {
-				N: aws.String(fmt.Sprintf("%f", amount)),
-			},
-		},
-		ReturnValues: aws.String("UPDATED_NEW"),
-	}
-
-	_, err := svc.UpdateItem(input)
+func updateWallet(ctx context.Context, userID string, amount Money, fundingAccount string, dryRun bool) (string, error) {
+	if dryRun {
+		return quoteWalletEntry(ctx, "updateWallet", userID, amount)
+	}
+
+	err := postWalletEntry(ctx, userID, amount, fundingAccount, transactionTypeAdjustment, "wallet adjustment")
+	if isCallerError(err) {
+		return "", err
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to update wallet amount, %v", err)
 	}
@@ -266,58 +288,87 @@ func updateWallet(userID string, amount float64) (string, error) {
 	return "Wallet amount updated successfully", nil
 }
 
-func generateApiKey(userID string) (string, error) {
-
-	keyHolder := make([]byte, 32) // 32 bytes will be 256 bits
+func setCreditLimit(ctx context.Context, userID string, creditLimit Money) (string, error) {
+	user, err := userStore.GetUser(ctx, userID)
+	if err == errUserNotFound {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get user, %v", err)
+	}
 
-	// Read random bytes into the byte slice
-	_, err := rand.Read(keyHolder)
+	creditLimit, err = inWalletCurrency(user, "credit_limit", creditLimit)
 	if err != nil {
 		return "", err
 	}
 
-	apiKey := base64.StdEncoding.EncodeToString(keyHolder)
-	keyItem := ApiKey{
-		UserID: userID,
-		ApiKey: apiKey,
+	err = userStore.SetCreditLimit(ctx, userID, creditLimit)
+	if err == errUserNotFound {
+		return "", err
 	}
-
-	keyItemMap, err := dynamodbattribute.MarshalMap(keyItem)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal API key, %v", err)
+		return "", fmt.Errorf("failed to set credit limit, %v", err)
 	}
 
-	input := &dynamodb.PutItemInput{
-		TableName: aws.String("api_keys"),
-		Item:      keyItemMap,
+	return "Credit limit updated successfully", nil
+}
+
+func generateApiKey(ctx context.Context, userID string, label string, expiresAt *time.Time) (string, error) {
+	generated, err := issueApiKey(ctx, userID, label, expiresAt)
+	if err != nil {
+		return "", err
 	}
 
-	_, err = svc.PutItem(input)
+	generatedJson, err := json.Marshal(generated)
 	if err != nil {
-		return "", fmt.Errorf("failed to store API key, %v", err)
+		return "", fmt.Errorf("failed to marshal API key JSON, %v", err)
 	}
 
-	return apiKey, nil
+	return string(generatedJson), nil
 }
 
-func logTransaction(transaction map[string]interface{}) (string, error) {
+// newTransactionID returns a ULID, so ids never collide and sort in the
+// order the transactions were made.
+func newTransactionID() (string, error) {
+	return newULID(time.Now())
+}
 
-	transactionID := time.Now().UnixNano() / int64(time.Millisecond) // Milliseconds since epoch
+// inWalletCurrency fills in a missing currency from the user's wallet and
+// rejects amounts in any other currency.
+func inWalletCurrency(user User, field string, amount Money) (Money, error) {
+	if amount.Currency == "" {
+		amount.Currency = user.WalletAmount.Currency
+	}
+	if amount.Currency != user.WalletAmount.Currency {
+		return Money{}, &ValidationError{Fields: []FieldError{{
+			Field:   field,
+			Message: fmt.Sprintf("currency must match the wallet currency %s", user.WalletAmount.Currency),
+		}}}
+	}
+	return amount, nil
+}
 
-	// Add transaction ID to the transaction map
-	transaction["transaction_id"] = transactionID
+func logTransaction(ctx context.Context, transaction Transaction) (string, error) {
 
-	transactionItem, err := dynamodbattribute.MarshalMap(transaction)
+	user, err := userStore.GetUser(ctx, transaction.UserID)
+	if err == errUserNotFound {
+		return "", err
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal transaction, %v", err)
+		return "", fmt.Errorf("failed to get user, %v", err)
 	}
 
-	input := &dynamodb.PutItemInput{
-		TableName: aws.String("transactions"),
-		Item:      transactionItem,
+	transaction.Amount, err = inWalletCurrency(user, "amount", transaction.Amount)
+	if err != nil {
+		return "", err
+	}
+
+	transaction.TransactionID, err = newTransactionID()
+	if err != nil {
+		return "", err
 	}
 
-	_, err = svc.PutItem(input)
+	err = ledgerStore.CreateTransaction(ctx, transaction)
 	if err != nil {
 		return "", fmt.Errorf("failed to log transaction, %v", err)
 	}
@@ -325,80 +376,151 @@ func logTransaction(transaction map[string]interface{}) (string, error) {
 	return "Transaction logged successfully", nil
 }
 
-func getTransactionHistory(userID string) (string, error) {
+// maxCallDuration is the longest a single callAPI invocation runs.
+const maxCallDuration = time.Second
 
-	indexName := "user_id-index" // Make sure this is the correct index name
+// callAPI runs a metered call for the owner of the caller's API key. A dry
+// run stops once the call has been authorised and priced, returning its
+// quote.
+func callAPI(ctx context.Context, apiKey string, dryRun bool) (string, error) {
 
-	input := &dynamodb.QueryInput{
-		TableName: aws.String("transactions"),
-		IndexName: aws.String(indexName),
-		KeyConditions: map[string]*dynamodb.Condition{
-			"user_id": {
-				ComparisonOperator: aws.String("EQ"),
-				AttributeValueList: []*dynamodb.AttributeValue{
-					{
-						S: aws.String(userID),
-					},
-				},
-			},
-		},
+	key, err := callerApiKey(ctx, apiKey, dryRun)
+	if isCallerError(err) {
+		return "", err
 	}
-
-	result, err := svc.Query(input)
 	if err != nil {
-		return "", fmt.Errorf("failed to query transaction history, %v", err)
+		return "", fmt.Errorf("failed to get API key, %v", err)
 	}
+	userID := key.UserID
 
-	transactions := []Transaction{}
-	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &transactions)
+	user, err := userStore.GetUser(ctx, userID)
 	if err != nil {
-		return "", fmt.Errorf("failed to unmarshal transactions, %v", err)
+		return "", fmt.Errorf("failed to get user, %v", err)
 	}
-
-	transactionsJson, err := json.Marshal(transactions)
+	if user.Status == accountStatusDeleting {
+		return "", errAccountDeleting
+	}
+	plan, err := getPlan(ctx, user.planID())
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal transactions JSON, %v", err)
+		return "", fmt.Errorf("failed to get plan, %v", err)
 	}
 
-	return string(transactionsJson), nil
-}
+	// Price the largest possible charge, and refuse the work up front if
+	// the wallet cannot cover it
+	now := time.Now()
+	maxQuote, err := quoteCall(ctx, user, plan, maxCallDuration, now)
+	if err != nil {
+		return "", err
+	}
+	if dryRun {
+		return marshalQuote(maxQuote)
+	}
+	if !maxQuote.Covered {
+		return "", errInsufficientFunds
+	}
 
-func callAPI(apiKey string) (string, error) {
+	// Limit each key separately, so a leaked key cannot starve the
+	// owner's other keys
+	err = checkRateLimit(ctx, apiKeyRateLimitKey(key.KeyID), rateLimitFor(plan.PlanID))
+	if err != nil {
+		return "", err
+	}
 
-	userID, err := getUserFromApiKey(apiKey)
+	overage, err := countCall(ctx, userID, plan, now)
 	if err != nil {
-		return "", fmt.Errorf("failed to get user, %v", err)
+		return "", err
 	}
 
-	// Generate a random number between 0 and 1
-	randomDuration := float64(math_rand.Intn(1000)) / 1000.0
+	// The call holds its place in the quota from here. Unless it is
+	// charged, the place and any cost metered for it are given back.
+	metered := Money{}
+	charged := false
+	defer func() {
+		if !charged {
+			releaseCall(ctx, userID, now, metered)
+		}
+	}()
 
-	// Convert the random duration to milliseconds and sleep for that duration
-	sleepDuration := time.Duration(randomDuration * float64(time.Second))
-	time.Sleep(sleepDuration)
+	// Generate a random duration between 0 and 999 milliseconds
+	durationMs := int64(math_rand.Intn(1000))
 
-	_, err_update := updateWallet(userID, -1*randomDuration)
+	// Sleep for that duration
+	sleepDuration := time.Duration(durationMs) * time.Millisecond
+	time.Sleep(sleepDuration)
 
-	if err_update != nil {
-		return "", fmt.Errorf("failed to updated wallet, %v", err_update)
+	// Charge for the measured duration, debiting the wallet and recording
+	// the charge together. Usage within the plan's included credit is
+	// free, and calls beyond the quota add the overage price.
+	call := MeteredCall{
+		Operation: "callAPI",
+		Plan:      plan.PlanID,
+		Currency:  user.WalletAmount.Currency,
+		Duration:  time.Since(now),
+		At:        now,
+	}
+	if call.Duration > maxCallDuration {
+		call.Duration = maxCallDuration
+	}
+	price, err := pricingEngine.Price(ctx, call)
+	if isCallerError(err) {
+		return "", err
 	}
-
-	data := make(map[string]interface{})
-	description := "api call cost"
-	data["user_id"] = userID
-	data["amount"] = -1 * randomDuration
-	data["description"] = description
-
-	_, err_transaction := logTransaction(data)
-
-	if err_transaction != nil {
-		return "", fmt.Errorf("failed to log transaction, %v", err_transaction)
+	if err != nil {
+		return "", fmt.Errorf("failed to price call, %v", err)
 	}
-	// Return the sleep duration in milliseconds as a string
-
-	return strconv.FormatFloat(randomDuration*1000, 'f', -1, 64) + " ms", nil
+	cost, err := chargeableCost(ctx, user, plan, price.Total, now)
+	if err != nil {
+		return "", err
+	}
+	metered, err = inCurrency(price.Total, user.WalletAmount.Currency)
+	if err != nil {
+		return "", err
+	}
+	if overage {
+		overagePrice, err := inCurrency(plan.OveragePrice, cost.Currency)
+		if err != nil {
+			return "", err
+		}
+		cost, err = cost.Add(overagePrice)
+		if err != nil {
+			return "", fmt.Errorf("failed to add overage price, %v", err)
+		}
+	}
+	if !cost.IsZero() {
+		err = postWalletEntry(ctx, userID, cost.Neg(), accountRevenue, transactionTypeUsage, "api call cost")
+		if isCallerError(err) {
+			return "", err
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to charge wallet, %v", err)
+		}
+	}
+	charged = true
+
+	// Return the measured duration in milliseconds as a string
+
+	return strconv.FormatInt(call.Duration.Milliseconds(), 10) + " ms", nil
 }
 
 func main() {
-	lambda.Start(handler)
+	configureStores()
+
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
+	// The same image backs every function in the stack; LAMBDA_HANDLER
+	// picks the entry point.
+	switch os.Getenv("LAMBDA_HANDLER") {
+	case "reconcile":
+		lambda.Start(reconcileHandler)
+	case "postConfirmation":
+		lambda.Start(postConfirmationHandler)
+	case "preTokenGeneration":
+		lambda.Start(preTokenGenerationHandler)
+	case "authorizer":
+		lambda.Start(authorizerHandler)
+	default:
+		lambda.Start(handler)
+	}
 }
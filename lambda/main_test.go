@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	metricsOutput = io.Discard
+	useMemoryStores()
+	os.Exit(m.Run())
+}
+
+// resetStores gives the test empty in-memory stores and empty caches.
+func resetStores(t *testing.T) {
+	t.Helper()
+	useMemoryStores()
+	planCache.plans = map[string]cachedPlan{}
+	authorizerCache.authorizations = map[string]cachedAuthorization{}
+	tokenClaimsCache.claims = map[string]cachedTokenClaims{}
+}
+
+// invoke runs a request through the handler as a direct invocation, with no
+// caller identity.
+func invoke(t *testing.T, operation string, payload string) (string, error) {
+	t.Helper()
+	return invokeAs(t, nil, operation, payload)
+}
+
+// invokeAs runs a request through the handler as the given caller.
+func invokeAs(t *testing.T, identity *RequestIdentity, operation string, payload string) (string, error) {
+	t.Helper()
+	request := Request{Operation: operation, Identity: identity}
+	if payload != "" {
+		request.Payload = json.RawMessage(payload)
+	}
+	return handler(context.Background(), request)
+}
+
+// mustInvoke fails the test if the request fails.
+func mustInvoke(t *testing.T, operation string, payload string) string {
+	t.Helper()
+	result, err := invoke(t, operation, payload)
+	if err != nil {
+		t.Fatalf("%s failed, %v", operation, err)
+	}
+	return result
+}
+
+// errorCode returns the code of an OperationError, or VALIDATION_ERROR.
+func errorCode(err error) string {
+	var operationErr *OperationError
+	if errors.As(err, &operationErr) {
+		return operationErr.Code
+	}
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		return "VALIDATION_ERROR"
+	}
+	return ""
+}
+
+func getTestUser(t *testing.T, userID string) User {
+	t.Helper()
+	user, err := userStore.GetUser(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("failed to get user %s, %v", userID, err)
+	}
+	return user
+}
+
+func TestCreateAndGetUser(t *testing.T) {
+	resetStores(t)
+
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com","wallet_amount":{"amount":"12.50","currency":"USD"}}`)
+
+	result := mustInvoke(t, "getUser", `{"user_id":"user-1"}`)
+	user := User{}
+	if err := json.Unmarshal([]byte(result), &user); err != nil {
+		t.Fatalf("getUser returned invalid JSON %q, %v", result, err)
+	}
+	if user.Email != "one@example.com" {
+		t.Errorf("email = %q, want one@example.com", user.Email)
+	}
+	if want := newMoney(12500000, "USD"); user.WalletAmount != want {
+		t.Errorf("wallet = %v, want %v", user.WalletAmount, want)
+	}
+}
+
+func TestCreateUserTwiceFails(t *testing.T) {
+	resetStores(t)
+
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com"}`)
+	_, err := invoke(t, "createUser", `{"user_id":"user-1","email":"other@example.com"}`)
+	if err != errUserExists {
+		t.Fatalf("second createUser error = %v, want %v", err, errUserExists)
+	}
+	if user := getTestUser(t, "user-1"); user.Email != "one@example.com" {
+		t.Errorf("email = %q, the existing user was overwritten", user.Email)
+	}
+}
+
+func TestGetUnknownUser(t *testing.T) {
+	resetStores(t)
+
+	_, err := invoke(t, "getUser", `{"user_id":"nobody"}`)
+	if err != errUserNotFound {
+		t.Fatalf("error = %v, want %v", err, errUserNotFound)
+	}
+}
+
+func TestUnknownOperation(t *testing.T) {
+	resetStores(t)
+
+	_, err := invoke(t, "doesNotExist", `{}`)
+	if err == nil {
+		t.Fatal("unknown operation succeeded")
+	}
+}
+
+func TestMemoryStoreListUsersPages(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	for _, id := range []string{"c", "a", "b"} {
+		if err := userStore.CreateUser(ctx, User{UserID: id, WalletAmount: newMoney(0, "USD")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := []string{}
+	after := ""
+	for {
+		users, next, err := userStore.ListUsers(ctx, after, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, user := range users {
+			seen = append(seen, user.UserID)
+		}
+		if next == "" {
+			break
+		}
+		after = next
+	}
+	if len(seen) != 3 || seen[0] != "a" || seen[1] != "b" || seen[2] != "c" {
+		t.Errorf("listed %v, want [a b c]", seen)
+	}
+}
+
+func TestCreateUserRepeatSucceeds(t *testing.T) {
+	resetStores(t)
+
+	request := `{"user_id":"user-1","email":"one@example.com","wallet_amount":{"amount":"5","currency":"USD"}}`
+	mustInvoke(t, "createUser", request)
+	mustInvoke(t, "createUser", request)
+
+	if user := getTestUser(t, "user-1"); user.WalletAmount != newMoney(5000000, "USD") {
+		t.Errorf("wallet = %v, the repeat changed the opening balance", user.WalletAmount)
+	}
+	page, err := ledgerStore.ListTransactions(context.Background(), TransactionQuery{UserID: "user-1", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Transactions) != 1 {
+		t.Errorf("%d transactions, want a single opening balance", len(page.Transactions))
+	}
+}
@@ -0,0 +1,583 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore is an in-process implementation of UserStore, ApiKeyStore,
+// LedgerStore, IdempotencyStore, RateLimitStore, PlanStore, UsageStore and
+// PriceStore. It is used for local development and
+// unit tests, where no AWS account is available.
+type memoryStore struct {
+	mu           sync.Mutex
+	users        map[string]User
+	apiKeys      map[string]ApiKey
+	transactions []Transaction
+	journal      map[string]JournalEntry
+	reversed     map[string]bool
+	idempotency  map[string]IdempotencyRecord
+	rateLimits   map[string]time.Time
+	plans        map[string]Plan
+	usage        map[string]Usage
+	prices       map[string]PriceTable
+}
+
+func newMemoryStore() *memoryStore {
+	store := &memoryStore{
+		users:       map[string]User{},
+		apiKeys:     map[string]ApiKey{},
+		journal:     map[string]JournalEntry{},
+		reversed:    map[string]bool{},
+		idempotency: map[string]IdempotencyRecord{},
+		rateLimits:  map[string]time.Time{},
+		plans:       map[string]Plan{},
+		usage:       map[string]Usage{},
+		prices:      map[string]PriceTable{},
+	}
+	for _, plan := range defaultPlans {
+		store.plans[plan.PlanID] = plan
+	}
+	for _, table := range defaultPriceTables {
+		store.prices[table.Operation] = table
+	}
+	return store
+}
+
+func (s *memoryStore) CreateUser(ctx context.Context, user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.users[user.UserID]; exists {
+		return errUserExists
+	}
+	s.users[user.UserID] = user
+	return nil
+}
+
+func (s *memoryStore) GetUser(ctx context.Context, userID string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return User{}, errUserNotFound
+	}
+	return user, nil
+}
+
+func (s *memoryStore) SetCreditLimit(ctx context.Context, userID string, creditLimit Money) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return errUserNotFound
+	}
+	user.CreditLimit = creditLimit
+	s.users[userID] = user
+	return nil
+}
+
+func (s *memoryStore) SetPlan(ctx context.Context, userID string, planID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return errUserNotFound
+	}
+	user.Plan = planID
+	s.users[userID] = user
+	return nil
+}
+
+func (s *memoryStore) SetStatus(ctx context.Context, userID string, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return errUserNotFound
+	}
+	user.Status = status
+	s.users[userID] = user
+	return nil
+}
+
+func (s *memoryStore) DeleteUser(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.users, userID)
+	return nil
+}
+
+func (s *memoryStore) ListUsers(ctx context.Context, after string, limit int) ([]User, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := []User{}
+	for _, user := range s.users {
+		if user.UserID > after {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].UserID < users[j].UserID
+	})
+
+	if len(users) > limit {
+		users = users[:limit]
+		return users, users[limit-1].UserID, nil
+	}
+	return users, "", nil
+}
+
+func (s *memoryStore) CreateApiKey(ctx context.Context, key ApiKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.apiKeys[key.KeyID]; ok {
+		return errApiKeyExists
+	}
+	s.apiKeys[key.KeyID] = key
+	return nil
+}
+
+func (s *memoryStore) GetApiKey(ctx context.Context, keyID string) (ApiKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.apiKeys[keyID]
+	if !ok {
+		return ApiKey{}, errApiKeyNotFound
+	}
+	return key, nil
+}
+
+func (s *memoryStore) RevokeApiKey(ctx context.Context, keyID string, revokedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.apiKeys[keyID]
+	if !ok {
+		return errApiKeyNotFound
+	}
+	if key.Status != apiKeyStatusActive {
+		return apiKeyUpdateRejection(key)
+	}
+	key.Status = apiKeyStatusRevoked
+	key.setExpiry(&revokedAt)
+	s.apiKeys[keyID] = key
+	return nil
+}
+
+func (s *memoryStore) RotateApiKey(ctx context.Context, keyID string, replacedBy string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.apiKeys[keyID]
+	if !ok {
+		return errApiKeyNotFound
+	}
+	if key.Status != apiKeyStatusActive || key.ReplacedBy != "" {
+		return apiKeyUpdateRejection(key)
+	}
+	key.ReplacedBy = replacedBy
+	key.setExpiry(&expiresAt)
+	s.apiKeys[keyID] = key
+	return nil
+}
+
+func (s *memoryStore) SetApiKeyExpiry(ctx context.Context, keyID string, expiresAt *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.apiKeys[keyID]
+	if !ok {
+		return errApiKeyNotFound
+	}
+	if key.Status != apiKeyStatusActive || key.ReplacedBy != "" {
+		return apiKeyUpdateRejection(key)
+	}
+	key.setExpiry(expiresAt)
+	s.apiKeys[keyID] = key
+	return nil
+}
+
+func (s *memoryStore) TouchApiKey(ctx context.Context, keyID string, usedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.apiKeys[keyID]
+	if !ok {
+		return errApiKeyNotFound
+	}
+	key.LastUsedAt = &usedAt
+	s.apiKeys[keyID] = key
+	return nil
+}
+
+func (s *memoryStore) ListApiKeys(ctx context.Context, userID string) ([]ApiKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := []ApiKey{}
+	for _, key := range s.apiKeys {
+		if key.UserID == userID {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *memoryStore) DeleteApiKey(ctx context.Context, keyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.apiKeys, keyID)
+	return nil
+}
+
+func (s *memoryStore) PostEntry(ctx context.Context, entry JournalEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry.ReversalOf != "" && s.reversed[entry.ReversalOf] {
+		return errAlreadyReversed
+	}
+
+	// Check every wallet before changing any, so a failure leaves nothing
+	// half applied.
+	users := map[string]User{}
+	for _, posting := range entry.Postings {
+		userID, ok := walletOwner(posting.Account)
+		if !ok {
+			continue
+		}
+		user, ok := s.users[userID]
+		if !ok {
+			return errUserNotFound
+		}
+		if posting.Amount.Currency != user.WalletAmount.Currency {
+			return errCurrencyMismatch
+		}
+		available, err := user.available()
+		if err != nil {
+			return err
+		}
+		if posting.Amount.IsNegative() && available.Micros < posting.Amount.Neg().Micros {
+			return errInsufficientFunds
+		}
+		user.WalletAmount, err = user.WalletAmount.Add(posting.Amount)
+		if err != nil {
+			return err
+		}
+		users[userID] = user
+	}
+
+	for userID, user := range users {
+		s.users[userID] = user
+	}
+	s.recordEntry(entry)
+	return nil
+}
+
+func (s *memoryStore) RecordEntry(ctx context.Context, entry JournalEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.recordEntry(entry)
+	return nil
+}
+
+func (s *memoryStore) recordEntry(entry JournalEntry) {
+	s.journal[entry.EntryID] = entry
+	if entry.ReversalOf != "" {
+		s.reversed[entry.ReversalOf] = true
+	}
+	s.transactions = append(s.transactions, entry.walletTransactions()...)
+}
+
+func (s *memoryStore) GetEntry(ctx context.Context, entryID string) (JournalEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.journal[entryID]
+	if !ok {
+		return JournalEntry{}, errEntryNotFound
+	}
+	return entry, nil
+}
+
+func (s *memoryStore) CreateTransaction(ctx context.Context, transaction Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Transactions are keyed on user and transaction id, as in DynamoDB
+	for _, existing := range s.transactions {
+		if existing.UserID == transaction.UserID && existing.TransactionID == transaction.TransactionID {
+			return errTransactionExists
+		}
+	}
+	s.transactions = append(s.transactions, transaction)
+	return nil
+}
+
+func (s *memoryStore) ListTransactions(ctx context.Context, query TransactionQuery) (TransactionPage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transactions := []Transaction{}
+	for _, transaction := range s.transactions {
+		if transaction.UserID != query.UserID || !query.matches(transaction) {
+			continue
+		}
+		if query.After != "" && transaction.TransactionID >= query.After {
+			continue
+		}
+		transactions = append(transactions, transaction)
+	}
+	sort.Slice(transactions, func(i, j int) bool {
+		return transactions[i].TransactionID > transactions[j].TransactionID
+	})
+
+	page := TransactionPage{Transactions: transactions}
+	if query.Limit > 0 && len(transactions) > query.Limit {
+		page.Transactions = transactions[:query.Limit]
+		page.Next = page.Transactions[query.Limit-1].TransactionID
+	}
+	return page, nil
+}
+
+func (s *memoryStore) RedactTransaction(ctx context.Context, userID string, transactionID string, description string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, existing := range s.transactions {
+		if existing.UserID == userID && existing.TransactionID == transactionID {
+			s.transactions[i].Description = description
+			return nil
+		}
+	}
+	return errEntryNotFound
+}
+
+func (s *memoryStore) ClaimIdempotencyKey(ctx context.Context, record IdempotencyRecord, now time.Time) (IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.idempotency[record.Key]
+	expired := ok && existing.TTL <= now.Unix()
+	lapsed := ok && existing.Status == idempotencyStatusInProgress && existing.LockedUntil < now.Unix()
+	if ok && !expired && !lapsed {
+		return existing, false, nil
+	}
+	s.idempotency[record.Key] = record
+	return IdempotencyRecord{}, true, nil
+}
+
+func (s *memoryStore) CompleteIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.idempotency[record.Key] = record
+	return nil
+}
+
+func (s *memoryStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.idempotency, key)
+	return nil
+}
+
+func (s *memoryStore) TakeRateLimit(ctx context.Context, key string, limit RateLimit, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tat, allowed, retryAfter := limit.allow(s.rateLimits[key], now)
+	s.rateLimits[key] = tat
+	return allowed, retryAfter, nil
+}
+
+func (s *memoryStore) GetPlan(ctx context.Context, planID string) (Plan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	plan, ok := s.plans[planID]
+	if !ok {
+		return Plan{}, errPlanNotFound
+	}
+	return plan, nil
+}
+
+func (s *memoryStore) PutPlan(ctx context.Context, plan Plan) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.plans[plan.PlanID] = plan
+	return nil
+}
+
+func (s *memoryStore) GetPriceTable(ctx context.Context, operation string) (PriceTable, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	table, ok := s.prices[operation]
+	if !ok {
+		return PriceTable{}, errPriceNotFound
+	}
+	return table, nil
+}
+
+func (s *memoryStore) PutPriceTable(ctx context.Context, table PriceTable) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prices[table.Operation] = table
+	return nil
+}
+
+func (s *memoryStore) CountCall(ctx context.Context, userID string, period string, limit int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := s.usageFor(userID, period)
+	if limit > 0 && usage.Calls >= limit {
+		return usage.Calls, errQuotaLimitReached
+	}
+	usage.Calls++
+	s.usage[userID+"#"+period] = usage
+	return usage.Calls, nil
+}
+
+func (s *memoryStore) ReleaseCall(ctx context.Context, userID string, period string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := s.usageFor(userID, period)
+	if usage.Calls > 0 {
+		usage.Calls--
+		s.usage[userID+"#"+period] = usage
+	}
+	return nil
+}
+
+func (s *memoryStore) AddUsageCost(ctx context.Context, userID string, period string, cost Money) (Money, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := s.usageFor(userID, period)
+	if usage.Cost.Currency == "" {
+		usage.Cost.Currency = cost.Currency
+	}
+	total, err := usage.Cost.Add(cost)
+	if err != nil {
+		return Money{}, err
+	}
+	usage.Cost = total
+	s.usage[userID+"#"+period] = usage
+	return usage.Cost, nil
+}
+
+func (s *memoryStore) GetUsage(ctx context.Context, userID string, period string) (Usage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.usageFor(userID, period), nil
+}
+
+func (s *memoryStore) DeleteUsage(ctx context.Context, userID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for key, usage := range s.usage {
+		if usage.UserID == userID {
+			delete(s.usage, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// usageFor must be called with s.mu held.
+func (s *memoryStore) usageFor(userID string, period string) Usage {
+	usage, ok := s.usage[userID+"#"+period]
+	if !ok {
+		usage = Usage{UserID: userID, Period: period}
+	}
+	return usage
+}
+
+// memoryUserDirectory is the UserDirectory used for local development, where
+// there is no user pool and so no identities to read, disable or delete.
+type memoryUserDirectory struct{}
+
+func (memoryUserDirectory) DisableUser(ctx context.Context, userID string) error {
+	return nil
+}
+
+func (memoryUserDirectory) DeleteUser(ctx context.Context, userID string) error {
+	return nil
+}
+
+func (memoryUserDirectory) GetUserAttributes(ctx context.Context, userID string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+// memoryObjectStore is an in-process ObjectStore. Its URLs are not
+// downloadable; they only identify the stored object.
+type memoryObjectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newMemoryObjectStore() *memoryObjectStore {
+	return &memoryObjectStore{objects: map[string][]byte{}}
+}
+
+func (s *memoryObjectStore) PutObject(ctx context.Context, key string, contentType string, body io.Reader) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.objects[key] = data
+	return nil
+}
+
+func (s *memoryObjectStore) PresignGetObject(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.objects[key]; !ok {
+		return "", fmt.Errorf("object %q not found", key)
+	}
+	return "memory://" + key, nil
+}
+
+func (s *memoryObjectStore) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.objects, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
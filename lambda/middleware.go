@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime/debug"
+	"time"
+)
+
+const metricsNamespace = "ProbablyCrater"
+
+// metricsOutput receives CloudWatch embedded metric format records. Lambda
+// ships stdout to CloudWatch Logs, which extracts the metrics.
+var metricsOutput io.Writer = os.Stdout
+
+// loggingMiddleware logs every invocation with its duration and outcome.
+func loggingMiddleware(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, inv *Invocation) (string, error) {
+		start := time.Now()
+		result, err := next(ctx, inv)
+		if err != nil {
+			log.Printf("operation=%s duration=%s error=%v", inv.Operation.Name, time.Since(start), err)
+		} else {
+			log.Printf("operation=%s duration=%s", inv.Operation.Name, time.Since(start))
+		}
+		return result, err
+	}
+}
+
+// metricsMiddleware emits invocation count, error count and duration per
+// operation in CloudWatch embedded metric format.
+func metricsMiddleware(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, inv *Invocation) (string, error) {
+		start := time.Now()
+		result, err := next(ctx, inv)
+
+		errorCount := 0
+		if err != nil {
+			errorCount = 1
+		}
+		record := map[string]interface{}{
+			"_aws": map[string]interface{}{
+				"Timestamp": time.Now().UnixNano() / int64(time.Millisecond),
+				"CloudWatchMetrics": []map[string]interface{}{
+					{
+						"Namespace":  metricsNamespace,
+						"Dimensions": [][]string{{"Operation"}},
+						"Metrics": []map[string]string{
+							{"Name": "Invocations", "Unit": "Count"},
+							{"Name": "Errors", "Unit": "Count"},
+							{"Name": "Duration", "Unit": "Milliseconds"},
+						},
+					},
+				},
+			},
+			"Operation":   inv.Operation.Name,
+			"Invocations": 1,
+			"Errors":      errorCount,
+			"Duration":    float64(time.Since(start).Microseconds()) / 1000,
+		}
+		line, marshalErr := json.Marshal(record)
+		if marshalErr == nil {
+			fmt.Fprintln(metricsOutput, string(line))
+		}
+
+		return result, err
+	}
+}
+
+// recoveryMiddleware turns a panic inside an operation into an error so a
+// single bad request cannot take down the runtime.
+func recoveryMiddleware(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, inv *Invocation) (result string, err error) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				log.Printf("operation=%s panic=%v\n%s", inv.Operation.Name, recovered, debug.Stack())
+				result, err = "", fmt.Errorf("internal error")
+			}
+		}()
+		return next(ctx, inv)
+	}
+}
+
+// identityMiddleware attaches the caller's Cognito claims to the context.
+func identityMiddleware(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, inv *Invocation) (string, error) {
+		claims := inv.Request.Identity
+		if claims == nil {
+			return next(ctx, inv)
+		}
+		if claims.Sub == "" {
+			return "", errForbidden("caller identity is missing the sub claim")
+		}
+		return next(withIdentity(ctx, newIdentity(*claims)), inv)
+	}
+}
+
+// authMiddleware enforces the operation's RequiredRole and RequiredScope
+// against the caller identity attached to the context. Direct invocations
+// carry no identity and are trusted, since reaching the Lambda without API
+// Gateway already requires IAM permission to invoke it.
+func authMiddleware(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, inv *Invocation) (string, error) {
+		op := inv.Operation
+		identity, ok := identityFromContext(ctx)
+		// An API key only stands in for its owner on the operations a
+		// machine client needs, so a leaked key cannot manage the account
+		if ok && identity.ApiKeyID != "" && !op.AcceptsApiKey {
+			return "", errForbidden(fmt.Sprintf("%s cannot be called with an API key", op.Name))
+		}
+		if !ok || (op.RequiredRole == "" && op.RequiredScope == "") {
+			return next(ctx, inv)
+		}
+
+		if !hasRole(identity, op.RequiredRole) {
+			return "", errForbidden(fmt.Sprintf("%s requires the %s group", op.Name, op.RequiredRole))
+		}
+		if op.RequiredScope != "" && !identity.HasScope(op.RequiredScope) {
+			return "", errForbidden(fmt.Sprintf("%s requires the %s scope", op.Name, op.RequiredScope))
+		}
+
+		return next(ctx, inv)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// microsPerUnit is the number of micro-units in one unit of currency.
+	microsPerUnit = 1000000
+	moneyDecimals = 6
+	// maxMoneyExponent bounds the exponent ParseMoney accepts. Anything
+	// larger is out of range, or rounds to zero, for every int64 amount.
+	maxMoneyExponent = 30
+	// maxMoneyDigits is the most integer digits of micro-units that fit in
+	// an int64.
+	maxMoneyDigits = 18
+
+	defaultCurrency = "USD"
+)
+
+// Money is an exact amount of a currency held as integer micro-units, so
+// balances never pick up floating point error. Amounts with more than six
+// decimal places are rounded half to even.
+//
+// In JSON it is {"amount": "12.500000", "currency": "USD"}; a bare number or
+// numeric string is also accepted on input, leaving Currency empty for the
+// caller to fill in. In DynamoDB it is a map of micros and currency.
+type Money struct {
+	Micros   int64
+	Currency string
+}
+
+// errMoneyOverflow is returned by arithmetic whose result does not fit in
+// int64 micro-units.
+var errMoneyOverflow = &OperationError{
+	Code:    "AMOUNT_OUT_OF_RANGE",
+	Message: "amount is out of range",
+}
+
+func newMoney(micros int64, currency string) Money {
+	return Money{Micros: micros, Currency: currency}
+}
+
+// ParseMoney parses a decimal string such as "-12.5" exactly.
+func ParseMoney(value string, currency string) (Money, error) {
+	text := strings.TrimSpace(value)
+	negative := false
+	switch {
+	case strings.HasPrefix(text, "-"):
+		negative = true
+		text = text[1:]
+	case strings.HasPrefix(text, "+"):
+		text = text[1:]
+	}
+
+	// Accept exponents produced by JSON encoders, e.g. 1e-3.
+	exponent := 0
+	if i := strings.IndexAny(text, "eE"); i >= 0 {
+		e, err := strconv.Atoi(text[i+1:])
+		if err != nil {
+			return Money{}, fmt.Errorf("invalid amount %q", value)
+		}
+		if e > maxMoneyExponent || e < -maxMoneyExponent {
+			return Money{}, fmt.Errorf("amount %q is out of range", value)
+		}
+		exponent = e
+		text = text[:i]
+	}
+
+	whole, fraction := text, ""
+	if i := strings.IndexByte(text, '.'); i >= 0 {
+		whole, fraction = text[:i], text[i+1:]
+	}
+	if whole == "" && fraction == "" || !isDigits(whole) || !isDigits(fraction) {
+		return Money{}, fmt.Errorf("invalid amount %q", value)
+	}
+
+	// Shift the decimal point so digits holds the value in micro-units
+	// followed by any remaining digits that need rounding.
+	digits := strings.TrimLeft(whole+fraction, "0")
+	scale := len(fraction) - exponent - moneyDecimals
+	if digits == "" {
+		return newMoney(0, currency), nil
+	}
+	if len(digits)-scale > maxMoneyDigits {
+		return Money{}, fmt.Errorf("amount %q is out of range", value)
+	}
+	if scale < 0 {
+		digits += strings.Repeat("0", -scale)
+		scale = 0
+	}
+
+	kept, dropped := digits, ""
+	if scale > 0 {
+		if scale >= len(digits) {
+			kept, dropped = "0", strings.Repeat("0", scale-len(digits))+digits
+		} else {
+			kept, dropped = digits[:len(digits)-scale], digits[len(digits)-scale:]
+		}
+	}
+
+	micros, err := strconv.ParseInt(kept, 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("amount %q is out of range", value)
+	}
+	if roundsUp(micros, dropped) {
+		micros++
+	}
+	if negative {
+		micros = -micros
+	}
+	return newMoney(micros, currency), nil
+}
+
+// roundsUp applies round-half-to-even to the dropped digits.
+func roundsUp(kept int64, dropped string) bool {
+	if dropped == "" || dropped[0] < '5' {
+		return false
+	}
+	if dropped[0] > '5' || strings.Trim(dropped[1:], "0") != "" {
+		return true
+	}
+	return kept%2 == 1
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String renders the amount with all six decimal places, e.g. "-0.537000".
+func (m Money) String() string {
+	sign := ""
+	// Negate as unsigned, which also holds the magnitude of math.MinInt64
+	micros := uint64(m.Micros)
+	if m.Micros < 0 {
+		sign = "-"
+		micros = -micros
+	}
+	return fmt.Sprintf("%s%d.%06d", sign, micros/microsPerUnit, micros%microsPerUnit)
+}
+
+// commonCurrency returns the currency of an operation on m and other. An
+// amount without a currency, such as a bare number from a payload, takes the
+// other's. Amounts in two different currencies cannot be combined.
+func (m Money) commonCurrency(other Money) (string, error) {
+	if !m.sameCurrency(other) {
+		return "", errCurrencyMismatch
+	}
+	if m.Currency == "" {
+		return other.Currency, nil
+	}
+	return m.Currency, nil
+}
+
+// sameCurrency reports whether m and other can be combined.
+func (m Money) sameCurrency(other Money) bool {
+	return m.Currency == "" || other.Currency == "" || m.Currency == other.Currency
+}
+
+// Add returns m + other, failing with errCurrencyMismatch or
+// errMoneyOverflow rather than returning a wrong amount.
+func (m Money) Add(other Money) (Money, error) {
+	currency, err := m.commonCurrency(other)
+	if err != nil {
+		return Money{}, err
+	}
+	sum := m.Micros + other.Micros
+	if other.Micros > 0 && sum < m.Micros || other.Micros < 0 && sum > m.Micros || sum == math.MinInt64 {
+		return Money{}, errMoneyOverflow
+	}
+	return newMoney(sum, currency), nil
+}
+
+// Sub returns m - other, failing like Add.
+func (m Money) Sub(other Money) (Money, error) {
+	if other.Micros == math.MinInt64 {
+		return Money{}, errMoneyOverflow
+	}
+	return m.Add(other.Neg())
+}
+
+// Neg returns -m. Arithmetic and decoding never produce math.MinInt64, so
+// every amount can be negated.
+func (m Money) Neg() Money {
+	return newMoney(-m.Micros, m.Currency)
+}
+
+func (m Money) IsZero() bool {
+	return m.Micros == 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.Micros < 0
+}
+
+// LessThan compares amounts of the same currency.
+func (m Money) LessThan(other Money) (bool, error) {
+	_, err := m.commonCurrency(other)
+	if err != nil {
+		return false, err
+	}
+	return m.Micros < other.Micros, nil
+}
+
+// MulRatio returns m * numerator / denominator rounded half to even. The
+// product is computed exactly, so it cannot overflow; a result that does not
+// fit in int64 micro-units fails with errMoneyOverflow.
+func (m Money) MulRatio(numerator int64, denominator int64) (Money, error) {
+	product := new(big.Int).Mul(big.NewInt(m.Micros), big.NewInt(numerator))
+	divisor := big.NewInt(denominator)
+	quotient, remainder := new(big.Int).QuoRem(product, divisor, new(big.Int))
+
+	// Compare twice the remainder with the divisor to round
+	twice := new(big.Int).Abs(remainder)
+	twice.Lsh(twice, 1)
+	switch twice.Cmp(new(big.Int).Abs(divisor)) {
+	case 1:
+		quotient.Add(quotient, big.NewInt(int64(product.Sign()*divisor.Sign())))
+	case 0:
+		if quotient.Bit(0) != 0 {
+			quotient.Add(quotient, big.NewInt(int64(product.Sign()*divisor.Sign())))
+		}
+	}
+
+	if !quotient.IsInt64() || quotient.Int64() == math.MinInt64 {
+		return Money{}, errMoneyOverflow
+	}
+	return newMoney(quotient.Int64(), m.Currency), nil
+}
+
+type moneyJSON struct {
+	Amount   json.Number `json:"amount"`
+	Currency string      `json:"currency"`
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+	}{
+		Amount:   m.String(),
+		Currency: m.Currency,
+	})
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		decoder.UseNumber()
+		value := moneyJSON{}
+		err := decoder.Decode(&value)
+		if err != nil {
+			return err
+		}
+		parsed, err := ParseMoney(value.Amount.String(), strings.ToUpper(value.Currency))
+		if err != nil {
+			return err
+		}
+		*m = parsed
+		return nil
+	}
+
+	text := string(data)
+	if len(data) > 0 && data[0] == '"' {
+		err := json.Unmarshal(data, &text)
+		if err != nil {
+			return err
+		}
+	}
+	parsed, err := ParseMoney(text, "")
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+func (m Money) MarshalDynamoDBAttributeValue(av *dynamodb.AttributeValue) error {
+	av.M = map[string]*dynamodb.AttributeValue{
+		"micros": {
+			N: aws.String(strconv.FormatInt(m.Micros, 10)),
+		},
+		"currency": {
+			S: aws.String(m.Currency),
+		},
+	}
+	return nil
+}
+
+// UnmarshalDynamoDBAttributeValue also reads the plain float numbers written
+// before amounts were stored as micro-units.
+func (m *Money) UnmarshalDynamoDBAttributeValue(av *dynamodb.AttributeValue) error {
+	if av.N != nil {
+		parsed, err := ParseMoney(aws.StringValue(av.N), defaultCurrency)
+		if err != nil {
+			return err
+		}
+		*m = parsed
+		return nil
+	}
+
+	if av.M == nil || av.M["micros"] == nil || av.M["micros"].N == nil {
+		return fmt.Errorf("money attribute must be a number or a map with micros")
+	}
+	micros, err := strconv.ParseInt(aws.StringValue(av.M["micros"].N), 10, 64)
+	if err != nil {
+		return err
+	}
+	if micros == math.MinInt64 {
+		return errMoneyOverflow
+	}
+	currency := defaultCurrency
+	if av.M["currency"] != nil && av.M["currency"].S != nil {
+		currency = aws.StringValue(av.M["currency"].S)
+	}
+	*m = newMoney(micros, currency)
+	return nil
+}
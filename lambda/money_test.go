@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		value  string
+		micros int64
+	}{
+		{"0", 0},
+		{"12.5", 12500000},
+		{"-12.5", -12500000},
+		{"+0.000001", 1},
+		{".5", 500000},
+		{"5.", 5000000},
+		{"1e-3", 1000},
+		{"1.5E2", 150000000},
+		{"0.000000e+30", 0},
+		{"1e-30", 0},
+		{"999999999999.999999", 999999999999999999},
+
+		// Half to even on the seventh decimal place
+		{"0.0000005", 0},
+		{"0.0000015", 2},
+		{"0.0000025", 2},
+		{"0.00000250001", 3},
+		{"-0.0000015", -2},
+		{"-0.0000025", -2},
+		{"0.0000004999", 0},
+		{"2.5e-6", 2},
+		{"3.5e-6", 4},
+	}
+	for _, test := range tests {
+		money, err := ParseMoney(test.value, "USD")
+		if err != nil {
+			t.Errorf("ParseMoney(%q) failed, %v", test.value, err)
+			continue
+		}
+		if money.Micros != test.micros || money.Currency != "USD" {
+			t.Errorf("ParseMoney(%q) = %v %s, want %d micros", test.value, money, money.Currency, test.micros)
+		}
+	}
+}
+
+func TestParseMoneyRejects(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"-",
+		".",
+		"abc",
+		"1.2.3",
+		"1e",
+		"1e1.5",
+		"0x10",
+		"1,000",
+		"1e31",
+		"1e-31",
+		"1e200000000",
+		"1e-200000000",
+		"0e99999999999999999999",
+		"1000000000000",
+		"1e12",
+		"99999999999999999999999",
+	} {
+		if money, err := ParseMoney(value, "USD"); err == nil {
+			t.Errorf("ParseMoney(%q) = %v, want an error", value, money)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	money := Money{}
+	if err := json.Unmarshal([]byte(`{"amount":"1.25","currency":"eur"}`), &money); err != nil {
+		t.Fatal(err)
+	}
+	if money != newMoney(1250000, "EUR") {
+		t.Errorf("decoded %v %s", money, money.Currency)
+	}
+
+	if err := json.Unmarshal([]byte(`2.5`), &money); err != nil {
+		t.Fatal(err)
+	}
+	if money != newMoney(2500000, "") {
+		t.Errorf("decoded bare number as %v %q", money, money.Currency)
+	}
+
+	encoded, err := json.Marshal(newMoney(-537000, "USD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(encoded) != `{"amount":"-0.537000","currency":"USD"}` {
+		t.Errorf("encoded %s", encoded)
+	}
+}
+
+func TestMoneyMulRatioRoundsHalfToEven(t *testing.T) {
+	tests := []struct {
+		micros      int64
+		numerator   int64
+		denominator int64
+		want        int64
+	}{
+		{5, 1, 2, 2},
+		{7, 1, 2, 4},
+		{-5, 1, 2, -2},
+		{-7, 1, 2, -4},
+		{10, 1, 3, 3},
+		{20, 1, 3, 7},
+		{100, -15, 100, -15},
+		{1000000, 1500, 1000, 1500000},
+	}
+	for _, test := range tests {
+		got, err := newMoney(test.micros, "USD").MulRatio(test.numerator, test.denominator)
+		if err != nil || got.Micros != test.want {
+			t.Errorf("%d * %d / %d = %d, want %d", test.micros, test.numerator, test.denominator, got.Micros, test.want)
+		}
+	}
+}
+
+func TestMoneyArithmeticChecksCurrency(t *testing.T) {
+	usd := newMoney(1000000, "USD")
+	if got, err := usd.Add(newMoney(500000, "")); err != nil || got != newMoney(1500000, "USD") {
+		t.Errorf("USD + bare = %v %s, %v", got, got.Currency, err)
+	}
+	if got, err := newMoney(500000, "").Sub(usd); err != nil || got != newMoney(-500000, "USD") {
+		t.Errorf("bare - USD = %v %s, %v", got, got.Currency, err)
+	}
+
+	eur := newMoney(1, "EUR")
+	if _, err := usd.Add(eur); err != errCurrencyMismatch {
+		t.Errorf("USD + EUR error = %v, want %v", err, errCurrencyMismatch)
+	}
+	if _, err := usd.Sub(eur); err != errCurrencyMismatch {
+		t.Errorf("USD - EUR error = %v, want %v", err, errCurrencyMismatch)
+	}
+	if _, err := usd.LessThan(eur); err != errCurrencyMismatch {
+		t.Errorf("USD < EUR error = %v, want %v", err, errCurrencyMismatch)
+	}
+}
+
+func TestMoneyArithmeticDoesNotOverflow(t *testing.T) {
+	// The intermediate product is far beyond int64
+	large := newMoney(4000000000000000000, "USD")
+	if got, err := large.MulRatio(3, 4); err != nil || got.Micros != 3000000000000000000 {
+		t.Errorf("MulRatio = %d, %v, want 3000000000000000000", got.Micros, err)
+	}
+
+	for name, operation := range map[string]func() (Money, error){
+		"MulRatio":     func() (Money, error) { return large.MulRatio(4, 1) },
+		"Add":          func() (Money, error) { return large.Add(newMoney(math.MaxInt64-1000, "USD")) },
+		"Sub":          func() (Money, error) { return large.Neg().Sub(newMoney(math.MaxInt64, "USD")) },
+		"Sub MinInt64": func() (Money, error) { return large.Sub(newMoney(math.MinInt64, "USD")) },
+		"Add MinInt64": func() (Money, error) { return newMoney(-math.MaxInt64, "USD").Add(newMoney(-1, "USD")) },
+	} {
+		if got, err := operation(); err != errMoneyOverflow {
+			t.Errorf("%s = %v, %v, want %v", name, got, err, errMoneyOverflow)
+		}
+	}
+
+	if got := newMoney(math.MinInt64, "USD").String(); got != "-9223372036854.775808" {
+		t.Errorf("String of the smallest int64 = %s", got)
+	}
+}
+
+func TestTransactionHistoryAmountBoundsCurrency(t *testing.T) {
+	payload := GetTransactionHistoryPayload{}
+	err := decodePayload(json.RawMessage(`{"user_id":"user-1","min_amount":{"amount":"1","currency":"USD"},"max_amount":{"amount":"2","currency":"EUR"}}`), &payload)
+	validationErr, ok := err.(*ValidationError)
+	if !ok || len(validationErr.Fields) != 1 || validationErr.Fields[0].Field != "max_amount" {
+		t.Fatalf("error = %v, want a max_amount ValidationError", err)
+	}
+
+	minimum := newMoney(1, "EUR")
+	query := TransactionQuery{MinAmount: &minimum}
+	if query.matches(Transaction{Amount: newMoney(5000000, "USD")}) {
+		t.Error("a EUR bound matched a USD transaction")
+	}
+}
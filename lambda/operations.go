@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+var registry = newOperationRegistry()
+
+// newOperationRegistry registers every operation the Lambda serves behind
+// the standard middleware chain. New operations only need an entry here;
+// who may run them is decided by the access policy in policy.go.
+func newOperationRegistry() *Registry {
+	r := newRegistry()
+	r.Use(loggingMiddleware, metricsMiddleware, recoveryMiddleware, identityMiddleware, authMiddleware, idempotencyMiddleware)
+
+	r.Register(Operation{
+		Name: "createUser",
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := CreateUserPayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			userID, err := resolveUserID(ctx, inv.Operation, payload.UserID)
+			if err != nil {
+				return "", err
+			}
+			user := User{
+				UserID: userID,
+				Email:  payload.Email,
+			}
+
+			// Signed-in callers register themselves with their verified
+			// email. Only admins may grant a starting balance.
+			if identity, ok := identityFromContext(ctx); ok {
+				if userID == identity.Sub {
+					if payload.Email != "" && payload.Email != identity.Email {
+						return "", errForbidden("email must match the caller's verified email")
+					}
+					user.Email = identity.Email
+				}
+				if payload.WalletAmount != nil && !hasRole(identity, adminsGroup) {
+					return "", errForbidden("wallet_amount can only be set by an administrator")
+				}
+			}
+			if user.Email == "" {
+				return "", &ValidationError{Fields: []FieldError{{Field: "email", Message: "is required"}}}
+			}
+			user.WalletAmount = newMoney(0, defaultCurrency)
+			if payload.WalletAmount != nil {
+				user.WalletAmount = *payload.WalletAmount
+				if user.WalletAmount.Currency == "" {
+					user.WalletAmount.Currency = defaultCurrency
+				}
+			}
+			user.CreditLimit = newMoney(0, user.WalletAmount.Currency)
+			return createUser(ctx, user)
+		},
+	})
+
+	r.Register(Operation{
+		Name: "getUser",
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := GetUserPayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			userID, err := resolveUserID(ctx, inv.Operation, payload.UserID)
+			if err != nil {
+				return "", err
+			}
+			return getUser(ctx, userID)
+		},
+	})
+
+	r.Register(Operation{
+		Name:                  "updateWallet",
+		AcceptsIdempotencyKey: true,
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := UpdateWalletPayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			return updateWallet(ctx, payload.UserID, *payload.Amount, fundingAccount(payload.Account), payload.DryRun)
+		},
+	})
+
+	r.Register(Operation{
+		Name:                  "addWallet",
+		AcceptsIdempotencyKey: true,
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := AddWalletPayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			return addWallet(ctx, payload.UserID, *payload.Amount, fundingAccount(payload.Account), payload.DryRun)
+		},
+	})
+
+	r.Register(Operation{
+		Name: "setCreditLimit",
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := SetCreditLimitPayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			return setCreditLimit(ctx, payload.UserID, *payload.CreditLimit)
+		},
+	})
+
+	r.Register(Operation{
+		Name: "setPlan",
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := SetPlanPayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			return setPlan(ctx, payload.UserID, payload.Plan)
+		},
+	})
+
+	r.Register(Operation{
+		Name:          "getUsage",
+		AcceptsApiKey: true,
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := GetUsagePayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			userID, err := resolveUserID(ctx, inv.Operation, payload.UserID)
+			if err != nil {
+				return "", err
+			}
+			return getUsage(ctx, userID, payload.Period)
+		},
+	})
+
+	// Used by the front end application to display api keys
+	r.Register(Operation{
+		Name: "getApiKeyFromUser",
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := GetApiKeyFromUserPayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			userID, err := resolveUserID(ctx, inv.Operation, payload.UserID)
+			if err != nil {
+				return "", err
+			}
+			return getApiKeyFromUser(ctx, userID)
+		},
+	})
+
+	// Use by the service that the API key is used for
+	r.Register(Operation{
+		Name: "getUserFromApiKey",
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := GetUserFromApiKeyPayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			return getUserFromApiKey(ctx, payload.ApiKey)
+		},
+	})
+
+	r.Register(Operation{
+		Name: "generateApiKey",
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := GenerateApiKeyPayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			userID, err := resolveUserID(ctx, inv.Operation, payload.UserID)
+			if err != nil {
+				return "", err
+			}
+			return generateApiKey(ctx, userID, payload.Label, payload.ExpiresAt)
+		},
+	})
+
+	r.Register(Operation{
+		Name: "listApiKeys",
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := ListApiKeysPayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			userID, err := resolveUserID(ctx, inv.Operation, payload.UserID)
+			if err != nil {
+				return "", err
+			}
+			return listApiKeys(ctx, userID)
+		},
+	})
+
+	r.Register(Operation{
+		Name: "revokeApiKey",
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := RevokeApiKeyPayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			key, err := loadOwnedApiKey(ctx, inv.Operation, payload.KeyID)
+			if err != nil {
+				return "", err
+			}
+			return revokeApiKey(ctx, key)
+		},
+	})
+
+	r.Register(Operation{
+		Name: "rotateApiKey",
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := RotateApiKeyPayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			key, err := loadOwnedApiKey(ctx, inv.Operation, payload.KeyID)
+			if err != nil {
+				return "", err
+			}
+			return rotateApiKey(ctx, key, payload.gracePeriod())
+		},
+	})
+
+	r.Register(Operation{
+		Name: "setApiKeyExpiry",
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := SetApiKeyExpiryPayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			key, err := loadOwnedApiKey(ctx, inv.Operation, payload.KeyID)
+			if err != nil {
+				return "", err
+			}
+			return setApiKeyExpiry(ctx, key, payload.ExpiresAt)
+		},
+	})
+
+	r.Register(Operation{
+		Name:                  "logTransaction",
+		AcceptsIdempotencyKey: true,
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := LogTransactionPayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			transaction := Transaction{
+				UserID:      payload.UserID,
+				Amount:      *payload.Amount,
+				Type:        transactionTypeManual,
+				Description: payload.Description,
+			}
+			return logTransaction(ctx, transaction)
+		},
+	})
+
+	r.Register(Operation{
+		Name: "reverseTransaction",
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := ReverseTransactionPayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			return reverseTransaction(ctx, payload.UserID, payload.TransactionID)
+		},
+	})
+
+	r.Register(Operation{
+		Name: "getTransactionHistory",
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := GetTransactionHistoryPayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			userID, err := resolveUserID(ctx, inv.Operation, payload.UserID)
+			if err != nil {
+				return "", err
+			}
+			return getTransactionHistory(ctx, payload.query(userID))
+		},
+	})
+
+	r.Register(Operation{
+		Name: "exportTransactionHistory",
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := ExportTransactionHistoryPayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			userID, err := resolveUserID(ctx, inv.Operation, payload.UserID)
+			if err != nil {
+				return "", err
+			}
+			return exportTransactionHistory(ctx, userID, payload.Format)
+		},
+	})
+
+	r.Register(Operation{
+		Name:          "quote",
+		AcceptsApiKey: true,
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := QuotePayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			userID, err := resolveUserID(ctx, inv.Operation, payload.UserID)
+			if err != nil {
+				return "", err
+			}
+			return quote(ctx, userID, payload.Operation, payload.duration())
+		},
+	})
+
+	r.Register(Operation{
+		Name: "exportMyData",
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := ExportMyDataPayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			userID, err := resolveUserID(ctx, inv.Operation, payload.UserID)
+			if err != nil {
+				return "", err
+			}
+			return exportMyData(ctx, userID)
+		},
+	})
+
+	r.Register(Operation{
+		Name: "deleteAccount",
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := DeleteAccountPayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			userID, err := resolveUserID(ctx, inv.Operation, payload.UserID)
+			if err != nil {
+				return "", err
+			}
+			return deleteAccount(ctx, userID)
+		},
+	})
+
+	r.Register(Operation{
+		Name:                  "callAPI",
+		AcceptsIdempotencyKey: true,
+		AcceptsApiKey:         true,
+		Handler: func(ctx context.Context, inv *Invocation) (string, error) {
+			payload := CallAPIPayload{}
+			if err := decodePayload(inv.Request.Payload, &payload); err != nil {
+				return "", err
+			}
+			return callAPI(ctx, payload.ApiKey, payload.DryRun)
+		},
+	})
+
+	policy, err := loadAccessPolicy()
+	if err != nil {
+		log.Fatalf("unable to load access policy, %v", err)
+	}
+	err = applyAccessPolicy(r, policy)
+	if err != nil {
+		log.Fatalf("unable to apply access policy, %v", err)
+	}
+
+	return r
+}
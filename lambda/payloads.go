@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// payload is implemented by every typed operation payload. validate reports
+// the fields that decoded cleanly but hold unacceptable values.
+//
+// Self-service payloads leave user_id optional: it defaults to the caller and
+// is checked against the caller's identity by resolveUserID.
+type payload interface {
+	validate() []FieldError
+}
+
+// legacyPayload is implemented by the payloads of operations that used to
+// take a bare JSON string. primaryField names the field such a string is
+// decoded into.
+type legacyPayload interface {
+	primaryField() string
+}
+
+type CreateUserPayload struct {
+	UserID       string `json:"user_id"`
+	Email        string `json:"email"`
+	WalletAmount *Money `json:"wallet_amount"`
+}
+
+func (p *CreateUserPayload) validate() []FieldError {
+	errs := []FieldError{}
+	if p.Email != "" && !strings.Contains(p.Email, "@") {
+		errs = append(errs, FieldError{Field: "email", Message: "must be an email address"})
+	}
+	if p.WalletAmount != nil && p.WalletAmount.IsNegative() {
+		errs = append(errs, FieldError{Field: "wallet_amount", Message: "must not be negative"})
+	}
+	return validateCurrency(errs, "wallet_amount", p.WalletAmount)
+}
+
+type GetUserPayload struct {
+	UserID string `json:"user_id"`
+}
+
+func (p *GetUserPayload) primaryField() string {
+	return "user_id"
+}
+
+func (p *GetUserPayload) validate() []FieldError {
+	return nil
+}
+
+type UpdateWalletPayload struct {
+	UserID string `json:"user_id"`
+	Amount *Money `json:"amount"`
+	// Account is the system account on the other side of the movement,
+	// promotions unless given.
+	Account string `json:"account"`
+	// DryRun returns the quote of the movement without making it.
+	DryRun bool `json:"dry_run"`
+}
+
+func (p *UpdateWalletPayload) validate() []FieldError {
+	errs := requireString(nil, "user_id", p.UserID)
+	errs = validateFundingAccount(errs, p.Account)
+	if p.Amount == nil {
+		errs = append(errs, FieldError{Field: "amount", Message: "is required"})
+	} else if p.Amount.IsZero() {
+		errs = append(errs, FieldError{Field: "amount", Message: "must not be zero"})
+	}
+	return validateCurrency(errs, "amount", p.Amount)
+}
+
+type AddWalletPayload struct {
+	UserID string `json:"user_id"`
+	Amount *Money `json:"amount"`
+	// Account is the system account on the other side of the movement,
+	// promotions unless given.
+	Account string `json:"account"`
+	// DryRun returns the quote of the movement without making it.
+	DryRun bool `json:"dry_run"`
+}
+
+func (p *AddWalletPayload) validate() []FieldError {
+	errs := requireString(nil, "user_id", p.UserID)
+	errs = validateFundingAccount(errs, p.Account)
+	if p.Amount == nil {
+		errs = append(errs, FieldError{Field: "amount", Message: "is required"})
+	} else if p.Amount.IsNegative() || p.Amount.IsZero() {
+		errs = append(errs, FieldError{Field: "amount", Message: "must be greater than zero"})
+	}
+	return validateCurrency(errs, "amount", p.Amount)
+}
+
+// fundingAccount returns the requested account, defaulting to promotions.
+func fundingAccount(account string) string {
+	if account == "" {
+		return accountPromotions
+	}
+	return account
+}
+
+func validateFundingAccount(errs []FieldError, account string) []FieldError {
+	if account != "" && !contains(fundingAccounts, account) {
+		errs = append(errs, FieldError{Field: "account", Message: fmt.Sprintf("must be one of %s", strings.Join(fundingAccounts, ", "))})
+	}
+	return errs
+}
+
+type SetCreditLimitPayload struct {
+	UserID      string `json:"user_id"`
+	CreditLimit *Money `json:"credit_limit"`
+}
+
+func (p *SetCreditLimitPayload) validate() []FieldError {
+	errs := requireString(nil, "user_id", p.UserID)
+	if p.CreditLimit == nil {
+		errs = append(errs, FieldError{Field: "credit_limit", Message: "is required"})
+	} else if p.CreditLimit.IsNegative() {
+		errs = append(errs, FieldError{Field: "credit_limit", Message: "must not be negative"})
+	}
+	return validateCurrency(errs, "credit_limit", p.CreditLimit)
+}
+
+type SetPlanPayload struct {
+	UserID string `json:"user_id"`
+	Plan   string `json:"plan"`
+}
+
+func (p *SetPlanPayload) validate() []FieldError {
+	errs := requireString(nil, "user_id", p.UserID)
+	return requireString(errs, "plan", p.Plan)
+}
+
+type GetUsagePayload struct {
+	UserID string `json:"user_id"`
+	// Period is the month to report as YYYY-MM, the current one if empty.
+	Period string `json:"period"`
+}
+
+func (p *GetUsagePayload) validate() []FieldError {
+	var errs []FieldError
+	if _, err := time.Parse(usagePeriodLayout, p.Period); p.Period != "" && err != nil {
+		errs = append(errs, FieldError{Field: "period", Message: "must be a month as YYYY-MM"})
+	}
+	return errs
+}
+
+type GetApiKeyFromUserPayload struct {
+	UserID string `json:"user_id"`
+}
+
+func (p *GetApiKeyFromUserPayload) primaryField() string {
+	return "user_id"
+}
+
+func (p *GetApiKeyFromUserPayload) validate() []FieldError {
+	return nil
+}
+
+type GetUserFromApiKeyPayload struct {
+	ApiKey string `json:"api_key"`
+}
+
+func (p *GetUserFromApiKeyPayload) primaryField() string {
+	return "api_key"
+}
+
+func (p *GetUserFromApiKeyPayload) validate() []FieldError {
+	return requireString(nil, "api_key", p.ApiKey)
+}
+
+type GenerateApiKeyPayload struct {
+	UserID    string     `json:"user_id"`
+	Label     string     `json:"label"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func (p *GenerateApiKeyPayload) primaryField() string {
+	return "user_id"
+}
+
+func (p *GenerateApiKeyPayload) validate() []FieldError {
+	errs := validateLabel(nil, p.Label)
+	return validateFuture(errs, "expires_at", p.ExpiresAt)
+}
+
+type ListApiKeysPayload struct {
+	UserID string `json:"user_id"`
+}
+
+func (p *ListApiKeysPayload) validate() []FieldError {
+	return nil
+}
+
+type RevokeApiKeyPayload struct {
+	KeyID string `json:"key_id"`
+}
+
+func (p *RevokeApiKeyPayload) validate() []FieldError {
+	return requireString(nil, "key_id", p.KeyID)
+}
+
+type RotateApiKeyPayload struct {
+	KeyID              string `json:"key_id"`
+	GracePeriodSeconds *int64 `json:"grace_period_seconds"`
+}
+
+func (p *RotateApiKeyPayload) validate() []FieldError {
+	errs := requireString(nil, "key_id", p.KeyID)
+	if p.GracePeriodSeconds != nil {
+		grace := time.Duration(*p.GracePeriodSeconds) * time.Second
+		if grace < 0 || grace > maxRotationGracePeriod {
+			errs = append(errs, FieldError{Field: "grace_period_seconds", Message: fmt.Sprintf("must be between 0 and %d", int64(maxRotationGracePeriod/time.Second))})
+		}
+	}
+	return errs
+}
+
+func (p *RotateApiKeyPayload) gracePeriod() time.Duration {
+	if p.GracePeriodSeconds == nil {
+		return defaultRotationGracePeriod
+	}
+	return time.Duration(*p.GracePeriodSeconds) * time.Second
+}
+
+// SetApiKeyExpiryPayload sets a key's expiry. Omitting expires_at removes it.
+type SetApiKeyExpiryPayload struct {
+	KeyID     string     `json:"key_id"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func (p *SetApiKeyExpiryPayload) validate() []FieldError {
+	errs := requireString(nil, "key_id", p.KeyID)
+	return validateFuture(errs, "expires_at", p.ExpiresAt)
+}
+
+type LogTransactionPayload struct {
+	UserID      string `json:"user_id"`
+	Amount      *Money `json:"amount"`
+	Description string `json:"description"`
+}
+
+func (p *LogTransactionPayload) validate() []FieldError {
+	errs := requireString(nil, "user_id", p.UserID)
+	if p.Amount == nil {
+		errs = append(errs, FieldError{Field: "amount", Message: "is required"})
+	}
+	errs = validateCurrency(errs, "amount", p.Amount)
+	return requireString(errs, "description", p.Description)
+}
+
+type GetTransactionHistoryPayload struct {
+	UserID    string     `json:"user_id"`
+	PageSize  *int       `json:"page_size"`
+	NextToken string     `json:"next_token"`
+	From      *time.Time `json:"from"`
+	To        *time.Time `json:"to"`
+	Types     []string   `json:"types"`
+	MinAmount *Money     `json:"min_amount"`
+	MaxAmount *Money     `json:"max_amount"`
+}
+
+func (p *GetTransactionHistoryPayload) primaryField() string {
+	return "user_id"
+}
+
+func (p *GetTransactionHistoryPayload) validate() []FieldError {
+	var errs []FieldError
+	if p.PageSize != nil && (*p.PageSize < 1 || *p.PageSize > maxTransactionPageSize) {
+		errs = append(errs, FieldError{Field: "page_size", Message: fmt.Sprintf("must be between 1 and %d", maxTransactionPageSize)})
+	}
+	if _, ok := decodePageToken(p.NextToken); p.NextToken != "" && !ok {
+		errs = append(errs, FieldError{Field: "next_token", Message: "is not a valid page token"})
+	}
+	if p.From != nil && p.To != nil && p.To.Before(*p.From) {
+		errs = append(errs, FieldError{Field: "to", Message: "must not be before from"})
+	}
+	for _, transactionType := range p.Types {
+		if !contains(transactionTypes, transactionType) {
+			errs = append(errs, FieldError{Field: "types", Message: fmt.Sprintf("must only contain %s", strings.Join(transactionTypes, ", "))})
+			break
+		}
+	}
+	if p.MinAmount != nil && p.MaxAmount != nil {
+		if p.MinAmount.Currency != "" && p.MaxAmount.Currency != "" && p.MinAmount.Currency != p.MaxAmount.Currency {
+			errs = append(errs, FieldError{Field: "max_amount", Message: "currency must match min_amount"})
+		} else if less, _ := p.MaxAmount.LessThan(*p.MinAmount); less {
+			errs = append(errs, FieldError{Field: "max_amount", Message: "must not be less than min_amount"})
+		}
+	}
+	return errs
+}
+
+// query builds the store query for userID, applying the default page size.
+func (p *GetTransactionHistoryPayload) query(userID string) TransactionQuery {
+	query := TransactionQuery{
+		UserID:    userID,
+		From:      p.From,
+		To:        p.To,
+		Types:     p.Types,
+		MinAmount: p.MinAmount,
+		MaxAmount: p.MaxAmount,
+		Limit:     defaultTransactionPageSize,
+	}
+	if p.PageSize != nil {
+		query.Limit = *p.PageSize
+	}
+	query.After, _ = decodePageToken(p.NextToken)
+	return query
+}
+
+type ExportTransactionHistoryPayload struct {
+	UserID string `json:"user_id"`
+	Format string `json:"format"`
+}
+
+func (p *ExportTransactionHistoryPayload) validate() []FieldError {
+	var errs []FieldError
+	if !contains(exportFormats, p.Format) {
+		errs = append(errs, FieldError{Field: "format", Message: fmt.Sprintf("must be one of %s", strings.Join(exportFormats, ", "))})
+	}
+	return errs
+}
+
+type ReverseTransactionPayload struct {
+	UserID        string `json:"user_id"`
+	TransactionID string `json:"transaction_id"`
+}
+
+func (p *ReverseTransactionPayload) validate() []FieldError {
+	errs := requireString(nil, "user_id", p.UserID)
+	return requireString(errs, "transaction_id", p.TransactionID)
+}
+
+type QuotePayload struct {
+	UserID    string `json:"user_id"`
+	Operation string `json:"operation"`
+	// DurationMs is the expected duration, the longest possible if unset.
+	DurationMs *int64 `json:"duration_ms"`
+}
+
+func (p *QuotePayload) validate() []FieldError {
+	var errs []FieldError
+	if !contains(meteredOperations, p.Operation) {
+		errs = append(errs, FieldError{Field: "operation", Message: fmt.Sprintf("must be one of %s", strings.Join(meteredOperations, ", "))})
+	}
+	if p.DurationMs != nil && (*p.DurationMs < 0 || *p.DurationMs > maxCallDuration.Milliseconds()) {
+		errs = append(errs, FieldError{Field: "duration_ms", Message: fmt.Sprintf("must be between 0 and %d", maxCallDuration.Milliseconds())})
+	}
+	return errs
+}
+
+func (p *QuotePayload) duration() time.Duration {
+	if p.DurationMs == nil {
+		return maxCallDuration
+	}
+	return time.Duration(*p.DurationMs) * time.Millisecond
+}
+
+type ExportMyDataPayload struct {
+	UserID string `json:"user_id"`
+}
+
+func (p *ExportMyDataPayload) validate() []FieldError {
+	return nil
+}
+
+type DeleteAccountPayload struct {
+	UserID string `json:"user_id"`
+	// Confirm must be true; deleting an account cannot be undone.
+	Confirm bool `json:"confirm"`
+}
+
+func (p *DeleteAccountPayload) validate() []FieldError {
+	if !p.Confirm {
+		return []FieldError{{Field: "confirm", Message: "must be true to delete the account"}}
+	}
+	return nil
+}
+
+type CallAPIPayload struct {
+	// ApiKey is only needed when the request did not come through the API
+	// key authorizer.
+	ApiKey string `json:"api_key"`
+	// DryRun returns the quote of the largest possible charge without
+	// making the call.
+	DryRun bool `json:"dry_run"`
+}
+
+func (p *CallAPIPayload) primaryField() string {
+	return "api_key"
+}
+
+func (p *CallAPIPayload) validate() []FieldError {
+	return nil
+}
+
+func requireString(errs []FieldError, field string, value string) []FieldError {
+	if strings.TrimSpace(value) == "" {
+		errs = append(errs, FieldError{Field: field, Message: "is required"})
+	}
+	return errs
+}
+
+// validateCurrency checks that an explicit currency is an ISO 4217 style
+// three letter code.
+func validateCurrency(errs []FieldError, field string, amount *Money) []FieldError {
+	if amount == nil || amount.Currency == "" {
+		return errs
+	}
+	valid := len(amount.Currency) == 3
+	for _, r := range amount.Currency {
+		valid = valid && r >= 'A' && r <= 'Z'
+	}
+	if !valid {
+		errs = append(errs, FieldError{Field: field, Message: "currency must be a three letter code"})
+	}
+	return errs
+}
+
+func validateLabel(errs []FieldError, label string) []FieldError {
+	if len(label) > 64 {
+		errs = append(errs, FieldError{Field: "label", Message: "must be at most 64 characters"})
+	}
+	return errs
+}
+
+func validateFuture(errs []FieldError, field string, value *time.Time) []FieldError {
+	if value != nil && !value.After(time.Now()) {
+		errs = append(errs, FieldError{Field: field, Message: "must be in the future"})
+	}
+	return errs
+}
+
+// decodePayload strictly decodes raw into dst. Unknown fields, values of the
+// wrong JSON type and failed validations are all collected into a single
+// ValidationError rather than stopping at the first problem.
+//
+// A missing or null payload is decoded as an empty object, so the
+// operation's own validation reports what is required. A bare string is
+// accepted for the operations that took one before payloads were objects.
+func decodePayload(raw json.RawMessage, dst payload) error {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		raw = json.RawMessage("{}")
+	}
+
+	fields := map[string]json.RawMessage{}
+	if legacy, ok := dst.(legacyPayload); ok && raw[0] == '"' {
+		fields[legacy.primaryField()] = raw
+	} else if err := json.Unmarshal(raw, &fields); err != nil {
+		return &ValidationError{Fields: []FieldError{{Field: "payload", Message: "must be a JSON object"}}}
+	}
+
+	value := reflect.ValueOf(dst).Elem()
+	known := map[string]int{}
+	for i := 0; i < value.NumField(); i++ {
+		name := strings.Split(value.Type().Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			known[name] = i
+		}
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	errs := []FieldError{}
+	malformed := map[string]bool{}
+	for _, name := range names {
+		index, ok := known[name]
+		if !ok {
+			errs = append(errs, FieldError{Field: name, Message: "is not a recognized field"})
+			continue
+		}
+
+		field := value.Field(index)
+		err := json.Unmarshal(fields[name], field.Addr().Interface())
+		if err != nil {
+			errs = append(errs, FieldError{Field: name, Message: describeExpected(field.Type())})
+			malformed[name] = true
+		}
+	}
+
+	for _, fieldErr := range dst.validate() {
+		if !malformed[fieldErr.Field] {
+			errs = append(errs, fieldErr)
+		}
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{Fields: errs}
+	}
+	return nil
+}
+
+func describeExpected(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return "must be an RFC 3339 timestamp"
+	}
+	if t == reflect.TypeOf(Money{}) {
+		return "must be a decimal amount or an object with amount and currency"
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return "must be a string"
+	case reflect.Bool:
+		return "must be a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "must be an integer"
+	case reflect.Float32, reflect.Float64:
+		return "must be a number"
+	case reflect.Slice, reflect.Array:
+		return "must be an array"
+	default:
+		return "is invalid"
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDecodePayloadLegacyString(t *testing.T) {
+	tests := []struct {
+		name  string
+		dst   payload
+		field func(payload) string
+	}{
+		{"getUser", &GetUserPayload{}, func(p payload) string { return p.(*GetUserPayload).UserID }},
+		{"getApiKeyFromUser", &GetApiKeyFromUserPayload{}, func(p payload) string { return p.(*GetApiKeyFromUserPayload).UserID }},
+		{"generateApiKey", &GenerateApiKeyPayload{}, func(p payload) string { return p.(*GenerateApiKeyPayload).UserID }},
+		{"getTransactionHistory", &GetTransactionHistoryPayload{}, func(p payload) string { return p.(*GetTransactionHistoryPayload).UserID }},
+		{"getUserFromApiKey", &GetUserFromApiKeyPayload{}, func(p payload) string { return p.(*GetUserFromApiKeyPayload).ApiKey }},
+		{"callAPI", &CallAPIPayload{}, func(p payload) string { return p.(*CallAPIPayload).ApiKey }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := decodePayload(json.RawMessage(` "value-1" `), test.dst)
+			if err != nil {
+				t.Fatalf("decodePayload failed, %v", err)
+			}
+			if got := test.field(test.dst); got != "value-1" {
+				t.Errorf("primary field = %q, want value-1", got)
+			}
+		})
+	}
+}
+
+func TestDecodePayloadRejectsStringForObjectPayloads(t *testing.T) {
+	err := decodePayload(json.RawMessage(`"user-1"`), &UpdateWalletPayload{})
+	validationErr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("error = %v, want a ValidationError", err)
+	}
+	if len(validationErr.Fields) != 1 || validationErr.Fields[0].Field != "payload" {
+		t.Errorf("fields = %+v, want only payload", validationErr.Fields)
+	}
+}
+
+func TestDecodePayloadEmptyIsEmptyObject(t *testing.T) {
+	for _, raw := range []string{"", "null", "  "} {
+		// Nothing is required, so an empty payload is valid
+		if err := decodePayload(json.RawMessage(raw), &GetUserPayload{}); err != nil {
+			t.Errorf("decodePayload(%q) failed, %v", raw, err)
+		}
+
+		// Required fields are reported by the payload's own validation
+		err := decodePayload(json.RawMessage(raw), &UpdateWalletPayload{})
+		validationErr, ok := err.(*ValidationError)
+		if !ok {
+			t.Fatalf("decodePayload(%q) error = %v, want a ValidationError", raw, err)
+		}
+		fields := map[string]bool{}
+		for _, field := range validationErr.Fields {
+			fields[field.Field] = true
+		}
+		if !fields["user_id"] || !fields["amount"] || fields["payload"] {
+			t.Errorf("decodePayload(%q) fields = %+v, want user_id and amount", raw, validationErr.Fields)
+		}
+	}
+}
+
+func TestDecodePayloadCollectsFieldErrors(t *testing.T) {
+	err := decodePayload(json.RawMessage(`{"user_id":5,"unknown":true}`), &UpdateWalletPayload{})
+	validationErr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("error = %v, want a ValidationError", err)
+	}
+	fields := map[string]string{}
+	for _, field := range validationErr.Fields {
+		fields[field.Field] = field.Message
+	}
+	if fields["user_id"] != "must be a string" {
+		t.Errorf("user_id message = %q", fields["user_id"])
+	}
+	if fields["unknown"] != "is not a recognized field" {
+		t.Errorf("unknown message = %q", fields["unknown"])
+	}
+	if fields["amount"] != "is required" {
+		t.Errorf("amount message = %q", fields["amount"])
+	}
+}
+
+func TestGetUserWithLegacyStringPayload(t *testing.T) {
+	resetStores(t)
+
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com"}`)
+	result := mustInvoke(t, "getUser", `"user-1"`)
+	user := User{}
+	if err := json.Unmarshal([]byte(result), &user); err != nil {
+		t.Fatal(err)
+	}
+	if user.UserID != "user-1" {
+		t.Errorf("user_id = %q, want user-1", user.UserID)
+	}
+}
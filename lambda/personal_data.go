@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// PersonalData is everything held about a user apart from their
+// transactions, which are streamed into the archive after it.
+type PersonalData struct {
+	ExportedAt time.Time `json:"exported_at"`
+	User       User      `json:"user"`
+	// CognitoAttributes are the user's attributes in the user pool.
+	CognitoAttributes map[string]string `json:"cognito_attributes"`
+	// ApiKeys holds the keys' metadata; the secrets are never stored.
+	ApiKeys []ApiKey `json:"api_keys"`
+}
+
+// exportMyData answers a subject access request: it writes the user's users
+// row, Cognito attributes, API key metadata and full transaction history to
+// one JSON archive in the object store and returns a presigned link to it.
+func exportMyData(ctx context.Context, userID string) (string, error) {
+	user, err := userStore.GetUser(ctx, userID)
+	if err == errUserNotFound {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get user, %v", err)
+	}
+
+	attributes, err := userDirectory.GetUserAttributes(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get Cognito attributes, %v", err)
+	}
+
+	keys, err := apiKeyStore.ListApiKeys(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to list API keys, %v", err)
+	}
+	sortApiKeysNewestFirst(keys)
+
+	now := time.Now().UTC()
+	data := PersonalData{
+		ExportedAt:        now,
+		User:              user,
+		CognitoAttributes: attributes,
+		ApiKeys:           keys,
+	}
+
+	exportID, err := newULID(now)
+	if err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("%s%s-personal-data.json", exportPrefix(userID), exportID)
+
+	count, err := uploadExport(ctx, key, "application/json", func(w io.Writer) (int, error) {
+		return writePersonalData(ctx, w, data)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to write personal data export, %v", err)
+	}
+
+	url, err := objectStore.PresignGetObject(ctx, key, exportURLLifetime)
+	if err != nil {
+		return "", fmt.Errorf("failed to presign export URL, %v", err)
+	}
+
+	resultJson, err := json.Marshal(struct {
+		URL          string    `json:"url"`
+		ExpiresAt    time.Time `json:"expires_at"`
+		ApiKeys      int       `json:"api_keys"`
+		Transactions int       `json:"transactions"`
+	}{
+		URL:          url,
+		ExpiresAt:    time.Now().UTC().Add(exportURLLifetime),
+		ApiKeys:      len(keys),
+		Transactions: count,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal export JSON, %v", err)
+	}
+
+	return string(resultJson), nil
+}
+
+// writePersonalData writes data as one JSON object with the user's
+// transactions, newest first, in its "transactions" array. The array is
+// streamed page by page, so the archive is never held in memory. It returns
+// how many transactions were written.
+func writePersonalData(ctx context.Context, w io.Writer, data PersonalData) (int, error) {
+	buffered := bufio.NewWriter(w)
+
+	// Reopen the encoded object to append the transactions to it
+	head, err := json.Marshal(data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal personal data, %v", err)
+	}
+	buffered.Write(bytes.TrimSuffix(head, []byte("}")))
+	buffered.WriteString(`,"transactions":[`)
+
+	count := 0
+	query := TransactionQuery{UserID: data.User.UserID, Limit: exportPageSize}
+	for {
+		page, err := ledgerStore.ListTransactions(ctx, query)
+		if err != nil {
+			return count, fmt.Errorf("failed to query transactions, %v", err)
+		}
+
+		for _, transaction := range page.Transactions {
+			transactionJson, err := json.Marshal(transaction)
+			if err != nil {
+				return count, fmt.Errorf("failed to marshal transaction, %v", err)
+			}
+			if count > 0 {
+				buffered.WriteByte(',')
+			}
+			_, err = buffered.Write(transactionJson)
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+
+		if page.Next == "" {
+			break
+		}
+		query.After = page.Next
+	}
+
+	buffered.WriteString("]}")
+	return count, buffered.Flush()
+}
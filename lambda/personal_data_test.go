@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestExportMyDataWritesOneArchive(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	caller := &RequestIdentity{Sub: "user-1", Email: "one@example.com"}
+	if _, err := invokeAs(t, caller, "createUser", `{}`); err != nil {
+		t.Fatal(err)
+	}
+	generated, err := issueApiKey(ctx, "user-1", "ci", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := postWalletEntry(ctx, "user-1", newMoney(1000000, "USD"), accountPromotions, transactionTypeTopUp, "wallet top-up"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := invokeAs(t, caller, "exportMyData", `{}`)
+	if err != nil {
+		t.Fatalf("exportMyData failed, %v", err)
+	}
+	archive := exportedObject(t, result)
+	if strings.Contains(archive, generated.ApiKey) {
+		t.Error("the archive holds the API key secret")
+	}
+
+	data := struct {
+		PersonalData
+		Transactions []Transaction `json:"transactions"`
+	}{}
+	if err := json.Unmarshal([]byte(archive), &data); err != nil {
+		t.Fatalf("archive is not valid JSON, %v", err)
+	}
+	if data.User.UserID != "user-1" || data.User.Email != "one@example.com" {
+		t.Errorf("user = %+v", data.User)
+	}
+	if len(data.ApiKeys) != 1 || data.ApiKeys[0].Label != "ci" {
+		t.Errorf("api keys = %+v, want the ci key", data.ApiKeys)
+	}
+	if len(data.Transactions) != 2 {
+		t.Errorf("%d transactions, want 2", len(data.Transactions))
+	}
+
+	// Other users' data is not the caller's to export
+	if _, err := invokeAs(t, caller, "exportMyData", `{"user_id":"user-2"}`); errorCode(err) != "FORBIDDEN" {
+		t.Errorf("exporting another user error = %v, want FORBIDDEN", err)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Subscription plans. A user without a plan on their row is on defaultPlan.
+const (
+	planFree       = "free"
+	planPro        = "pro"
+	planEnterprise = "enterprise"
+
+	defaultPlan = planFree
+
+	// planCacheTTL is how long a plan read from the plans table is reused,
+	// so callAPI does not read it on every call.
+	planCacheTTL = 5 * time.Minute
+)
+
+var errPlanNotFound = errors.New("plan not found")
+
+// Plan sets what a user may consume each calendar month (UTC). Amounts
+// without a currency are in the user's wallet currency.
+type Plan struct {
+	PlanID string `json:"plan_id"`
+	Name   string `json:"name"`
+	// MonthlyCallQuota is the number of callAPI calls included each month.
+	MonthlyCallQuota int64 `json:"monthly_call_quota"`
+	// IncludedCredit is the usage each month that is not charged to the
+	// wallet.
+	IncludedCredit Money `json:"included_credit"`
+	// OveragePrice is charged on top of usage for every call beyond the
+	// quota. Plans without one refuse calls beyond the quota instead.
+	OveragePrice Money `json:"overage_price"`
+}
+
+func (p Plan) allowsOverage() bool {
+	return !p.OveragePrice.IsZero()
+}
+
+// inCurrency returns amount in the wallet currency. An amount without a
+// currency is taken to be in it; a plan or price in any other currency fails
+// with errCurrencyMismatch rather than billing the wrong amount.
+func inCurrency(amount Money, currency string) (Money, error) {
+	if amount.Currency != "" && amount.Currency != currency {
+		return Money{}, errCurrencyMismatch
+	}
+	return newMoney(amount.Micros, currency), nil
+}
+
+// defaultPlans are written to the plans table by the seed-plans command and
+// loaded into the in-memory store.
+var defaultPlans = []Plan{
+	{
+		PlanID:           planFree,
+		Name:             "Free",
+		MonthlyCallQuota: 1000,
+		IncludedCredit:   newMoney(1*microsPerUnit, ""),
+	},
+	{
+		PlanID:           planPro,
+		Name:             "Pro",
+		MonthlyCallQuota: 100000,
+		IncludedCredit:   newMoney(50*microsPerUnit, ""),
+		OveragePrice:     newMoney(1000, ""),
+	},
+	{
+		PlanID:           planEnterprise,
+		Name:             "Enterprise",
+		MonthlyCallQuota: 1000000,
+		IncludedCredit:   newMoney(500*microsPerUnit, ""),
+		OveragePrice:     newMoney(500, ""),
+	},
+}
+
+// planID returns the user's plan, or the default plan when none is set.
+func (u User) planID() string {
+	if u.Plan == "" {
+		return defaultPlan
+	}
+	return u.Plan
+}
+
+type cachedPlan struct {
+	plan     Plan
+	loadedAt time.Time
+}
+
+var planCache = struct {
+	sync.Mutex
+	plans map[string]cachedPlan
+}{plans: map[string]cachedPlan{}}
+
+// getPlan returns a plan from the plans table, cached for planCacheTTL. One
+// of the default plans missing from the table, as on a fresh deployment
+// before seed-plans has run, is served from defaultPlans.
+func getPlan(ctx context.Context, planID string) (Plan, error) {
+	now := time.Now()
+
+	planCache.Lock()
+	cached, ok := planCache.plans[planID]
+	planCache.Unlock()
+	if ok && now.Sub(cached.loadedAt) < planCacheTTL {
+		return cached.plan, nil
+	}
+
+	plan, err := planStore.GetPlan(ctx, planID)
+	if err == errPlanNotFound {
+		for _, fallback := range defaultPlans {
+			if fallback.PlanID == planID {
+				log.Printf("plan %s is not in the plans table, using the default", planID)
+				plan, err = fallback, nil
+			}
+		}
+	}
+	if err != nil {
+		return Plan{}, err
+	}
+
+	planCache.Lock()
+	planCache.plans[planID] = cachedPlan{plan: plan, loadedAt: now}
+	planCache.Unlock()
+	return plan, nil
+}
+
+// seedPlans writes every default plan missing from the plans table. Plans
+// already there are left alone, so edits made in the table survive.
+func seedPlans(ctx context.Context) (int, error) {
+	seeded := 0
+	for _, plan := range defaultPlans {
+		_, err := planStore.GetPlan(ctx, plan.PlanID)
+		if err == nil {
+			continue
+		}
+		if err != errPlanNotFound {
+			return seeded, fmt.Errorf("failed to get plan %s, %v", plan.PlanID, err)
+		}
+		err = planStore.PutPlan(ctx, plan)
+		if err != nil {
+			return seeded, fmt.Errorf("failed to put plan %s, %v", plan.PlanID, err)
+		}
+		seeded++
+	}
+	return seeded, nil
+}
+
+func setPlan(ctx context.Context, userID string, planID string) (string, error) {
+	_, err := getPlan(ctx, planID)
+	if err == errPlanNotFound {
+		return "", &ValidationError{Fields: []FieldError{{Field: "plan", Message: "is not a known plan"}}}
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get plan, %v", err)
+	}
+
+	err = userStore.SetPlan(ctx, userID, planID)
+	if err == errUserNotFound {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to set plan, %v", err)
+	}
+
+	return "Plan updated successfully", nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestGetPlanFallsBackToDefaults(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	empty := newMemoryStore()
+	empty.plans = map[string]Plan{}
+	planStore = empty
+
+	plan, err := getPlan(ctx, planPro)
+	if err != nil {
+		t.Fatalf("getPlan on an empty table failed, %v", err)
+	}
+	if plan.MonthlyCallQuota != 100000 {
+		t.Errorf("plan = %+v, want the default pro plan", plan)
+	}
+
+	if _, err := getPlan(ctx, "platinum"); err != errPlanNotFound {
+		t.Errorf("unknown plan error = %v, want %v", err, errPlanNotFound)
+	}
+}
+
+func TestGetPlanPrefersTable(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	custom := Plan{PlanID: planFree, Name: "Free", MonthlyCallQuota: 5}
+	if err := planStore.PutPlan(ctx, custom); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := getPlan(ctx, planFree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.MonthlyCallQuota != 5 {
+		t.Errorf("quota = %d, want the table's 5", plan.MonthlyCallQuota)
+	}
+}
+
+func TestSetPlan(t *testing.T) {
+	resetStores(t)
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com"}`)
+
+	mustInvoke(t, "setPlan", `{"user_id":"user-1","plan":"pro"}`)
+	if user := getTestUser(t, "user-1"); user.planID() != planPro {
+		t.Errorf("plan = %q, want pro", user.planID())
+	}
+
+	_, err := invoke(t, "setPlan", `{"user_id":"user-1","plan":"platinum"}`)
+	if errorCode(err) != "VALIDATION_ERROR" {
+		t.Errorf("unknown plan error = %v, want a validation error", err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Cognito groups created by CreateCognitoUserPool.
+const (
+	adminsGroup  = "admins"
+	supportGroup = "support"
+)
+
+// AccessRule is the group requirement for a single operation.
+type AccessRule struct {
+	// Group the caller must belong to in order to run the operation at all.
+	Group string `json:"group,omitempty"`
+	// OnBehalfGroup lets members act on a user_id other than their own.
+	// Without it a self-service operation is limited to the caller.
+	OnBehalfGroup string `json:"on_behalf_group,omitempty"`
+}
+
+// defaultAccessPolicy is the single place privileged operations are decided.
+// Operations that are not listed are open to any authenticated caller acting
+// on themselves. ACCESS_POLICY can override individual entries, e.g.
+// {"getUser":{"on_behalf_group":"admins"}}.
+var defaultAccessPolicy = map[string]AccessRule{
+	"updateWallet":             {Group: adminsGroup},
+	"addWallet":                {Group: adminsGroup},
+	"logTransaction":           {Group: adminsGroup},
+	"setCreditLimit":           {Group: adminsGroup},
+	"reverseTransaction":       {Group: adminsGroup},
+	"setPlan":                  {Group: adminsGroup},
+	"createUser":               {OnBehalfGroup: adminsGroup},
+	"generateApiKey":           {OnBehalfGroup: adminsGroup},
+	"revokeApiKey":             {OnBehalfGroup: adminsGroup},
+	"rotateApiKey":             {OnBehalfGroup: adminsGroup},
+	"setApiKeyExpiry":          {OnBehalfGroup: adminsGroup},
+	"deleteAccount":            {OnBehalfGroup: adminsGroup},
+	"getUser":                  {OnBehalfGroup: supportGroup},
+	"getApiKeyFromUser":        {OnBehalfGroup: supportGroup},
+	"listApiKeys":              {OnBehalfGroup: supportGroup},
+	"getTransactionHistory":    {OnBehalfGroup: supportGroup},
+	"exportTransactionHistory": {OnBehalfGroup: supportGroup},
+	"exportMyData":             {OnBehalfGroup: supportGroup},
+	"getUsage":                 {OnBehalfGroup: supportGroup},
+	"quote":                    {OnBehalfGroup: supportGroup},
+}
+
+// loadAccessPolicy returns the default policy with any ACCESS_POLICY
+// overrides applied.
+func loadAccessPolicy() (map[string]AccessRule, error) {
+	policy := map[string]AccessRule{}
+	for name, rule := range defaultAccessPolicy {
+		policy[name] = rule
+	}
+
+	overrides := os.Getenv("ACCESS_POLICY")
+	if overrides == "" {
+		return policy, nil
+	}
+
+	rules := map[string]AccessRule{}
+	err := json.Unmarshal([]byte(overrides), &rules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ACCESS_POLICY, %v", err)
+	}
+	for name, rule := range rules {
+		policy[name] = rule
+	}
+	return policy, nil
+}
+
+// applyAccessPolicy copies the policy onto the registered operations so the
+// auth middleware and resolveUserID can enforce it.
+func applyAccessPolicy(r *Registry, policy map[string]AccessRule) error {
+	for name, rule := range policy {
+		op, ok := r.Operation(name)
+		if !ok {
+			return fmt.Errorf("access policy names unknown operation %q", name)
+		}
+		op.RequiredRole = rule.Group
+		op.OnBehalfRole = rule.OnBehalfGroup
+	}
+	return nil
+}
+
+// hasRole reports whether the caller satisfies a group requirement. Admins
+// satisfy every requirement.
+func hasRole(identity Identity, role string) bool {
+	return role == "" || identity.HasGroup(role) || identity.HasGroup(adminsGroup)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAdminOnlyOperations(t *testing.T) {
+	resetStores(t)
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com"}`)
+	request := `{"user_id":"user-1","credit_limit":{"amount":"5","currency":"USD"}}`
+
+	member := &RequestIdentity{Sub: "user-1", Groups: "[support]"}
+	if _, err := invokeAs(t, member, "setCreditLimit", request); errorCode(err) != "FORBIDDEN" {
+		t.Errorf("support error = %v, want FORBIDDEN", err)
+	}
+
+	admin := &RequestIdentity{Sub: "admin-1", Groups: "[admins]"}
+	if _, err := invokeAs(t, admin, "setCreditLimit", request); err != nil {
+		t.Errorf("admin setCreditLimit failed, %v", err)
+	}
+	if user := getTestUser(t, "user-1"); user.CreditLimit != newMoney(5000000, "USD") {
+		t.Errorf("credit limit = %v, want 5", user.CreditLimit)
+	}
+}
+
+func TestSupportActsOnBehalf(t *testing.T) {
+	resetStores(t)
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com"}`)
+
+	support := &RequestIdentity{Sub: "support-1", Groups: "support"}
+	if _, err := invokeAs(t, support, "getUser", `{"user_id":"user-1"}`); err != nil {
+		t.Errorf("support getUser failed, %v", err)
+	}
+	// Reading is not managing
+	if _, err := invokeAs(t, support, "generateApiKey", `{"user_id":"user-1"}`); errorCode(err) != "FORBIDDEN" {
+		t.Errorf("support generateApiKey error = %v, want FORBIDDEN", err)
+	}
+}
+
+func TestAccessPolicyOverrides(t *testing.T) {
+	t.Setenv("ACCESS_POLICY", `{"getUser":{"on_behalf_group":"admins"}}`)
+	policy, err := loadAccessPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule := policy["getUser"]; rule.OnBehalfGroup != adminsGroup {
+		t.Errorf("getUser rule = %+v, want the override", rule)
+	}
+	if rule := policy["setPlan"]; rule.Group != adminsGroup {
+		t.Errorf("setPlan rule = %+v, want the default", rule)
+	}
+
+}
+
+func TestApplyAccessPolicyRejectsUnknownOperations(t *testing.T) {
+	r := newRegistry()
+	r.Register(Operation{Name: "getUser"})
+
+	if err := applyAccessPolicy(r, map[string]AccessRule{"getUser": {Group: adminsGroup}}); err != nil {
+		t.Fatal(err)
+	}
+	if op, _ := r.Operation("getUser"); op.RequiredRole != adminsGroup {
+		t.Errorf("required role = %q, want admins", op.RequiredRole)
+	}
+	if err := applyAccessPolicy(r, map[string]AccessRule{"noSuchOperation": {Group: adminsGroup}}); err == nil {
+		t.Error("a policy naming an unknown operation was accepted")
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// priceCacheTTL is how long a price table read from DynamoDB is reused. Price
+// changes reach every Lambda instance within this time.
+const priceCacheTTL = time.Minute
+
+var errPriceNotFound = errors.New("price not found")
+
+// MeteredCall describes one metered operation to be priced.
+type MeteredCall struct {
+	Operation string
+	Plan      string
+	// Currency is the wallet currency the price is charged in.
+	Currency string
+	Duration time.Duration
+	// At is when the call started, for time-of-day rules.
+	At time.Time
+}
+
+// Price is the cost of a metered call and how it was arrived at. Total is
+// the sum of the other amounts.
+type Price struct {
+	BaseFee        Money `json:"base_fee"`
+	DurationCharge Money `json:"duration_charge"`
+	// TimeOfDayAdjustment and PlanDiscount are negative when they lower
+	// the price.
+	TimeOfDayAdjustment Money `json:"time_of_day_adjustment"`
+	PlanDiscount        Money `json:"plan_discount"`
+	Total               Money `json:"total"`
+}
+
+// PricingEngine computes what metered operations cost.
+type PricingEngine interface {
+	Price(ctx context.Context, call MeteredCall) (Price, error)
+}
+
+var pricingEngine PricingEngine
+
+// PriceTable prices one metered operation. Amounts without a currency are in
+// the wallet currency.
+type PriceTable struct {
+	Operation string `json:"operation"`
+	BaseFee   Money  `json:"base_fee"`
+	// PerSecond is charged for the measured duration, prorated to the
+	// millisecond.
+	PerSecond Money `json:"per_second"`
+	// PlanDiscounts are percentages taken off the price on each plan.
+	PlanDiscounts map[string]int64 `json:"plan_discounts,omitempty"`
+	// TimeOfDayRules scale the price at certain hours; the first rule
+	// matching the call's start time applies.
+	TimeOfDayRules []TimeOfDayRule `json:"time_of_day_rules,omitempty"`
+}
+
+// TimeOfDayRule scales the price by MultiplierPercent for calls starting
+// from StartHour up to, but not including, EndHour, in UTC. A rule whose end
+// is before its start wraps past midnight.
+type TimeOfDayRule struct {
+	StartHour         int   `json:"start_hour"`
+	EndHour           int   `json:"end_hour"`
+	MultiplierPercent int64 `json:"multiplier_percent"`
+}
+
+func (r TimeOfDayRule) matches(at time.Time) bool {
+	hour := at.UTC().Hour()
+	if r.StartHour <= r.EndHour {
+		return hour >= r.StartHour && hour < r.EndHour
+	}
+	return hour >= r.StartHour || hour < r.EndHour
+}
+
+// validate rejects tables that would price calls nonsensically, so a bad
+// edit fails calls loudly instead of charging the wrong amount.
+func (t PriceTable) validate() error {
+	if t.BaseFee.IsNegative() || t.PerSecond.IsNegative() {
+		return fmt.Errorf("price for %s must not be negative", t.Operation)
+	}
+	for plan, percent := range t.PlanDiscounts {
+		if percent < 0 || percent > 100 {
+			return fmt.Errorf("price for %s has a %s discount outside 0-100%%", t.Operation, plan)
+		}
+	}
+	for _, rule := range t.TimeOfDayRules {
+		if rule.StartHour < 0 || rule.StartHour > 23 || rule.EndHour < 0 || rule.EndHour > 24 {
+			return fmt.Errorf("price for %s has a time of day rule outside 0-24h", t.Operation)
+		}
+		if rule.MultiplierPercent < 0 {
+			return fmt.Errorf("price for %s has a negative time of day multiplier", t.Operation)
+		}
+	}
+	return nil
+}
+
+// price applies the table: the base fee and duration charge, then the
+// time-of-day rule, then the plan discount.
+func (t PriceTable) price(call MeteredCall) (Price, error) {
+	baseFee, err := inCurrency(t.BaseFee, call.Currency)
+	if err != nil {
+		return Price{}, err
+	}
+	perSecond, err := inCurrency(t.PerSecond, call.Currency)
+	if err != nil {
+		return Price{}, err
+	}
+	price := Price{
+		BaseFee:             baseFee,
+		TimeOfDayAdjustment: newMoney(0, call.Currency),
+	}
+	price.DurationCharge, err = perSecond.MulRatio(call.Duration.Milliseconds(), 1000)
+	if err != nil {
+		return Price{}, err
+	}
+	subtotal, err := price.BaseFee.Add(price.DurationCharge)
+	if err != nil {
+		return Price{}, err
+	}
+
+	for _, rule := range t.TimeOfDayRules {
+		if rule.matches(call.At) {
+			price.TimeOfDayAdjustment, err = subtotal.MulRatio(rule.MultiplierPercent-100, 100)
+			if err != nil {
+				return Price{}, err
+			}
+			break
+		}
+	}
+	subtotal, err = subtotal.Add(price.TimeOfDayAdjustment)
+	if err != nil {
+		return Price{}, err
+	}
+
+	price.PlanDiscount, err = subtotal.MulRatio(-t.PlanDiscounts[call.Plan], 100)
+	if err != nil {
+		return Price{}, err
+	}
+	price.Total, err = subtotal.Add(price.PlanDiscount)
+	if err != nil {
+		return Price{}, err
+	}
+	return price, nil
+}
+
+// defaultPriceTables are written to the prices table by the seed-prices
+// command and loaded into the in-memory store. callAPI costs one unit per
+// second.
+var defaultPriceTables = []PriceTable{
+	{
+		Operation: "callAPI",
+		BaseFee:   newMoney(0, ""),
+		PerSecond: newMoney(microsPerUnit, ""),
+	},
+}
+
+// tablePricingEngine prices calls from the price tables in a PriceStore,
+// so prices can change without redeploying the Lambda.
+type tablePricingEngine struct {
+	store PriceStore
+
+	mu     sync.Mutex
+	tables map[string]cachedPriceTable
+}
+
+type cachedPriceTable struct {
+	table    PriceTable
+	loadedAt time.Time
+}
+
+func newTablePricingEngine(store PriceStore) *tablePricingEngine {
+	return &tablePricingEngine{
+		store:  store,
+		tables: map[string]cachedPriceTable{},
+	}
+}
+
+func (e *tablePricingEngine) Price(ctx context.Context, call MeteredCall) (Price, error) {
+	table, err := e.priceTable(ctx, call.Operation)
+	if err != nil {
+		return Price{}, err
+	}
+	price, err := table.price(call)
+	if err == errCurrencyMismatch {
+		return Price{}, err
+	}
+	if err != nil {
+		return Price{}, fmt.Errorf("failed to apply price for %s, %v", call.Operation, err)
+	}
+	return price, nil
+}
+
+// priceTable returns the operation's price table, cached for priceCacheTTL.
+// A default table missing from the prices table, as on a fresh deployment
+// before seed-prices has run, is served from defaultPriceTables.
+func (e *tablePricingEngine) priceTable(ctx context.Context, operation string) (PriceTable, error) {
+	now := time.Now()
+
+	e.mu.Lock()
+	cached, ok := e.tables[operation]
+	e.mu.Unlock()
+	if ok && now.Sub(cached.loadedAt) < priceCacheTTL {
+		return cached.table, nil
+	}
+
+	table, err := e.store.GetPriceTable(ctx, operation)
+	if err == errPriceNotFound {
+		for _, fallback := range defaultPriceTables {
+			if fallback.Operation == operation {
+				log.Printf("no price for %s in the prices table, using the default", operation)
+				table, err = fallback, nil
+			}
+		}
+	}
+	if err != nil {
+		return PriceTable{}, err
+	}
+	err = table.validate()
+	if err != nil {
+		return PriceTable{}, err
+	}
+
+	e.mu.Lock()
+	e.tables[operation] = cachedPriceTable{table: table, loadedAt: now}
+	e.mu.Unlock()
+	return table, nil
+}
+
+// seedPriceTables writes every default price table missing from the prices
+// table, leaving prices finance has already set alone.
+func seedPriceTables(ctx context.Context) (int, error) {
+	seeded := 0
+	for _, table := range defaultPriceTables {
+		_, err := priceStore.GetPriceTable(ctx, table.Operation)
+		if err == nil {
+			continue
+		}
+		if err != errPriceNotFound {
+			return seeded, fmt.Errorf("failed to get price for %s, %v", table.Operation, err)
+		}
+		err = priceStore.PutPriceTable(ctx, table)
+		if err != nil {
+			return seeded, fmt.Errorf("failed to put price for %s, %v", table.Operation, err)
+		}
+		seeded++
+	}
+	return seeded, nil
+}
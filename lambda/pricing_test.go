@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPriceTableAppliesRulesInOrder(t *testing.T) {
+	table := PriceTable{
+		Operation:      "callAPI",
+		BaseFee:        newMoney(100000, ""),
+		PerSecond:      newMoney(1000000, ""),
+		PlanDiscounts:  map[string]int64{planPro: 10},
+		TimeOfDayRules: []TimeOfDayRule{{StartHour: 22, EndHour: 6, MultiplierPercent: 150}},
+	}
+	night := time.Date(2026, 1, 1, 23, 0, 0, 0, time.UTC)
+	day := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		plan  string
+		at    time.Time
+		total int64
+	}{
+		// 0.1 base + 0.5 for 500ms
+		{planFree, day, 600000},
+		// 0.6 * 150%
+		{planFree, night, 900000},
+		// 0.6 * 150% - 10%
+		{planPro, night, 810000},
+	}
+	for _, test := range tests {
+		price, err := table.price(MeteredCall{Operation: "callAPI", Plan: test.plan, Currency: "USD", Duration: 500 * time.Millisecond, At: test.at})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if price.Total != newMoney(test.total, "USD") {
+			t.Errorf("%s at %s: total = %v, want %d micros", test.plan, test.at.Format("15:04"), price.Total, test.total)
+		}
+		sum := price.BaseFee.Micros + price.DurationCharge.Micros + price.TimeOfDayAdjustment.Micros + price.PlanDiscount.Micros
+		if sum != price.Total.Micros {
+			t.Errorf("%s at %s: parts add up to %v, not the total %v", test.plan, test.at.Format("15:04"), sum, price.Total)
+		}
+	}
+}
+
+func TestPriceTableValidate(t *testing.T) {
+	invalid := []PriceTable{
+		{Operation: "callAPI", PerSecond: newMoney(-1, "")},
+		{Operation: "callAPI", PlanDiscounts: map[string]int64{planPro: 101}},
+		{Operation: "callAPI", TimeOfDayRules: []TimeOfDayRule{{StartHour: 0, EndHour: 25, MultiplierPercent: 100}}},
+		{Operation: "callAPI", TimeOfDayRules: []TimeOfDayRule{{StartHour: 0, EndHour: 1, MultiplierPercent: -1}}},
+	}
+	for _, table := range invalid {
+		if err := table.validate(); err == nil {
+			t.Errorf("table %+v passed validation", table)
+		}
+	}
+	if err := defaultPriceTables[0].validate(); err != nil {
+		t.Errorf("default price table is invalid, %v", err)
+	}
+}
+
+func TestPricingFallsBackToDefaultTables(t *testing.T) {
+	resetStores(t)
+	empty := newMemoryStore()
+	empty.prices = map[string]PriceTable{}
+	engine := newTablePricingEngine(empty)
+
+	price, err := engine.Price(context.Background(), MeteredCall{Operation: "callAPI", Plan: planFree, Currency: "USD", Duration: 2 * time.Second})
+	if err != nil {
+		t.Fatalf("Price on an empty table failed, %v", err)
+	}
+	if price.Total != newMoney(2000000, "USD") {
+		t.Errorf("total = %v, want the default 2", price.Total)
+	}
+
+	if _, err := engine.Price(context.Background(), MeteredCall{Operation: "unknown", Currency: "USD"}); err != errPriceNotFound {
+		t.Errorf("unknown operation error = %v, want %v", err, errPriceNotFound)
+	}
+}
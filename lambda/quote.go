@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// meteredOperations are the operations quote can price.
+var meteredOperations = []string{"callAPI"}
+
+// Quote is what an operation would do to a wallet, worked out with the same
+// validation and pricing as the operation but without writing anything. It
+// is returned by quote and by requests made with dry_run.
+type Quote struct {
+	Operation string `json:"operation"`
+	UserID    string `json:"user_id"`
+	// Amount is the signed wallet movement; charges are negative.
+	Amount Money `json:"amount"`
+	// Price, IncludedCreditApplied and OverageCharge explain the charge of
+	// a metered operation.
+	Price                 *Price `json:"price,omitempty"`
+	IncludedCreditApplied *Money `json:"included_credit_applied,omitempty"`
+	OverageCharge         *Money `json:"overage_charge,omitempty"`
+	Balance               Money  `json:"balance"`
+	ProjectedBalance      Money  `json:"projected_balance"`
+	// Covered reports whether the balance and credit limit cover the
+	// movement.
+	Covered bool `json:"covered"`
+}
+
+func newQuote(operation string, user User, amount Money) (Quote, error) {
+	projected, err := user.WalletAmount.Add(amount)
+	if err != nil {
+		return Quote{}, err
+	}
+	available, err := user.available()
+	if err != nil {
+		return Quote{}, err
+	}
+	short, err := available.LessThan(amount.Neg())
+	if err != nil {
+		return Quote{}, err
+	}
+	return Quote{
+		Operation:        operation,
+		UserID:           user.UserID,
+		Amount:           amount,
+		Balance:          user.WalletAmount,
+		ProjectedBalance: projected,
+		Covered:          !amount.IsNegative() || !short,
+	}, nil
+}
+
+func marshalQuote(quote Quote) (string, error) {
+	quoteJson, err := json.Marshal(quote)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal quote JSON, %v", err)
+	}
+	return string(quoteJson), nil
+}
+
+// quoteWalletEntry is the dry run of moving amount into the user's wallet.
+func quoteWalletEntry(ctx context.Context, operation string, userID string, amount Money) (string, error) {
+	user, err := userStore.GetUser(ctx, userID)
+	if err == errUserNotFound {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get user, %v", err)
+	}
+
+	amount, err = inWalletCurrency(user, "amount", amount)
+	if err != nil {
+		return "", err
+	}
+
+	quote, err := newQuote(operation, user, amount)
+	if err != nil {
+		return "", err
+	}
+	return marshalQuote(quote)
+}
+
+// quoteCall prices a callAPI call of the given duration for the user as it
+// would be charged now, reading the period's usage without counting the
+// call. A call the plan's quota would refuse fails as it would for real.
+func quoteCall(ctx context.Context, user User, plan Plan, duration time.Duration, now time.Time) (Quote, error) {
+	currency := user.WalletAmount.Currency
+	price, err := pricingEngine.Price(ctx, MeteredCall{
+		Operation: "callAPI",
+		Plan:      plan.PlanID,
+		Currency:  currency,
+		Duration:  duration,
+		At:        now,
+	})
+	if isCallerError(err) {
+		return Quote{}, err
+	}
+	if err != nil {
+		return Quote{}, fmt.Errorf("failed to price call, %v", err)
+	}
+
+	period := usagePeriod(now)
+	usage, err := usageStore.GetUsage(ctx, user.UserID, period)
+	if err != nil {
+		return Quote{}, fmt.Errorf("failed to get usage, %v", err)
+	}
+
+	overage := newMoney(0, currency)
+	if usage.Calls >= plan.MonthlyCallQuota {
+		if !plan.allowsOverage() {
+			end, _ := usagePeriodEnd(period)
+			return Quote{}, errQuotaExceeded(plan, end.Sub(now))
+		}
+		overage, err = inCurrency(plan.OveragePrice, currency)
+		if err != nil {
+			return Quote{}, err
+		}
+	}
+
+	credit, err := inCurrency(plan.IncludedCredit, currency)
+	if err != nil {
+		return Quote{}, err
+	}
+	used, err := inCurrency(usage.Cost, currency)
+	if err != nil {
+		return Quote{}, err
+	}
+	charge, err := uncoveredCost(credit, used, price.Total)
+	if err != nil {
+		return Quote{}, err
+	}
+	applied, err := price.Total.Sub(charge)
+	if err != nil {
+		return Quote{}, err
+	}
+	total, err := charge.Add(overage)
+	if err != nil {
+		return Quote{}, err
+	}
+
+	quote, err := newQuote("callAPI", user, total.Neg())
+	if err != nil {
+		return Quote{}, err
+	}
+	quote.Price = &price
+	quote.IncludedCreditApplied = &applied
+	quote.OverageCharge = &overage
+	return quote, nil
+}
+
+// quote prices a metered operation for the user before they make it.
+func quote(ctx context.Context, userID string, operation string, duration time.Duration) (string, error) {
+	user, err := userStore.GetUser(ctx, userID)
+	if err == errUserNotFound {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get user, %v", err)
+	}
+
+	plan, err := getPlan(ctx, user.planID())
+	if err != nil {
+		return "", fmt.Errorf("failed to get plan, %v", err)
+	}
+
+	result, err := quoteCall(ctx, user, plan, duration, time.Now())
+	if err != nil {
+		return "", err
+	}
+	return marshalQuote(result)
+}
+
+// isDryRun peeks at the payload's dry_run flag, for middleware that runs
+// before the payload is decoded.
+func isDryRun(payload json.RawMessage) bool {
+	flag := struct {
+		DryRun bool `json:"dry_run"`
+	}{}
+	return json.Unmarshal(payload, &flag) == nil && flag.DryRun
+}
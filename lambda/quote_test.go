@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func decodeQuote(t *testing.T, result string) Quote {
+	t.Helper()
+	quote := Quote{}
+	if err := json.Unmarshal([]byte(result), &quote); err != nil {
+		t.Fatalf("quote is not valid JSON %q, %v", result, err)
+	}
+	return quote
+}
+
+func TestDryRunChangesNothing(t *testing.T) {
+	resetStores(t)
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com","wallet_amount":{"amount":"5","currency":"USD"}}`)
+
+	quote := decodeQuote(t, mustInvoke(t, "updateWallet", `{"user_id":"user-1","amount":{"amount":"-8","currency":"USD"},"dry_run":true}`))
+	if quote.ProjectedBalance != newMoney(-3000000, "USD") || quote.Covered {
+		t.Errorf("quote = %+v, want an uncovered balance of -3", quote)
+	}
+	if user := getTestUser(t, "user-1"); user.WalletAmount != newMoney(5000000, "USD") {
+		t.Errorf("wallet = %v, the dry run moved money", user.WalletAmount)
+	}
+	page, err := ledgerStore.ListTransactions(context.Background(), TransactionQuery{UserID: "user-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Transactions) != 1 {
+		t.Errorf("%d transactions, the dry run wrote one", len(page.Transactions))
+	}
+}
+
+func TestQuoteCallDoesNotCountIt(t *testing.T) {
+	resetStores(t)
+	apiKey := newCallingUser(t)
+
+	quote := decodeQuote(t, mustInvoke(t, "quote", `{"user_id":"user-1","operation":"callAPI","duration_ms":500}`))
+	// Half a second at one unit a second, inside the plan's included credit
+	if quote.Price == nil || quote.Price.Total != newMoney(500000, "USD") {
+		t.Fatalf("quote = %+v, want a price of 0.5", quote)
+	}
+	if quote.IncludedCreditApplied == nil || *quote.IncludedCreditApplied != quote.Price.Total || !quote.Amount.IsZero() {
+		t.Errorf("quote = %+v, want the included credit to cover the call", quote)
+	}
+	if usage := currentUsage(t); usage.Calls != 0 {
+		t.Errorf("calls = %d, the quote used up quota", usage.Calls)
+	}
+
+	// callAPI's own dry run neither counts nor charges
+	before := getTestUser(t, "user-1").WalletAmount
+	if _, err := callAPI(context.Background(), apiKey, true); err != nil {
+		t.Fatalf("dry run callAPI failed, %v", err)
+	}
+	if usage := currentUsage(t); usage.Calls != 0 {
+		t.Errorf("calls = %d after a dry run", usage.Calls)
+	}
+	if after := getTestUser(t, "user-1").WalletAmount; after != before {
+		t.Errorf("wallet went from %v to %v on a dry run", before, after)
+	}
+}
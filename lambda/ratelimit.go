@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// RateLimit allows Requests calls per Period on average, with up to Burst
+// calls at once.
+type RateLimit struct {
+	Requests      int `json:"requests"`
+	PeriodSeconds int `json:"period_seconds"`
+	Burst         int `json:"burst"`
+}
+
+// defaultRateLimits holds the limits per plan. RATE_LIMITS can override
+// individual plans, e.g. {"pro":{"requests":1200,"period_seconds":60,"burst":100}}.
+var defaultRateLimits = map[string]RateLimit{
+	planFree:       {Requests: 60, PeriodSeconds: 60, Burst: 10},
+	planPro:        {Requests: 600, PeriodSeconds: 60, Burst: 50},
+	planEnterprise: {Requests: 3000, PeriodSeconds: 60, Burst: 200},
+}
+
+var rateLimits map[string]RateLimit
+
+func init() {
+	var err error
+	rateLimits, err = loadRateLimits()
+	if err != nil {
+		log.Fatalf("unable to load rate limits, %v", err)
+	}
+}
+
+// loadRateLimits returns the default limits with any RATE_LIMITS overrides
+// applied.
+func loadRateLimits() (map[string]RateLimit, error) {
+	limits := map[string]RateLimit{}
+	for plan, limit := range defaultRateLimits {
+		limits[plan] = limit
+	}
+
+	overrides := os.Getenv("RATE_LIMITS")
+	if overrides == "" {
+		return limits, nil
+	}
+
+	custom := map[string]RateLimit{}
+	err := json.Unmarshal([]byte(overrides), &custom)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RATE_LIMITS, %v", err)
+	}
+	for plan, limit := range custom {
+		if limit.Requests < 1 || limit.PeriodSeconds < 1 || limit.Burst < 1 {
+			return nil, fmt.Errorf("invalid RATE_LIMITS, %s needs positive requests, period_seconds and burst", plan)
+		}
+		limits[plan] = limit
+	}
+	return limits, nil
+}
+
+// rateLimitFor returns the limit of the given plan, falling back to the
+// default plan.
+func rateLimitFor(plan string) RateLimit {
+	if limit, ok := rateLimits[plan]; ok {
+		return limit
+	}
+	return rateLimits[defaultPlan]
+}
+
+// interval is the time one request uses up.
+func (l RateLimit) interval() time.Duration {
+	return time.Duration(l.PeriodSeconds) * time.Second / time.Duration(l.Requests)
+}
+
+// allow applies the generic cell rate algorithm, a token bucket that needs
+// a single timestamp of state: the theoretical arrival time (TAT) of the
+// next request. A request is allowed while the TAT is no more than Burst
+// intervals ahead of now; each allowed request pushes it one interval on.
+// It returns the new TAT, or how long to wait when the request is refused.
+func (l RateLimit) allow(tat time.Time, now time.Time) (time.Time, bool, time.Duration) {
+	interval := l.interval()
+	if tat.Before(now) {
+		tat = now
+	}
+	next := tat.Add(interval)
+	earliest := next.Add(-interval * time.Duration(l.Burst))
+	if now.Before(earliest) {
+		return tat, false, earliest.Sub(now)
+	}
+	return next, true, 0
+}
+
+// errRateLimited tells the caller to slow down and when to try again.
+func errRateLimited(retryAfter time.Duration) error {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	return &OperationError{
+		Code:              "RATE_LIMITED",
+		Message:           fmt.Sprintf("rate limit exceeded, retry after %d seconds", seconds),
+		RetryAfterSeconds: seconds,
+	}
+}
+
+// checkRateLimit takes one request from the limiter identified by key.
+func checkRateLimit(ctx context.Context, key string, limit RateLimit) error {
+	allowed, retryAfter, err := rateLimitStore.TakeRateLimit(ctx, key, limit, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to check rate limit, %v", err)
+	}
+	if !allowed {
+		return errRateLimited(retryAfter)
+	}
+	return nil
+}
+
+func apiKeyRateLimitKey(keyID string) string {
+	return "api_key#" + keyID
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimitAllowsBurstThenRate(t *testing.T) {
+	limit := RateLimit{Requests: 60, PeriodSeconds: 60, Burst: 3}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tat := time.Time{}
+	for i := 0; i < limit.Burst; i++ {
+		var allowed bool
+		tat, allowed, _ = limit.allow(tat, now)
+		if !allowed {
+			t.Fatalf("request %d of the burst refused", i+1)
+		}
+	}
+	tat, allowed, retryAfter := limit.allow(tat, now)
+	if allowed {
+		t.Fatal("request beyond the burst allowed")
+	}
+	if retryAfter != time.Second {
+		t.Errorf("retry after %v, want 1s", retryAfter)
+	}
+
+	// One interval later there is room for exactly one more
+	later := now.Add(time.Second)
+	tat, allowed, _ = limit.allow(tat, later)
+	if !allowed {
+		t.Error("request after an interval refused")
+	}
+	if _, allowed, _ = limit.allow(tat, later); allowed {
+		t.Error("second request after one interval allowed")
+	}
+}
+
+func TestCheckRateLimitReturnsRetryAfter(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	limit := RateLimit{Requests: 1, PeriodSeconds: 90, Burst: 1}
+
+	if err := checkRateLimit(ctx, apiKeyRateLimitKey("abc"), limit); err != nil {
+		t.Fatalf("first request refused, %v", err)
+	}
+	err := checkRateLimit(ctx, apiKeyRateLimitKey("abc"), limit)
+	operationErr, ok := err.(*OperationError)
+	if !ok || operationErr.Code != "RATE_LIMITED" {
+		t.Fatalf("error = %v, want RATE_LIMITED", err)
+	}
+	if operationErr.RetryAfterSeconds < 89 || operationErr.RetryAfterSeconds > 90 {
+		t.Errorf("retry after %d seconds, want 90", operationErr.RetryAfterSeconds)
+	}
+	// Each key has its own bucket
+	if err := checkRateLimit(ctx, apiKeyRateLimitKey("def"), limit); err != nil {
+		t.Errorf("another key was limited, %v", err)
+	}
+}
+
+func TestLoadRateLimitsOverrides(t *testing.T) {
+	t.Setenv("RATE_LIMITS", `{"pro":{"requests":1200,"period_seconds":60,"burst":100}}`)
+	limits, err := loadRateLimits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits[planPro].Requests != 1200 || limits[planFree] != defaultRateLimits[planFree] {
+		t.Errorf("limits = %+v", limits)
+	}
+
+	t.Setenv("RATE_LIMITS", `{"pro":{"requests":0,"period_seconds":60,"burst":100}}`)
+	if _, err := loadRateLimits(); err == nil {
+		t.Error("a limit of zero requests was accepted")
+	}
+}
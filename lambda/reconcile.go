@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	reconcilePageSize = 100
+	// reconcileAttempts is how many times a user is re-read when their
+	// wallet changes while the ledger is being summed.
+	reconcileAttempts = 3
+)
+
+// ReconcileRequest is the event the scheduled reconciliation Lambda
+// receives.
+type ReconcileRequest struct {
+	// Fix posts a correcting ledger entry for every drifted user.
+	Fix bool `json:"fix"`
+}
+
+// WalletDrift is a user whose wallet does not match their ledger.
+type WalletDrift struct {
+	UserID string `json:"user_id"`
+	Wallet Money  `json:"wallet"`
+	Ledger Money  `json:"ledger"`
+	Drift  Money  `json:"drift"`
+	// Corrected is set once a reconciliation entry has been posted.
+	Corrected bool   `json:"corrected"`
+	Error     string `json:"error,omitempty"`
+}
+
+// WalletError is a user whose wallet could not be checked.
+type WalletError struct {
+	UserID string `json:"user_id"`
+	Error  string `json:"error"`
+}
+
+// ReconcileReport is the outcome of one reconciliation run.
+type ReconcileReport struct {
+	StartedAt    time.Time     `json:"started_at"`
+	FinishedAt   time.Time     `json:"finished_at"`
+	Fix          bool          `json:"fix"`
+	UsersChecked int           `json:"users_checked"`
+	Drifted      []WalletDrift `json:"drifted"`
+	Errors       []WalletError `json:"errors"`
+}
+
+// affectsWallet reports whether a transaction type is part of the wallet
+// balance. Manual entries from logTransaction are recorded for reference
+// only and never moved the wallet.
+func affectsWallet(transactionType string) bool {
+	return transactionType != transactionTypeManual
+}
+
+// reconcileWallets recomputes every user's balance from their ledger and
+// compares it with wallet_amount. With fix set, drift is settled by
+// recording a reconciliation entry against the suspense account, so the
+// wallet stays the source of truth for what the user can spend.
+//
+// A user that cannot be checked is listed in the report's errors and the
+// run carries on; only failing to list the users stops it.
+func reconcileWallets(ctx context.Context, fix bool) (ReconcileReport, error) {
+	report := ReconcileReport{
+		StartedAt: time.Now().UTC(),
+		Fix:       fix,
+		Drifted:   []WalletDrift{},
+		Errors:    []WalletError{},
+	}
+
+	after := ""
+	for {
+		users, next, err := userStore.ListUsers(ctx, after, reconcilePageSize)
+		if err != nil {
+			return report, fmt.Errorf("failed to list users, %v", err)
+		}
+
+		for _, user := range users {
+			// A deletion part way through closes the wallet itself
+			if user.Status == accountStatusDeleting {
+				continue
+			}
+			drift, err := reconcileWallet(ctx, user, fix)
+			if err != nil {
+				log.Printf("failed to reconcile wallet, user_id=%s, %v", user.UserID, err)
+				report.Errors = append(report.Errors, WalletError{UserID: user.UserID, Error: err.Error()})
+				continue
+			}
+			report.UsersChecked++
+			if drift != nil {
+				report.Drifted = append(report.Drifted, *drift)
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		after = next
+	}
+
+	report.FinishedAt = time.Now().UTC()
+	return report, nil
+}
+
+// reconcileWallet checks one user. Wallet changes and their ledger entries
+// are written together, so the ledger sum is only trusted when the wallet is
+// unchanged from before the sum to after it.
+func reconcileWallet(ctx context.Context, user User, fix bool) (*WalletDrift, error) {
+	for attempt := 0; attempt < reconcileAttempts; attempt++ {
+		ledger, err := ledgerBalance(ctx, user.UserID, user.WalletAmount.Currency)
+		if err != nil {
+			return nil, err
+		}
+
+		current, err := userStore.GetUser(ctx, user.UserID)
+		if err == errUserNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get user, %v", err)
+		}
+		if current.WalletAmount != user.WalletAmount {
+			user = current
+			continue
+		}
+
+		if ledger == user.WalletAmount {
+			return nil, nil
+		}
+
+		difference, err := user.WalletAmount.Sub(ledger)
+		if err != nil {
+			return nil, err
+		}
+		drift := &WalletDrift{
+			UserID: user.UserID,
+			Wallet: user.WalletAmount,
+			Ledger: ledger,
+			Drift:  difference,
+		}
+		if fix {
+			err = recordWalletEntry(ctx, user.UserID, drift.Drift, accountSuspense, transactionTypeReconciliation, "reconciliation adjustment")
+			if err != nil {
+				drift.Error = err.Error()
+			} else {
+				drift.Corrected = true
+			}
+		}
+		return drift, nil
+	}
+
+	// The wallet kept moving; report it without correcting anything.
+	return &WalletDrift{
+		UserID: user.UserID,
+		Wallet: user.WalletAmount,
+		Error:  "wallet changed during every attempt",
+	}, nil
+}
+
+// ledgerBalance sums every wallet-affecting transaction of the user.
+func ledgerBalance(ctx context.Context, userID string, currency string) (Money, error) {
+	balance := newMoney(0, currency)
+	query := TransactionQuery{UserID: userID, Limit: maxTransactionPageSize}
+	for {
+		page, err := ledgerStore.ListTransactions(ctx, query)
+		if err != nil {
+			return Money{}, fmt.Errorf("failed to query transactions, %v", err)
+		}
+		for _, transaction := range page.Transactions {
+			if !affectsWallet(transaction.Type) {
+				continue
+			}
+			if !balance.sameCurrency(transaction.Amount) {
+				return Money{}, fmt.Errorf("transaction %s is in %s, not the wallet currency %s", transaction.TransactionID, transaction.Amount.Currency, currency)
+			}
+			balance, err = balance.Add(transaction.Amount)
+			if err != nil {
+				return Money{}, fmt.Errorf("transaction %s, %v", transaction.TransactionID, err)
+			}
+		}
+		if page.Next == "" {
+			return balance, nil
+		}
+		query.After = page.Next
+	}
+}
+
+// reconcileHandler is the entry point of the scheduled reconciliation
+// Lambda. The report is stored next to the exports.
+func reconcileHandler(ctx context.Context, request ReconcileRequest) (string, error) {
+	report, err := reconcileWallets(ctx, request.Fix)
+	if err != nil {
+		return "", err
+	}
+
+	reportJson, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal reconciliation report, %v", err)
+	}
+
+	key := fmt.Sprintf("reconciliation/%s.json", report.StartedAt.Format("2006-01-02T15-04-05Z"))
+	err = objectStore.PutObject(ctx, key, "application/json", bytes.NewReader(reportJson))
+	if err != nil {
+		return "", fmt.Errorf("failed to write reconciliation report, %v", err)
+	}
+
+	log.Printf("reconciliation users_checked=%d drifted=%d errors=%d report=%s", report.UsersChecked, len(report.Drifted), len(report.Errors), key)
+	return key, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// failingLedgerStore fails to list the transactions of one user.
+type failingLedgerStore struct {
+	LedgerStore
+	userID string
+}
+
+func (s failingLedgerStore) ListTransactions(ctx context.Context, query TransactionQuery) (TransactionPage, error) {
+	if query.UserID == s.userID {
+		return TransactionPage{}, errors.New("throttled")
+	}
+	return s.LedgerStore.ListTransactions(ctx, query)
+}
+
+func TestReconcileFindsAndFixesDrift(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com","wallet_amount":"10"}`)
+	mustInvoke(t, "createUser", `{"user_id":"user-2","email":"two@example.com","wallet_amount":"5"}`)
+
+	// Move user-2's wallet without a ledger entry
+	user := getTestUser(t, "user-2")
+	user.WalletAmount = newMoney(7000000, "USD")
+	userStore.DeleteUser(ctx, "user-2")
+	userStore.CreateUser(ctx, user)
+
+	report, err := reconcileWallets(ctx, true)
+	if err != nil {
+		t.Fatalf("reconcileWallets failed, %v", err)
+	}
+	if report.UsersChecked != 2 || len(report.Errors) != 0 {
+		t.Fatalf("report = %+v, want two users checked", report)
+	}
+	if len(report.Drifted) != 1 || report.Drifted[0].UserID != "user-2" || report.Drifted[0].Drift != newMoney(2000000, "USD") || !report.Drifted[0].Corrected {
+		t.Fatalf("drifted = %+v, want user-2 corrected by 2", report.Drifted)
+	}
+
+	report, err = reconcileWallets(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Drifted) != 0 {
+		t.Errorf("drifted after the fix = %+v", report.Drifted)
+	}
+}
+
+func TestReconcileCarriesOnPastFailingUser(t *testing.T) {
+	resetStores(t)
+
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com","wallet_amount":"10"}`)
+	mustInvoke(t, "createUser", `{"user_id":"user-2","email":"two@example.com","wallet_amount":"5"}`)
+	mustInvoke(t, "createUser", `{"user_id":"user-3","email":"three@example.com"}`)
+	ledgerStore = failingLedgerStore{LedgerStore: ledgerStore, userID: "user-2"}
+
+	report, err := reconcileWallets(context.Background(), false)
+	if err != nil {
+		t.Fatalf("reconcileWallets failed, %v", err)
+	}
+	if report.UsersChecked != 2 {
+		t.Errorf("users checked = %d, want 2", report.UsersChecked)
+	}
+	if len(report.Errors) != 1 || report.Errors[0].UserID != "user-2" {
+		t.Errorf("errors = %+v, want user-2", report.Errors)
+	}
+}
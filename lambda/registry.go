@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// HandlerFunc runs one invocation of an operation.
+type HandlerFunc func(ctx context.Context, inv *Invocation) (string, error)
+
+// Middleware wraps a HandlerFunc with cross-cutting behaviour such as
+// logging or authorization.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Operation is a named unit of work the handler can dispatch to, together
+// with the metadata middleware uses to decide how to run it.
+type Operation struct {
+	Name string
+	// RequiredRole is the Cognito group the caller must belong to. Empty
+	// means any authenticated caller may run the operation.
+	RequiredRole string
+	// OnBehalfRole is the Cognito group allowed to run a self-service
+	// operation for a user other than themselves.
+	OnBehalfRole string
+	// RequiredScope is the OAuth scope the caller's token must carry. Empty
+	// means no scope is required.
+	RequiredScope string
+	// AcceptsApiKey operations can be called on API key routes, where the
+	// caller authenticated with an API key instead of a Cognito token.
+	AcceptsApiKey bool
+	// AcceptsIdempotencyKey operations replay their stored result when a
+	// request is repeated with the same idempotency key.
+	AcceptsIdempotencyKey bool
+	Handler               HandlerFunc
+}
+
+// Invocation is what flows through the middleware chain: the request as it
+// arrived and the operation it was resolved to.
+type Invocation struct {
+	Operation *Operation
+	Request   Request
+}
+
+// Registry maps operation names to operations and runs every dispatch
+// through the same middleware chain.
+type Registry struct {
+	operations map[string]*Operation
+	middleware []Middleware
+}
+
+func newRegistry() *Registry {
+	return &Registry{operations: map[string]*Operation{}}
+}
+
+// Register adds op to the registry. Registering the same name twice is a
+// programming error and panics.
+func (r *Registry) Register(op Operation) {
+	if _, exists := r.operations[op.Name]; exists {
+		panic(fmt.Sprintf("operation %q registered twice", op.Name))
+	}
+	r.operations[op.Name] = &op
+}
+
+// Use appends middleware to the chain. The first middleware added is the
+// outermost one.
+func (r *Registry) Use(middleware ...Middleware) {
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// Operation returns the registered operation with the given name.
+func (r *Registry) Operation(name string) (*Operation, bool) {
+	op, ok := r.operations[name]
+	return op, ok
+}
+
+// Dispatch resolves the request to an operation and runs it through the
+// middleware chain.
+func (r *Registry) Dispatch(ctx context.Context, request Request) (string, error) {
+	op, ok := r.operations[request.Operation]
+	if !ok {
+		return "", fmt.Errorf("invalid operation")
+	}
+
+	next := op.Handler
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		next = r.middleware[i](next)
+	}
+
+	return next(ctx, &Invocation{Operation: op, Request: request})
+}
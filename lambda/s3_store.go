@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// s3ObjectStore implements ObjectStore on the bucket created by
+// CreateExportsBucket.
+type s3ObjectStore struct {
+	s3       s3iface.S3API
+	uploader *s3manager.Uploader
+	bucket   string
+}
+
+func newS3ObjectStore(client s3iface.S3API, bucket string) *s3ObjectStore {
+	return &s3ObjectStore{
+		s3:       client,
+		uploader: s3manager.NewUploaderWithClient(client),
+		bucket:   bucket,
+	}
+}
+
+func (s *s3ObjectStore) PutObject(ctx context.Context, key string, contentType string, body io.Reader) error {
+	// The uploader switches to a multipart upload for large bodies, so the
+	// file is never held in memory in full.
+	_, err := s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+		Body:        body,
+	})
+	return err
+}
+
+func (s *s3ObjectStore) PresignGetObject(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	request, _ := s.s3.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	request.SetContext(ctx)
+	return request.Presign(expiry)
+}
+
+func (s *s3ObjectStore) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	deleted := 0
+	var deleteErr error
+	// A listed page holds at most 1,000 keys, which is as many as one
+	// DeleteObjects call takes.
+	err := s.s3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		if len(page.Contents) == 0 {
+			return true
+		}
+		objects := make([]*s3.ObjectIdentifier, 0, len(page.Contents))
+		for _, object := range page.Contents {
+			objects = append(objects, &s3.ObjectIdentifier{Key: object.Key})
+		}
+		output, err := s.s3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			deleteErr = err
+			return false
+		}
+		if len(output.Errors) > 0 {
+			failed := output.Errors[0]
+			deleteErr = fmt.Errorf("failed to delete %s, %s", aws.StringValue(failed.Key), aws.StringValue(failed.Message))
+			return false
+		}
+		deleted += len(objects)
+		return true
+	})
+	if err != nil {
+		return deleted, err
+	}
+	return deleted, deleteErr
+}
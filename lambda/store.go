@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	errUserNotFound   = errors.New("user not found")
+	errUserExists     = errors.New("user already exists")
+	errApiKeyNotFound = errors.New("API key not found")
+	errApiKeyExists   = errors.New("API key id already exists")
+	errApiKeyRevoked  = errors.New("API key has been revoked")
+	errApiKeyExpired  = errors.New("API key has expired")
+	// errTransactionExists is returned by LedgerStore.CreateTransaction.
+	errTransactionExists = errors.New("transaction id already exists")
+	// errQuotaLimitReached is returned by UsageStore.CountCall; callers
+	// turn it into errQuotaExceeded.
+	errQuotaLimitReached = errors.New("usage quota reached")
+)
+
+// UserStore persists user profiles and their wallet balances.
+type UserStore interface {
+	// CreateUser stores a new user, failing with errUserExists rather than
+	// overwriting an existing one.
+	CreateUser(ctx context.Context, user User) error
+	GetUser(ctx context.Context, userID string) (User, error)
+	SetCreditLimit(ctx context.Context, userID string, creditLimit Money) error
+	SetPlan(ctx context.Context, userID string, planID string) error
+	SetStatus(ctx context.Context, userID string, status string) error
+	// DeleteUser removes the user's row. Deleting a user that does not
+	// exist is not an error.
+	DeleteUser(ctx context.Context, userID string) error
+	// ListUsers returns up to limit users after the given user id, and the
+	// id to continue from, which is empty once every user has been listed.
+	ListUsers(ctx context.Context, after string, limit int) (users []User, next string, err error)
+}
+
+// ApiKeyStore persists hashed API keys, looked up by their key id.
+type ApiKeyStore interface {
+	// CreateApiKey stores a new key, failing with errApiKeyExists rather
+	// than overwriting a key with the same id.
+	CreateApiKey(ctx context.Context, key ApiKey) error
+	GetApiKey(ctx context.Context, keyID string) (ApiKey, error)
+	// RevokeApiKey marks an active key revoked and expires it at revokedAt.
+	// Like the updates below it changes only the attributes it sets, and
+	// fails with errApiKeyNotActive if the key is no longer active.
+	RevokeApiKey(ctx context.Context, keyID string, revokedAt time.Time) error
+	// RotateApiKey records the key's replacement and when the key stops
+	// working. A key that was already rotated fails with errApiKeyRotated.
+	RotateApiKey(ctx context.Context, keyID string, replacedBy string, expiresAt time.Time) error
+	// SetApiKeyExpiry sets, or with nil clears, the expiry of an active
+	// key. A rotated key fails with errApiKeyRotated, as its expiry ends
+	// the rotation's grace period.
+	SetApiKeyExpiry(ctx context.Context, keyID string, expiresAt *time.Time) error
+	// TouchApiKey records that the key was used at the given time.
+	TouchApiKey(ctx context.Context, keyID string, usedAt time.Time) error
+	ListApiKeys(ctx context.Context, userID string) ([]ApiKey, error)
+	DeleteApiKey(ctx context.Context, keyID string) error
+}
+
+// LedgerStore persists the double-entry journal and the per-user wallet
+// history derived from it. Wallet balances only change through PostEntry, so
+// every balance change has matching journal and history records.
+type LedgerStore interface {
+	// PostEntry writes a balanced journal entry, applies its wallet
+	// postings to the users' balances and records their history rows, all
+	// atomically. A wallet debit that the balance and credit limit cannot
+	// cover fails with errInsufficientFunds, and a posting in a currency
+	// other than the wallet's with errCurrencyMismatch; either changes
+	// nothing. A second reversal of the same entry fails with
+	// errAlreadyReversed.
+	PostEntry(ctx context.Context, entry JournalEntry) error
+	// RecordEntry writes the entry and its history rows without changing
+	// wallet balances, for movements the balances already reflect.
+	RecordEntry(ctx context.Context, entry JournalEntry) error
+	GetEntry(ctx context.Context, entryID string) (JournalEntry, error)
+	// CreateTransaction records a memo transaction without touching the
+	// wallet or the journal. Memos move no money, so they have no journal
+	// entry, but like entries they are never changed once written: it fails
+	// with errTransactionExists rather than replacing an existing row.
+	CreateTransaction(ctx context.Context, transaction Transaction) error
+	// ListTransactions returns one page of the user's transactions, newest
+	// first, matching the query's filters.
+	ListTransactions(ctx context.Context, query TransactionQuery) (TransactionPage, error)
+	// RedactTransaction replaces the description of one of the user's
+	// history rows. Nothing else about the row, and nothing in the journal,
+	// is changed.
+	RedactTransaction(ctx context.Context, userID string, transactionID string, description string) error
+}
+
+// IdempotencyStore records the outcome of requests made with an idempotency
+// key. Records expire through their TTL.
+type IdempotencyStore interface {
+	// ClaimIdempotencyKey stores record unless the key is already held by a
+	// live record, in which case that record is returned with claimed false.
+	// An in-progress record whose lock has passed at now can be claimed.
+	ClaimIdempotencyKey(ctx context.Context, record IdempotencyRecord, now time.Time) (existing IdempotencyRecord, claimed bool, err error)
+	// CompleteIdempotencyKey replaces the claim with the finished record.
+	CompleteIdempotencyKey(ctx context.Context, record IdempotencyRecord) error
+	// ReleaseIdempotencyKey drops a claim so the request can be retried.
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
+}
+
+// PlanStore persists the subscription plans users can be assigned.
+type PlanStore interface {
+	GetPlan(ctx context.Context, planID string) (Plan, error)
+	PutPlan(ctx context.Context, plan Plan) error
+}
+
+// PriceStore persists the price tables of metered operations.
+type PriceStore interface {
+	GetPriceTable(ctx context.Context, operation string) (PriceTable, error)
+	PutPriceTable(ctx context.Context, table PriceTable) error
+}
+
+// UsageStore meters each user's calls per billing period.
+type UsageStore interface {
+	// CountCall adds one call to the user's usage for the period and
+	// returns the new count. With a limit above zero, a call that would
+	// take the count past it fails with errQuotaLimitReached and is not
+	// counted.
+	CountCall(ctx context.Context, userID string, period string, limit int64) (int64, error)
+	// ReleaseCall takes back one call counted by CountCall.
+	ReleaseCall(ctx context.Context, userID string, period string) error
+	// AddUsageCost adds cost to the period's metered cost and returns the
+	// new total.
+	AddUsageCost(ctx context.Context, userID string, period string, cost Money) (Money, error)
+	// GetUsage returns the period's usage, which is empty if there was none.
+	GetUsage(ctx context.Context, userID string, period string) (Usage, error)
+	// DeleteUsage removes every period of the user's usage and returns how
+	// many there were.
+	DeleteUsage(ctx context.Context, userID string) (int, error)
+}
+
+// RateLimitStore keeps limiter state shared by every Lambda instance.
+type RateLimitStore interface {
+	// TakeRateLimit takes one request from the limiter named by key. When
+	// the limit is exhausted nothing is taken and retryAfter says how long
+	// until the next request would be allowed.
+	TakeRateLimit(ctx context.Context, key string, limit RateLimit, now time.Time) (allowed bool, retryAfter time.Duration, err error)
+}
+
+// ObjectStore holds generated files, such as exports, and hands out
+// time-limited download links for them.
+type ObjectStore interface {
+	// PutObject uploads everything read from body, streaming it rather than
+	// buffering the whole file.
+	PutObject(ctx context.Context, key string, contentType string, body io.Reader) error
+	// PresignGetObject returns a URL that downloads the object until it
+	// expires.
+	PresignGetObject(ctx context.Context, key string, expiry time.Duration) (string, error)
+	// DeletePrefix deletes every object whose key starts with prefix and
+	// returns how many there were.
+	DeletePrefix(ctx context.Context, prefix string) (int, error)
+}
+
+// UserDirectory manages users' sign-in identities in the Cognito user pool,
+// where a user's username is their user id. Users created without signing
+// up have no identity, which every method treats as already done.
+type UserDirectory interface {
+	// DisableUser stops the user signing in and signs out their existing
+	// sessions.
+	DisableUser(ctx context.Context, userID string) error
+	DeleteUser(ctx context.Context, userID string) error
+	// GetUserAttributes returns the attributes Cognito holds for the
+	// user, which are empty for a user without an identity.
+	GetUserAttributes(ctx context.Context, userID string) (map[string]string, error)
+}
+
+var (
+	userStore        UserStore
+	apiKeyStore      ApiKeyStore
+	ledgerStore      LedgerStore
+	idempotencyStore IdempotencyStore
+	rateLimitStore   RateLimitStore
+	planStore        PlanStore
+	usageStore       UsageStore
+	priceStore       PriceStore
+	objectStore      ObjectStore
+	userDirectory    UserDirectory
+)
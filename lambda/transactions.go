@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Transaction types, recorded on every transaction so history can be
+// filtered by what caused it.
+const (
+	transactionTypeTopUp      = "top_up"
+	transactionTypeAdjustment = "adjustment"
+	transactionTypeUsage      = "usage"
+	transactionTypeManual     = "manual"
+	// transactionTypeOpeningBalance records the balance a user was
+	// created with.
+	transactionTypeOpeningBalance = "opening_balance"
+	// transactionTypeReconciliation settles drift found between a wallet
+	// and its ledger.
+	transactionTypeReconciliation = "reconciliation"
+	// transactionTypeReversal undoes an earlier transaction.
+	transactionTypeReversal = "reversal"
+	// transactionTypeAccountClosure moves what is left in the wallet of a
+	// deleted account to suspense.
+	transactionTypeAccountClosure = "account_closure"
+)
+
+var transactionTypes = []string{
+	transactionTypeTopUp,
+	transactionTypeAdjustment,
+	transactionTypeUsage,
+	transactionTypeManual,
+	transactionTypeOpeningBalance,
+	transactionTypeReconciliation,
+	transactionTypeReversal,
+	transactionTypeAccountClosure,
+}
+
+// legacyTransactionType infers the type of a transaction written before
+// types were recorded from the description the operations used.
+func legacyTransactionType(description string) string {
+	switch description {
+	case "wallet top-up":
+		return transactionTypeTopUp
+	case "wallet adjustment":
+		return transactionTypeAdjustment
+	case "api call cost":
+		return transactionTypeUsage
+	default:
+		return transactionTypeManual
+	}
+}
+
+const (
+	defaultTransactionPageSize = 25
+	maxTransactionPageSize     = 100
+)
+
+// TransactionQuery selects one page of a user's transactions, newest first.
+// Zero-valued filters match everything.
+type TransactionQuery struct {
+	UserID string
+	// From and To bound the transaction time, inclusive.
+	From *time.Time
+	To   *time.Time
+	// Types limits results to the listed transaction types.
+	Types []string
+	// MinAmount and MaxAmount bound the signed amount, inclusive.
+	MinAmount *Money
+	MaxAmount *Money
+	Limit     int
+	// After resumes the listing after this transaction id.
+	After string
+}
+
+// TransactionPage is a page of transactions and where the next page starts.
+// Next is empty on the last page.
+type TransactionPage struct {
+	Transactions []Transaction
+	Next         string
+}
+
+// matches applies the query's filters to a single transaction, for stores
+// that cannot filter natively.
+func (q TransactionQuery) matches(transaction Transaction) bool {
+	if q.From != nil && transaction.TransactionID < transactionIDLowerBound(*q.From) {
+		return false
+	}
+	if q.To != nil && transaction.TransactionID > transactionIDUpperBound(*q.To) {
+		return false
+	}
+	if len(q.Types) > 0 && !contains(q.Types, transaction.Type) {
+		return false
+	}
+	// Amount bounds only match transactions in their currency
+	if q.MinAmount != nil {
+		less, err := transaction.Amount.LessThan(*q.MinAmount)
+		if err != nil || less {
+			return false
+		}
+	}
+	if q.MaxAmount != nil {
+		less, err := q.MaxAmount.LessThan(transaction.Amount)
+		if err != nil || less {
+			return false
+		}
+	}
+	return true
+}
+
+// Transaction ids are ULIDs, so a time range is a range of ids.
+func transactionIDLowerBound(at time.Time) string {
+	return ulidFromEntropy(at, [10]byte{})
+}
+
+func transactionIDUpperBound(at time.Time) string {
+	return ulidFromEntropy(at, [10]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+}
+
+// encodePageToken hides the store cursor from callers so its format can
+// change without breaking them.
+func encodePageToken(after string) string {
+	if after == "" {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(after))
+}
+
+func decodePageToken(token string) (string, bool) {
+	after, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(after) != 26 || strings.Trim(string(after), ulidAlphabet) != "" {
+		return "", false
+	}
+	return string(after), true
+}
+
+func getTransactionHistory(ctx context.Context, query TransactionQuery) (string, error) {
+	page, err := ledgerStore.ListTransactions(ctx, query)
+	if err != nil {
+		return "", fmt.Errorf("failed to query transaction history, %v", err)
+	}
+
+	pageJson, err := json.Marshal(struct {
+		Transactions []Transaction `json:"transactions"`
+		NextToken    string        `json:"next_token,omitempty"`
+	}{
+		Transactions: page.Transactions,
+		NextToken:    encodePageToken(page.Next),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal transactions JSON, %v", err)
+	}
+
+	return string(pageJson), nil
+}
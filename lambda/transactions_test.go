@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+type historyPage struct {
+	Transactions []Transaction `json:"transactions"`
+	NextToken    string        `json:"next_token"`
+}
+
+func getHistoryPage(t *testing.T, payload string) historyPage {
+	t.Helper()
+	page := historyPage{}
+	if err := json.Unmarshal([]byte(mustInvoke(t, "getTransactionHistory", payload)), &page); err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+func TestTransactionHistoryPages(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com"}`)
+	for i := 1; i <= 5; i++ {
+		if err := postWalletEntry(ctx, "user-1", newMoney(int64(i)*1000000, "USD"), accountPromotions, transactionTypeTopUp, "wallet top-up"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := map[string]bool{}
+	previous := ""
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("paging did not end")
+		}
+		page := getHistoryPage(t, fmt.Sprintf(`{"user_id":"user-1","page_size":2,"next_token":%q}`, token))
+		for _, transaction := range page.Transactions {
+			if seen[transaction.TransactionID] {
+				t.Errorf("%s listed twice", transaction.TransactionID)
+			}
+			if previous != "" && transaction.TransactionID > previous {
+				t.Errorf("%s listed after %s, want newest first", transaction.TransactionID, previous)
+			}
+			seen[transaction.TransactionID] = true
+			previous = transaction.TransactionID
+		}
+		if page.NextToken == "" {
+			break
+		}
+		token = page.NextToken
+	}
+	if len(seen) != 5 {
+		t.Errorf("listed %d transactions, want 5", len(seen))
+	}
+}
+
+func TestTransactionHistoryFilters(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com"}`)
+	if err := postWalletEntry(ctx, "user-1", newMoney(1000000, "USD"), accountPromotions, transactionTypeTopUp, "wallet top-up"); err != nil {
+		t.Fatal(err)
+	}
+	if err := postWalletEntry(ctx, "user-1", newMoney(5000000, "USD"), accountPromotions, transactionTypeTopUp, "wallet top-up"); err != nil {
+		t.Fatal(err)
+	}
+
+	page := getHistoryPage(t, `{"user_id":"user-1","types":["top_up"],"min_amount":{"amount":"2","currency":"USD"}}`)
+	if len(page.Transactions) != 1 || page.Transactions[0].Amount != newMoney(5000000, "USD") {
+		t.Errorf("filtered to %+v, want the 5 top-up", page.Transactions)
+	}
+
+	_, err := invoke(t, "getTransactionHistory", `{"user_id":"user-1","next_token":"not a token"}`)
+	if errorCode(err) != "VALIDATION_ERROR" {
+		t.Errorf("bad token error = %v, want a ValidationError", err)
+	}
+}
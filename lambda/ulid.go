@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transaction ids are ULIDs: a 48 bit millisecond timestamp followed by 80
+// random bits, written as 26 Crockford base32 characters. They sort by time
+// as plain strings, and ids made in the same millisecond by one process are
+// kept in order by incrementing the random part.
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+type ulid [16]byte
+
+var ulidState struct {
+	mu   sync.Mutex
+	last ulid
+}
+
+func newULID(now time.Time) (string, error) {
+	ulidState.mu.Lock()
+	defer ulidState.mu.Unlock()
+
+	ms := uint64(now.UnixMilli())
+	last := ulidState.last
+	if ms == ulidTime(last) {
+		next, ok := incrementULID(last)
+		if ok {
+			ulidState.last = next
+			return next.String(), nil
+		}
+		// The random part overflowed, fall through to a fresh one
+	}
+
+	id := ulid{}
+	putULIDTime(&id, ms)
+	_, err := rand.Read(id[6:])
+	if err != nil {
+		return "", fmt.Errorf("failed to generate transaction id, %v", err)
+	}
+	ulidState.last = id
+	return id.String(), nil
+}
+
+// ulidFromEntropy builds a ULID from a timestamp and caller supplied random
+// bytes, so the same input always produces the same id.
+func ulidFromEntropy(at time.Time, entropy [10]byte) string {
+	id := ulid{}
+	putULIDTime(&id, uint64(at.UnixMilli()))
+	copy(id[6:], entropy[:])
+	return id.String()
+}
+
+func ulidTime(id ulid) uint64 {
+	return uint64(id[0])<<40 | uint64(id[1])<<32 | uint64(binary.BigEndian.Uint32(id[2:6]))
+}
+
+func putULIDTime(id *ulid, ms uint64) {
+	id[0] = byte(ms >> 40)
+	id[1] = byte(ms >> 32)
+	binary.BigEndian.PutUint32(id[2:6], uint32(ms))
+}
+
+func incrementULID(id ulid) (ulid, bool) {
+	for i := len(id) - 1; i >= 6; i-- {
+		id[i]++
+		if id[i] != 0 {
+			return id, true
+		}
+	}
+	return id, false
+}
+
+func (id ulid) String() string {
+	// 128 bits encode to 26 characters of 5 bits each, the first holding
+	// only the top 3 bits.
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	out := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		out[i] = ulidAlphabet[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
+
+// ulidTimestamp returns the time encoded in the first ten characters of a
+// ULID string.
+func ulidTimestamp(id string) (time.Time, bool) {
+	if len(id) != 26 {
+		return time.Time{}, false
+	}
+	ms := uint64(0)
+	for i := 0; i < 10; i++ {
+		value := strings.IndexByte(ulidAlphabet, id[i])
+		if value < 0 {
+			return time.Time{}, false
+		}
+		ms = ms<<5 | uint64(value)
+	}
+	return time.UnixMilli(int64(ms)).UTC(), true
+}
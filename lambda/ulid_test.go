@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestULIDsSortInCreationOrder(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	previous := ""
+	for i := 0; i < 1000; i++ {
+		at := now
+		if i >= 500 {
+			at = now.Add(time.Millisecond)
+		}
+		id, err := newULID(at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(id) != 26 {
+			t.Fatalf("id %q is not 26 characters", id)
+		}
+		if id <= previous {
+			t.Fatalf("id %s does not sort after %s", id, previous)
+		}
+		previous = id
+	}
+}
+
+func TestULIDTimestampRoundTrips(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 123000000, time.UTC)
+	id := ulidFromEntropy(at, [10]byte{1, 2, 3})
+	if decoded, ok := ulidTimestamp(id); !ok || !decoded.Equal(at) {
+		t.Errorf("ulidTimestamp(%s) = %v, want %v", id, decoded, at)
+	}
+	if id != ulidFromEntropy(at, [10]byte{1, 2, 3}) {
+		t.Error("the same entropy gave two ids")
+	}
+	if _, ok := ulidTimestamp("01MEMO"); ok {
+		t.Error("a short id decoded")
+	}
+}
+
+func TestIncrementULIDOverflow(t *testing.T) {
+	id := ulid{}
+	for i := 6; i < len(id); i++ {
+		id[i] = 0xff
+	}
+	if _, ok := incrementULID(id); ok {
+		t.Error("incrementing the largest random part did not overflow")
+	}
+}
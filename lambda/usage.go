@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// usagePeriodLayout names a billing period, which is a calendar month in
+// UTC.
+const usagePeriodLayout = "2006-01"
+
+// Usage is what a user consumed in one billing period.
+type Usage struct {
+	UserID string
+	Period string
+	Calls  int64
+	// Cost is the metered cost of the calls before included credit and
+	// overage charges.
+	Cost Money
+}
+
+// UsageReport is the result of getUsage.
+type UsageReport struct {
+	UserID                  string    `json:"user_id"`
+	Plan                    string    `json:"plan"`
+	Period                  string    `json:"period"`
+	PeriodEnds              time.Time `json:"period_ends"`
+	Calls                   int64     `json:"calls"`
+	CallQuota               int64     `json:"call_quota"`
+	CallsRemaining          int64     `json:"calls_remaining"`
+	OverageCalls            int64     `json:"overage_calls"`
+	UsageCost               Money     `json:"usage_cost"`
+	IncludedCredit          Money     `json:"included_credit"`
+	IncludedCreditRemaining Money     `json:"included_credit_remaining"`
+	OverageCharges          Money     `json:"overage_charges"`
+}
+
+func usagePeriod(at time.Time) string {
+	return at.UTC().Format(usagePeriodLayout)
+}
+
+// usagePeriodEnd returns the start of the month after period.
+func usagePeriodEnd(period string) (time.Time, error) {
+	start, err := time.Parse(usagePeriodLayout, period)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return start.AddDate(0, 1, 0), nil
+}
+
+// errQuotaExceeded tells the caller their plan's calls are used up until
+// the next period starts.
+func errQuotaExceeded(plan Plan, retryAfter time.Duration) error {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	return &OperationError{
+		Code:              "QUOTA_EXCEEDED",
+		Message:           fmt.Sprintf("the %s plan's %d calls for this month are used up", plan.PlanID, plan.MonthlyCallQuota),
+		RetryAfterSeconds: seconds,
+	}
+}
+
+// countCall records one call against the user's quota for the current
+// period. It reports whether the call is beyond the quota, which only plans
+// with an overage price allow.
+func countCall(ctx context.Context, userID string, plan Plan, now time.Time) (bool, error) {
+	period := usagePeriod(now)
+	limit := plan.MonthlyCallQuota
+	if plan.allowsOverage() {
+		limit = 0
+	}
+
+	calls, err := usageStore.CountCall(ctx, userID, period, limit)
+	if err == errQuotaLimitReached {
+		end, _ := usagePeriodEnd(period)
+		return false, errQuotaExceeded(plan, end.Sub(now))
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to count call, %v", err)
+	}
+	return calls > plan.MonthlyCallQuota, nil
+}
+
+// releaseCall gives back a counted call's place in the quota, and the cost
+// metered for it, when the call was not charged. Failures are only logged;
+// the caller is already reporting the error that stopped the call.
+func releaseCall(ctx context.Context, userID string, now time.Time, metered Money) {
+	period := usagePeriod(now)
+	err := usageStore.ReleaseCall(ctx, userID, period)
+	if err != nil {
+		log.Printf("failed to release call, user_id=%s, %v", userID, err)
+	}
+	if metered.IsZero() {
+		return
+	}
+	_, err = usageStore.AddUsageCost(ctx, userID, period, metered.Neg())
+	if err != nil {
+		log.Printf("failed to release metered cost, user_id=%s, %v", userID, err)
+	}
+}
+
+// chargeableCost meters cost against the user's usage for the current
+// period and returns the part of it the plan's included credit does not
+// cover. Each call's cost takes its own slice of the running total, so
+// concurrent calls never share the same credit.
+func chargeableCost(ctx context.Context, user User, plan Plan, cost Money, now time.Time) (Money, error) {
+	currency := user.WalletAmount.Currency
+	cost, err := inCurrency(cost, currency)
+	if err != nil {
+		return Money{}, err
+	}
+	credit, err := inCurrency(plan.IncludedCredit, currency)
+	if err != nil {
+		return Money{}, err
+	}
+	total, err := usageStore.AddUsageCost(ctx, user.UserID, usagePeriod(now), cost)
+	if err != nil {
+		return Money{}, fmt.Errorf("failed to meter usage, %v", err)
+	}
+
+	used, err := total.Sub(cost)
+	if err != nil {
+		return Money{}, err
+	}
+	return uncoveredCost(credit, used, cost)
+}
+
+// uncoveredCost returns the part of cost left once whatever is left of
+// credit, after used has been taken from it, has been applied.
+func uncoveredCost(credit Money, used Money, cost Money) (Money, error) {
+	remaining, err := credit.Sub(used)
+	if err != nil {
+		return Money{}, err
+	}
+	if remaining.IsNegative() || remaining.IsZero() {
+		return cost, nil
+	}
+	short, err := remaining.LessThan(cost)
+	if err != nil {
+		return Money{}, err
+	}
+	if short {
+		return cost.Sub(remaining)
+	}
+	return newMoney(0, cost.Currency), nil
+}
+
+func getUsage(ctx context.Context, userID string, period string) (string, error) {
+	user, err := userStore.GetUser(ctx, userID)
+	if err == errUserNotFound {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get user, %v", err)
+	}
+
+	plan, err := getPlan(ctx, user.planID())
+	if err != nil {
+		return "", fmt.Errorf("failed to get plan, %v", err)
+	}
+
+	if period == "" {
+		period = usagePeriod(time.Now())
+	}
+	end, err := usagePeriodEnd(period)
+	if err != nil {
+		return "", fmt.Errorf("invalid usage period, %v", err)
+	}
+
+	usage, err := usageStore.GetUsage(ctx, userID, period)
+	if err != nil {
+		return "", fmt.Errorf("failed to get usage, %v", err)
+	}
+
+	currency := user.WalletAmount.Currency
+	report := UsageReport{
+		UserID:     userID,
+		Plan:       plan.PlanID,
+		Period:     period,
+		PeriodEnds: end,
+		Calls:      usage.Calls,
+		CallQuota:  plan.MonthlyCallQuota,
+	}
+	report.UsageCost, err = inCurrency(usage.Cost, currency)
+	if err != nil {
+		return "", err
+	}
+	report.IncludedCredit, err = inCurrency(plan.IncludedCredit, currency)
+	if err != nil {
+		return "", err
+	}
+	overagePrice, err := inCurrency(plan.OveragePrice, currency)
+	if err != nil {
+		return "", err
+	}
+	if usage.Calls < plan.MonthlyCallQuota {
+		report.CallsRemaining = plan.MonthlyCallQuota - usage.Calls
+	} else {
+		report.OverageCalls = usage.Calls - plan.MonthlyCallQuota
+	}
+	report.IncludedCreditRemaining, err = report.IncludedCredit.Sub(report.UsageCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute remaining credit, %v", err)
+	}
+	if report.IncludedCreditRemaining.IsNegative() {
+		report.IncludedCreditRemaining = newMoney(0, currency)
+	}
+	report.OverageCharges, err = overagePrice.MulRatio(report.OverageCalls, 1)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute overage charges, %v", err)
+	}
+
+	reportJson, err := json.Marshal(report)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal usage JSON, %v", err)
+	}
+
+	return string(reportJson), nil
+}
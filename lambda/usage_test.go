@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// failingPricingEngine prices the up-front quote and fails every later call.
+type failingPricingEngine struct {
+	PricingEngine
+	priced int
+}
+
+func (e *failingPricingEngine) Price(ctx context.Context, call MeteredCall) (Price, error) {
+	e.priced++
+	if e.priced > 1 {
+		return Price{}, errors.New("price table unavailable")
+	}
+	return e.PricingEngine.Price(ctx, call)
+}
+
+// failingPostLedgerStore fails to post every entry.
+type failingPostLedgerStore struct {
+	LedgerStore
+}
+
+func (s failingPostLedgerStore) PostEntry(ctx context.Context, entry JournalEntry) error {
+	return errors.New("transaction cancelled")
+}
+
+// newCallingUser creates user-1 with a wallet and returns one of their keys.
+func newCallingUser(t *testing.T) string {
+	t.Helper()
+	mustInvoke(t, "createUser", `{"user_id":"user-1","email":"one@example.com","wallet_amount":"10"}`)
+	generated, err := issueApiKey(context.Background(), "user-1", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return generated.ApiKey
+}
+
+func currentUsage(t *testing.T) Usage {
+	t.Helper()
+	usage, err := usageStore.GetUsage(context.Background(), "user-1", usagePeriod(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return usage
+}
+
+func TestCallAPICountsChargedCall(t *testing.T) {
+	resetStores(t)
+	apiKey := newCallingUser(t)
+
+	if _, err := callAPI(context.Background(), apiKey, false); err != nil {
+		t.Fatalf("callAPI failed, %v", err)
+	}
+	if usage := currentUsage(t); usage.Calls != 1 || usage.Cost.IsZero() {
+		t.Errorf("usage = %+v, want one metered call", usage)
+	}
+}
+
+func TestCallAPIReleasesCallWhenPricingFails(t *testing.T) {
+	resetStores(t)
+	apiKey := newCallingUser(t)
+	pricingEngine = &failingPricingEngine{PricingEngine: pricingEngine}
+
+	if _, err := callAPI(context.Background(), apiKey, false); err == nil {
+		t.Fatal("callAPI succeeded without a price")
+	}
+	if usage := currentUsage(t); usage.Calls != 0 {
+		t.Errorf("calls = %d, the failed call used up quota", usage.Calls)
+	}
+}
+
+func TestCallAPIReleasesCallAndCostWhenChargeFails(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	apiKey := newCallingUser(t)
+
+	// Use up the free plan's included credit so the call is charged
+	used := newMoney(microsPerUnit, "USD")
+	if _, err := usageStore.AddUsageCost(ctx, "user-1", usagePeriod(time.Now()), used); err != nil {
+		t.Fatal(err)
+	}
+	ledgerStore = failingPostLedgerStore{LedgerStore: ledgerStore}
+
+	if _, err := callAPI(ctx, apiKey, false); err == nil {
+		t.Fatal("callAPI succeeded without charging the wallet")
+	}
+	usage := currentUsage(t)
+	if usage.Calls != 0 {
+		t.Errorf("calls = %d, the failed call used up quota", usage.Calls)
+	}
+	if usage.Cost != used {
+		t.Errorf("metered cost = %v, want it back at %v", usage.Cost, used)
+	}
+}
+
+func TestCountCallEnforcesQuota(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	now := time.Now()
+	plan := Plan{PlanID: "tiny", MonthlyCallQuota: 2}
+
+	for i := 0; i < 2; i++ {
+		overage, err := countCall(ctx, "user-1", plan, now)
+		if err != nil || overage {
+			t.Fatalf("call %d: overage %v, error %v", i+1, overage, err)
+		}
+	}
+	_, err := countCall(ctx, "user-1", plan, now)
+	if errorCode(err) != "QUOTA_EXCEEDED" {
+		t.Fatalf("third call error = %v, want QUOTA_EXCEEDED", err)
+	}
+	if err.(*OperationError).RetryAfterSeconds <= 0 {
+		t.Error("quota error has no retry_after_seconds")
+	}
+
+	// With an overage price calls go past the quota and are flagged
+	plan.OveragePrice = newMoney(1000, "")
+	overage, err := countCall(ctx, "user-1", plan, now)
+	if err != nil || !overage {
+		t.Errorf("overage call: overage %v, error %v", overage, err)
+	}
+}
+
+func TestUncoveredCost(t *testing.T) {
+	credit := newMoney(1000, "USD")
+	tests := []struct {
+		used, cost, want int64
+	}{
+		{0, 400, 0},
+		{800, 400, 200},
+		{1000, 400, 400},
+		{1500, 400, 400},
+	}
+	for _, test := range tests {
+		got, err := uncoveredCost(credit, newMoney(test.used, "USD"), newMoney(test.cost, "USD"))
+		if err != nil || got.Micros != test.want {
+			t.Errorf("used %d, cost %d: charged %d, want %d", test.used, test.cost, got.Micros, test.want)
+		}
+	}
+}
+
+func TestCallAPIRefusesPricesInAnotherCurrency(t *testing.T) {
+	resetStores(t)
+	ctx := context.Background()
+	apiKey := newCallingUser(t)
+	if err := planStore.PutPlan(ctx, Plan{PlanID: planFree, Name: "Free", MonthlyCallQuota: 1000, IncludedCredit: newMoney(1000000, "EUR")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := invoke(t, "quote", `{"user_id":"user-1","operation":"callAPI"}`); err != errCurrencyMismatch {
+		t.Errorf("quote error = %v, want %v", err, errCurrencyMismatch)
+	}
+	before := getTestUser(t, "user-1").WalletAmount
+	if _, err := callAPI(ctx, apiKey, false); err == nil {
+		t.Fatal("callAPI succeeded with the included credit in EUR")
+	}
+	if after := getTestUser(t, "user-1").WalletAmount; after != before {
+		t.Errorf("wallet went from %v to %v", before, after)
+	}
+	if usage := currentUsage(t); usage.Calls != 0 {
+		t.Errorf("calls = %d, the refused call used up quota", usage.Calls)
+	}
+
+	resetStores(t)
+	newCallingUser(t)
+	if err := priceStore.PutPriceTable(ctx, PriceTable{Operation: "callAPI", BaseFee: newMoney(0, ""), PerSecond: newMoney(1000000, "EUR")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := invoke(t, "quote", `{"user_id":"user-1","operation":"callAPI"}`); err != errCurrencyMismatch {
+		t.Errorf("quote with the price in EUR error = %v, want %v", err, errCurrencyMismatch)
+	}
+}